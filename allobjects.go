@@ -0,0 +1,156 @@
+package gitwood
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ObjectInfo is an object found by ForEachObject.
+type ObjectInfo struct {
+	ShaSum Hash
+	// Pack is the name of the pack the object is in, or empty for loose objects.
+	Pack   string
+	repo   *Repo
+	pack   *Pack
+	offset uint64
+	// path is the file of a loose object.
+	path string
+}
+
+// Type returns the type of the object. Only object headers are read,
+// which for deltified objects are the headers of the entries in the delta chain.
+// It must be called from the function passed to ForEachObject, since the packs may be closed after it returns.
+func (o ObjectInfo) Type() (ObjectType, error) {
+	if o.pack != nil {
+		return o.repo.packedType(o.pack, o.offset)
+	}
+	otype, _, err := readLooseHeader(o.repo.storage(), o.path)
+	return otype, err
+}
+
+// ForEachObject calls fn for every object in the repo, including loose objects, packed objects and objects in alternates,
+// like `git cat-file --batch-all-objects`. Objects that are stored more than once are only passed the first time.
+// The objects aren't passed in any particular order. Iteration stops at the first error returned by fn, which is returned.
+func (r Repo) ForEachObject(fn func(ObjectInfo) error) error {
+	dirs, done := r.objectDirs()
+	defer done()
+	seen := map[Hash]bool{}
+	for _, d := range dirs {
+		err := d.packs.forEachPacked(func(p *Pack, sum Hash, off uint64) error {
+			if seen[sum] {
+				return nil
+			}
+			seen[sum] = true
+			return fn(ObjectInfo{ShaSum: sum, Pack: p.Name, repo: &r, pack: p, offset: off})
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachLooseID(r.storage(), d.path, r.hashSize(), func(sum Hash) error {
+			if seen[sum] {
+				return nil
+			}
+			seen[sum] = true
+			hexsum := sum.String()
+			return fn(ObjectInfo{ShaSum: sum, repo: &r, path: path.Join(d.path, hexsum[:2], hexsum[2:])})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachLooseID calls fn with the ID of every loose object in the objects directory.
+// Files that aren't named like objects are skipped.
+func forEachLooseID(fsys fs.FS, objectsDir string, hashSize int, fn func(Hash) error) error {
+	dirs, err := fs.ReadDir(fsys, objectsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		files, err := fs.ReadDir(fsys, path.Join(objectsDir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if len(f.Name()) != 2*hashSize-2 {
+				continue
+			}
+			id, err := ParseHash(d.Name() + f.Name())
+			if err != nil {
+				continue
+			}
+			if err = fn(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readLooseHeader returns the type and size of a loose object, only inflating its header.
+func readLooseHeader(fsys fs.FS, name string) (ObjectType, uint64, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return OBJ_INVALID, 0, err
+	}
+	defer file.Close()
+	buf := getBufReader(file)
+	defer putBufReader(buf)
+	zr, err := getZlibReader(buf)
+	if err != nil {
+		return OBJ_INVALID, 0, fmt.Errorf("%v: %w", name, err)
+	}
+	defer putZlibReader(zr)
+	// The longest header is "commit " and a 20 digit size.
+	hr := bufio.NewReaderSize(zr, 32)
+	otype, err := hr.ReadString(CHAR_SPACE)
+	var size string
+	if err == nil {
+		size, err = hr.ReadString(0)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = ErrMalformedObject
+		}
+		return OBJ_INVALID, 0, fmt.Errorf("%v: %w", name, err)
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(size, "\x00"), 10, 64)
+	if err != nil {
+		return OBJ_INVALID, 0, fmt.Errorf("%v: %w: bad size in header", name, ErrMalformedObject)
+	}
+	return ObjectTypeFromString(strings.TrimSuffix(otype, " ")), n, nil
+}
+
+// packedType returns the type of the packed object at the offset.
+// Deltas are followed to their base by reading entry headers, without inflating any data,
+// with the same limits as reading the object.
+func (r *Repo) packedType(p *Pack, off uint64) (ObjectType, error) {
+	c, l := newDeltaChain(r, p, off)
+	defer c.close()
+	for {
+		var err error
+		if l, err = c.read(l); err != nil {
+			if len(c.links) == 0 {
+				err = fmt.Errorf("failed to read pack entry at offset %d: %w", off, err)
+			}
+			return OBJ_INVALID, err
+		}
+		if l.h.otype != OBJ_OFS_DELTA && l.h.otype != OBJ_REF_DELTA {
+			return l.h.otype, nil
+		}
+		if l, err = c.next(l); err != nil {
+			return OBJ_INVALID, err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package gitwood_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// TestForEachObject lists a repo whose objects are loose, in two packs and in an alternate, many of them more than once.
+func TestForEachObject(t *testing.T) {
+	dir := t.TempDir()
+	gitdir := filepath.Join(dir, "repo")
+	want := map[gitwood.Hash]gitwood.ObjectType{}
+	write := func(b *gitwoodtest.Builder, gitdir string, opts gitwoodtest.Options) {
+		t.Helper()
+		if err := b.Write(gitdir, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, sum := range b.ObjectIDs() {
+			otype, _, _ := b.Content(sum)
+			want[sum] = otype
+		}
+	}
+	text := strings.Repeat("a line of text\n", 20)
+	history := func(b *gitwoodtest.Builder, n int) {
+		var parents []gitwood.Hash
+		for i := 0; i < n; i++ {
+			text += "more text\n"
+			tree := b.TreeFromFiles(map[string]string{"text": text, "dir/file": text + "in dir\n"})
+			parents = []gitwood.Hash{b.Commit(gitwoodtest.Commit{Tree: tree, Parents: parents, Message: "commit\n"})}
+		}
+		b.Ref("refs/heads/main", parents[0])
+		b.Tag(gitwoodtest.Tag{Name: "v1", Object: parents[0], Message: "v1\n"})
+	}
+	// The first commits are both loose and in a pack with ofs-deltas.
+	b := gitwoodtest.New()
+	history(b, 3)
+	write(b, gitdir, gitwoodtest.Options{})
+	write(b, gitdir, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas})
+	// A second pack has them again with ref-deltas, and more commits, some of which are also loose.
+	history(b, 2)
+	write(b, gitdir, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.RefDeltas})
+	loose := gitwoodtest.New()
+	loose.Blob(text)
+	loose.Blob("only loose\n")
+	write(loose, gitdir, gitwoodtest.Options{})
+	// The alternate has some of the objects of the repo, and its own.
+	alt := gitwoodtest.New()
+	alt.Blob(text)
+	alt.TreeFromFiles(map[string]string{"alternate": "only in the alternate\n"})
+	write(alt, filepath.Join(dir, "alt"), gitwoodtest.Options{Pack: true})
+	write(alt, filepath.Join(dir, "alt"), gitwoodtest.Options{})
+	writeAlternates(t, gitdir, "../../alt/objects")
+	if packs, err := filepath.Glob(filepath.Join(gitdir, "objects/pack/*.pack")); err != nil || len(packs) != 2 {
+		t.Fatalf("packs = %v, %v, want 2", packs, err)
+	}
+
+	repo := openRepo(t, gitdir)
+	seen := map[gitwood.Hash]int{}
+	err := repo.ForEachObject(func(o gitwood.ObjectInfo) error {
+		seen[o.ShaSum]++
+		otype, err := o.Type()
+		if err != nil || otype != want[o.ShaSum] {
+			t.Errorf("Type() of %v = %v, %v, want %v", o.ShaSum, otype, err, want[o.ShaSum])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sum, n := range seen {
+		if n != 1 {
+			t.Errorf("ForEachObject() passed %v %d times", sum, n)
+		}
+	}
+	if len(seen) != len(want) {
+		t.Errorf("ForEachObject() passed %d objects, want %d", len(seen), len(want))
+	}
+	for sum := range want {
+		if seen[sum] == 0 {
+			t.Errorf("ForEachObject() didn't pass %v", sum)
+		}
+	}
+
+	// An error stops the iteration, and is returned.
+	stop := errors.New("stop")
+	n := 0
+	err = repo.ForEachObject(func(o gitwood.ObjectInfo) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("ForEachObject() = %v after %d objects, want %v after 3", err, n, stop)
+	}
+}
@@ -0,0 +1,130 @@
+package gitwood
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxAlternateDepth is how deep alternates of alternates are followed, the same as in git.
+const maxAlternateDepth = 5
+
+// objectDir is an objects directory, either the repo's own or an alternate.
+type objectDir struct {
+	path  string
+	packs *PackStore
+}
+
+// readAlternates returns the alternate objects directories of the given objects directory,
+// in the order git searches them: first those given by GIT_ALTERNATE_OBJECT_DIRECTORIES,
+// then those listed in objects/info/alternates, recursively.
+// Relative paths are relative to the objects directory that lists them,
+// and directories that have already been seen are skipped, so that cycles end.
+// The environment variable only applies to repos on the OS file system.
+func readAlternates(fsys fs.FS, objectsDir string) []string {
+	seen := map[string]bool{alternateKey(fsys, objectsDir): true}
+	var dirs []string
+	var add func(dir string, depth int)
+	add = func(dir string, depth int) {
+		if seen[alternateKey(fsys, dir)] {
+			return
+		}
+		seen[alternateKey(fsys, dir)] = true
+		if fi, err := fs.Stat(fsys, dir); err != nil || !fi.IsDir() {
+			return
+		}
+		dirs = append(dirs, dir)
+		if depth < maxAlternateDepth {
+			for _, alt := range alternatesFile(fsys, dir) {
+				add(alt, depth+1)
+			}
+		}
+	}
+	if isOSFS(fsys) {
+		for _, dir := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+			if dir != "" {
+				add(dir, 0)
+			}
+		}
+	}
+	for _, alt := range alternatesFile(fsys, objectsDir) {
+		add(alt, 0)
+	}
+	return dirs
+}
+
+// alternatesFile reads objects/info/alternates in the given objects directory.
+// Blank lines and comments are skipped, and quoted paths are unquoted.
+// Outside the OS file system, absolute paths can't be followed and are skipped.
+func alternatesFile(fsys fs.FS, objectsDir string) []string {
+	data, err := fs.ReadFile(fsys, path.Join(objectsDir, "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '"' {
+			unquoted, err := strconv.Unquote(line)
+			if err != nil {
+				continue
+			}
+			line = unquoted
+		}
+		if !isOSFS(fsys) {
+			if !path.IsAbs(line) {
+				dirs = append(dirs, path.Join(objectsDir, line))
+			}
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectsDir, line)
+		}
+		dirs = append(dirs, filepath.Clean(line))
+	}
+	return dirs
+}
+
+// alternateKey returns the key used to detect directories that have already been seen.
+func alternateKey(fsys fs.FS, dir string) string {
+	if !isOSFS(fsys) {
+		return path.Clean(dir)
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return dir
+}
+
+func openObjectDirs(fsys fs.FS, gitdir string, hashSize int) []*objectDir {
+	objectsDir := path.Join(gitdir, "objects")
+	dirs := []*objectDir{{path: objectsDir, packs: newPackStore(fsys, path.Join(objectsDir, "pack"), hashSize)}}
+	for _, alt := range readAlternates(fsys, objectsDir) {
+		dirs = append(dirs, &objectDir{path: alt, packs: newPackStore(fsys, path.Join(alt, "pack"), hashSize)})
+	}
+	return dirs
+}
+
+// objectDirs returns the repo's objects directory followed by its alternates.
+// Repos that aren't created by Open read the alternates and open the packs on every call,
+// so the returned function must be called to close them when done.
+func (r Repo) objectDirs() ([]*objectDir, func()) {
+	if r.objects != nil {
+		return r.objects, func() {}
+	}
+	dirs := openObjectDirs(r.storage(), r.GitDir, r.hashSize())
+	return dirs, func() {
+		for _, d := range dirs {
+			d.packs.Close()
+		}
+	}
+}
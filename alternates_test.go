@@ -0,0 +1,100 @@
+package gitwood_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// writeAlternateRepos writes repos with the given names to a temporary directory, each with a blob of its name,
+// and returns the directory and the blobs.
+func writeAlternateRepos(t *testing.T, names ...string) (string, map[string]gitwood.Hash) {
+	t.Helper()
+	dir := t.TempDir()
+	blobs := map[string]gitwood.Hash{}
+	for _, name := range names {
+		b := gitwoodtest.New()
+		blobs[name] = b.Blob(name + "\n")
+		if err := b.Write(filepath.Join(dir, name), gitwoodtest.Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, blobs
+}
+
+// writeAlternates writes objects/info/alternates in the given repo.
+func writeAlternates(t *testing.T, gitdir string, alternates ...string) {
+	t.Helper()
+	info := filepath.Join(gitdir, "objects", "info")
+	if err := os.MkdirAll(info, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(info, "alternates"), []byte(strings.Join(alternates, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkObjects checks that the repo has the blobs of the named repos, and not those of the others.
+func checkObjects(t *testing.T, repo *gitwood.Repo, blobs map[string]gitwood.Hash, names ...string) {
+	t.Helper()
+	want := map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+	for name, sum := range blobs {
+		_, data, err := repo.Object(sum)
+		switch {
+		case want[name] && (err != nil || string(data) != name+"\n"):
+			t.Errorf("Object() of the blob of %v = %q, %v", name, data, err)
+		case !want[name] && !errors.Is(err, gitwood.ErrObjectNotFound):
+			t.Errorf("Object() of the blob of %v error = %v, want %v", name, err, gitwood.ErrObjectNotFound)
+		}
+	}
+}
+
+// TestAlternatesRelative checks that relative alternates are relative to the objects directory that lists them.
+func TestAlternatesRelative(t *testing.T) {
+	dir, blobs := writeAlternateRepos(t, "a", "b", "c", "d")
+	writeAlternates(t, filepath.Join(dir, "a"), "# comment", "", "../../b/objects")
+	writeAlternates(t, filepath.Join(dir, "b"), `"../../c/objects"`)
+	repo := openRepo(t, filepath.Join(dir, "a"))
+	checkObjects(t, repo, blobs, "a", "b", "c")
+	repo, err := gitwood.OpenFS(os.DirFS(dir), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	checkObjects(t, repo, blobs, "a", "b", "c")
+}
+
+// TestAlternatesCycle reads repos that are alternates of each other, which must not loop forever.
+func TestAlternatesCycle(t *testing.T) {
+	dir, blobs := writeAlternateRepos(t, "a", "b", "c")
+	writeAlternates(t, filepath.Join(dir, "a"), "../../b/objects")
+	writeAlternates(t, filepath.Join(dir, "b"), filepath.Join(dir, "a", "objects"), "../../c/objects")
+	checkObjects(t, openRepo(t, filepath.Join(dir, "a")), blobs, "a", "b", "c")
+	checkObjects(t, openRepo(t, filepath.Join(dir, "b")), blobs, "a", "b", "c")
+	// A repo that is its own alternate.
+	writeAlternates(t, filepath.Join(dir, "c"), "../../c/objects", ".")
+	checkObjects(t, openRepo(t, filepath.Join(dir, "c")), blobs, "c")
+}
+
+func TestAlternatesEnv(t *testing.T) {
+	dir, blobs := writeAlternateRepos(t, "a", "b", "c", "d")
+	writeAlternates(t, filepath.Join(dir, "a"), "../../d/objects")
+	env := filepath.Join(dir, "b", "objects") + string(os.PathListSeparator) + filepath.Join(dir, "c", "objects")
+	t.Setenv("GIT_ALTERNATE_OBJECT_DIRECTORIES", env)
+	checkObjects(t, openRepo(t, filepath.Join(dir, "a")), blobs, "a", "b", "c", "d")
+	// The environment variable doesn't apply to repos outside the OS file system.
+	repo, err := gitwood.OpenFS(os.DirFS(dir), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	checkObjects(t, repo, blobs, "a", "d")
+}
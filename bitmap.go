@@ -0,0 +1,501 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Reachability bitmap format (pack-*.bitmap and multi-pack-index-*.bitmap), see https://git-scm.com/docs/bitmap-format:
+//
+//	header: "BITM", 2 byte version, 2 byte flags, 4 byte number of entries, pack or multi-pack-index checksum
+//	type bitmaps: EWAH bitmaps of the commits, trees, blobs and tags
+//	entries: 4 byte index position of the commit, 1 byte XOR offset, 1 byte flags, EWAH bitmap
+//	(optional name hash cache and lookup table)
+//	trailer: checksum
+//
+// Bit i refers to the i'th object in pack order, i.e. sorted by pack offset.
+// For multi-pack bitmaps it's the pseudo-pack order given by the multi-pack-index RIDX chunk.
+// An entry with a non-zero XOR offset must be XORed with the bitmap of the entry that many entries before it.
+
+const (
+	bitmapHeaderSize = 12
+
+	bitmapOptFullDAG = 0x1
+)
+
+var bitmapSignature = []byte("BITM")
+
+type bitmapEntry struct {
+	xor int
+	raw []byte
+}
+
+// BitmapIndex is a parsed reachability bitmap, of a single pack or of a multi-pack-index.
+type BitmapIndex struct {
+	// Exactly one of pack and midx is set.
+	pack *packIndex
+	midx *MultiPackIndex
+	// types are the bitmaps of all commits, trees, blobs and tags, in that order.
+	types   [4]bitmap
+	entries []bitmapEntry
+	// commits maps the index position of bitmapped commits to their entry.
+	commits map[uint32]int
+	// order maps bit positions to index positions, and bitPos is the reverse.
+	order  []uint32
+	bitPos []uint32
+	// numObjects is the number of objects in the pack or multi-pack-index, which bitmaps have at most as many bits as.
+	numObjects int
+	// hashSize is the size of the object IDs of the pack or multi-pack-index.
+	hashSize int
+}
+
+// parseBitmapIndex parses a bitmap index of numObjects objects, and checks that it belongs to the pack
+// or multi-pack-index with the given checksum, which is the size of the object IDs.
+func parseBitmapIndex(data, checksum []byte, numObjects int) (*BitmapIndex, error) {
+	hashSize := len(checksum)
+	if len(data) < bitmapHeaderSize+hashSize || !bytes.Equal(data[:4], bitmapSignature) {
+		return nil, fmt.Errorf("%w: not a bitmap file", ErrMalformedBitmap)
+	}
+	if v := binary.BigEndian.Uint16(data[4:]); v != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedBitmap, v)
+	}
+	if flags := binary.BigEndian.Uint16(data[6:]); flags&bitmapOptFullDAG == 0 {
+		return nil, fmt.Errorf("%w: bitmaps are not closed under reachability", ErrMalformedBitmap)
+	}
+	numEntries := int(binary.BigEndian.Uint32(data[8:]))
+	if numEntries > numObjects {
+		return nil, fmt.Errorf("%w: %d entries for %d objects", ErrMalformedBitmap, numEntries, numObjects)
+	}
+	if !bytes.Equal(data[bitmapHeaderSize:bitmapHeaderSize+hashSize], checksum) {
+		return nil, fmt.Errorf("%w: checksum doesn't match the pack", ErrMalformedBitmap)
+	}
+	bi := &BitmapIndex{commits: make(map[uint32]int, numEntries), numObjects: numObjects, hashSize: hashSize}
+	off := bitmapHeaderSize + hashSize
+	for i := range bi.types {
+		raw, n, err := readEWAH(data[off:])
+		if err != nil {
+			return nil, err
+		}
+		if bi.types[i], err = decodeEWAH(raw, numObjects); err != nil {
+			return nil, err
+		}
+		off += n
+	}
+	for i := 0; i < numEntries; i++ {
+		if len(data) < off+6 {
+			return nil, fmt.Errorf("%w: truncated entry %d", ErrMalformedBitmap, i)
+		}
+		pos := binary.BigEndian.Uint32(data[off:])
+		xor := int(data[off+4])
+		if int(pos) >= numObjects || xor > i {
+			return nil, fmt.Errorf("%w: invalid entry %d", ErrMalformedBitmap, i)
+		}
+		raw, n, err := readEWAH(data[off+6:])
+		if err != nil {
+			return nil, err
+		}
+		bi.commits[pos] = len(bi.entries)
+		bi.entries = append(bi.entries, bitmapEntry{xor: xor, raw: raw})
+		off += 6 + n
+	}
+	return bi, nil
+}
+
+// loadPackBitmap loads the bitmap of the given pack.
+func loadPackBitmap(p *Pack) (*BitmapIndex, error) {
+	idx, err := p.index()
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(p.fsys, path.Join(p.dir, p.Name+".bitmap"))
+	if err != nil {
+		return nil, err
+	}
+	bi, err := parseBitmapIndex(data, idx.packChecksum, idx.numObjects())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v.bitmap: %w", p.Name, err)
+	}
+	order, err := p.revIndex()
+	if err != nil {
+		return nil, err
+	}
+	bi.pack = idx
+	bi.setOrder(order)
+	return bi, nil
+}
+
+// loadMultiPackBitmap loads the bitmap of the multi-pack-index in the given directory.
+// The pseudo-pack order is taken from the RIDX chunk, or from the multi-pack-index .rev file
+// written by older versions of git. Bitmaps without either can't be used.
+func loadMultiPackBitmap(fsys fs.FS, packdir string, midx *MultiPackIndex) (*BitmapIndex, error) {
+	checksum := hex.EncodeToString(midx.checksum)
+	name := "multi-pack-index-" + checksum + ".bitmap"
+	data, err := fs.ReadFile(fsys, path.Join(packdir, name))
+	if err != nil {
+		return nil, err
+	}
+	bi, err := parseBitmapIndex(data, midx.checksum, midx.NumObjects())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", name, err)
+	}
+	var order []uint32
+	if midx.HasRevIndex() {
+		order = make([]uint32, midx.NumObjects())
+		for i := range order {
+			order[i] = binary.BigEndian.Uint32(midx.ridx[4*i:])
+		}
+	} else {
+		rev, err := fs.ReadFile(fsys, path.Join(packdir, "multi-pack-index-"+checksum+".rev"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: multi-pack-index has no reverse index", ErrMalformedBitmap)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if order, err = parseRevIndex(rev, midx.NumObjects(), midx.checksum); err != nil {
+			return nil, err
+		}
+	}
+	bi.midx = midx
+	bi.setOrder(order)
+	return bi, nil
+}
+
+func (bi *BitmapIndex) setOrder(order []uint32) {
+	bi.order = order
+	bi.bitPos = make([]uint32, len(order))
+	for pos, i := range order {
+		bi.bitPos[i] = uint32(pos)
+	}
+}
+
+// NumObjects returns the number of objects covered by the bitmaps.
+func (bi *BitmapIndex) NumObjects() int {
+	return len(bi.order)
+}
+
+// NumCommits returns the number of commits that have a reachability bitmap.
+func (bi *BitmapIndex) NumCommits() int {
+	return len(bi.entries)
+}
+
+// bitPosition returns the bit position of the object with the given binary shasum.
+func (bi *BitmapIndex) bitPosition(sha []byte) (int, bool) {
+	var i int
+	var ok bool
+	if bi.midx != nil {
+		i, ok = bi.midx.find(sha)
+	} else {
+		i, ok = bi.pack.find(sha)
+	}
+	if !ok {
+		return -1, false
+	}
+	return int(bi.bitPos[i]), true
+}
+
+// shaAt returns the binary shasum of the object at the given bit position.
+func (bi *BitmapIndex) shaAt(pos int) []byte {
+	i := int(bi.order[pos])
+	if bi.midx != nil {
+		return bi.midx.oid(i)
+	}
+	return bi.pack.sha(i)
+}
+
+// commitBitmap returns the bitmap of objects reachable from the commit at the given bit position,
+// or false if the commit has no bitmap.
+func (bi *BitmapIndex) commitBitmap(pos int) (bitmap, bool, error) {
+	e, ok := bi.commits[bi.order[pos]]
+	if !ok {
+		return nil, false, nil
+	}
+	bm, err := bi.entryBitmap(e)
+	return bm, err == nil, err
+}
+
+// entryBitmap decodes the bitmap of the given entry, resolving its XOR chain.
+// The XOR offsets always point to earlier entries, so the chain ends.
+func (bi *BitmapIndex) entryBitmap(e int) (bitmap, error) {
+	var chain []int
+	for {
+		chain = append(chain, e)
+		if bi.entries[e].xor == 0 {
+			break
+		}
+		e -= bi.entries[e].xor
+	}
+	var bm bitmap
+	for i := len(chain) - 1; i >= 0; i-- {
+		words, err := decodeEWAH(bi.entries[chain[i]].raw, bi.numObjects)
+		if err != nil {
+			return nil, err
+		}
+		bm.xor(words)
+	}
+	return bm, nil
+}
+
+// Bitmap returns the reachability bitmap of the pack directory, or nil if there is none.
+// The bitmap of the multi-pack-index is preferred, then the bitmap of the most recent pack that has one.
+// The bitmap is loaded on first use, and is reloaded after the packs change.
+func (s *PackStore) Bitmap() (*BitmapIndex, error) {
+	s.mu.RLock()
+	gen, midx, packs := s.gen, s.midx, s.packs
+	s.mu.RUnlock()
+	if gen == 0 {
+		if err := s.Rescan(); err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		gen, midx, packs = s.gen, s.midx, s.packs
+		s.mu.RUnlock()
+	}
+	s.bitmapMu.Lock()
+	defer s.bitmapMu.Unlock()
+	if s.bitmapGen == gen {
+		return s.bitmap, nil
+	}
+	var bi *BitmapIndex
+	var err error
+	if midx != nil {
+		bi, err = loadMultiPackBitmap(s.fsys, s.dir, midx)
+	}
+	for _, p := range packs {
+		if bi != nil {
+			break
+		}
+		bi, err = loadPackBitmap(p)
+	}
+	// Having no bitmap isn't an error, but a broken one is.
+	if bi == nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrMalformedBitmap) {
+		return nil, err
+	}
+	s.bitmap, s.bitmapGen = bi, gen
+	return bi, nil
+}
+
+// ObjectCounts are the number of objects of each type.
+type ObjectCounts struct {
+	Commits int
+	Trees   int
+	Blobs   int
+	Tags    int
+}
+
+// Total returns the total number of objects.
+func (c ObjectCounts) Total() int {
+	return c.Commits + c.Trees + c.Blobs + c.Tags
+}
+
+func (c *ObjectCounts) add(otype ObjectType, n int) {
+	switch otype {
+	case OBJ_COMMIT:
+		c.Commits += n
+	case OBJ_TREE:
+		c.Trees += n
+	case OBJ_BLOB:
+		c.Blobs += n
+	case OBJ_TAG:
+		c.Tags += n
+	}
+}
+
+// reachability is a set of reachable objects.
+// Objects covered by the bitmap index are stored as bits, other objects by shasum.
+type reachability struct {
+	repo    Repo
+	commits *commitLookup
+	index   *BitmapIndex
+	bits    bitmap
+	extra   map[Hash]ObjectType
+}
+
+func (rs *reachability) position(shasum Hash) (int, bool) {
+	if rs.index == nil || shasum.Size() != rs.index.hashSize {
+		return -1, false
+	}
+	return rs.index.bitPosition(shasum.Bytes())
+}
+
+func (rs *reachability) has(shasum Hash) bool {
+	if pos, ok := rs.position(shasum); ok {
+		return rs.bits.get(pos)
+	}
+	_, ok := rs.extra[shasum]
+	return ok
+}
+
+func (rs *reachability) add(shasum Hash, otype ObjectType) {
+	if pos, ok := rs.position(shasum); ok {
+		rs.bits.set(pos)
+		return
+	}
+	rs.extra[shasum] = otype
+}
+
+// addObject adds the object and everything reachable from it.
+func (rs *reachability) addObject(shasum Hash) error {
+	if rs.has(shasum) {
+		return nil
+	}
+	otype, o, err := rs.repo.Object(shasum)
+	if err != nil {
+		return err
+	}
+	switch otype {
+	case OBJ_COMMIT:
+		return rs.addCommit(shasum)
+	case OBJ_TREE:
+		return rs.addTree(shasum)
+	case OBJ_TAG:
+		rs.add(shasum, OBJ_TAG)
+		target, err := tagTarget(o)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag %v: %w", shasum, err)
+		}
+		return rs.addObject(target)
+	default:
+		rs.add(shasum, otype)
+		return nil
+	}
+}
+
+// addCommit adds the commit and its history.
+// Commits with a bitmap add all their reachable objects at once,
+// other commits are walked until a commit with a bitmap (or the root) is reached.
+func (rs *reachability) addCommit(shasum Hash) error {
+	stack := []Hash{shasum}
+	for len(stack) > 0 {
+		sum := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if rs.has(sum) {
+			continue
+		}
+		if pos, ok := rs.position(sum); ok {
+			bm, ok, err := rs.index.commitBitmap(pos)
+			if err != nil {
+				return err
+			}
+			if ok {
+				rs.bits.or(bm)
+				continue
+			}
+		}
+		ci, err := rs.commits.info(sum)
+		if err != nil {
+			return err
+		}
+		rs.add(sum, OBJ_COMMIT)
+		if err = rs.addTree(ci.Tree); err != nil {
+			return err
+		}
+		stack = append(stack, ci.Parents...)
+	}
+	return nil
+}
+
+// addTree adds the tree and all trees and blobs in it.
+// Submodule commits are not followed, as they aren't part of the repo.
+func (rs *reachability) addTree(shasum Hash) error {
+	if rs.has(shasum) {
+		return nil
+	}
+	tree, err := rs.repo.Tree(shasum)
+	if err != nil {
+		return err
+	}
+	entries, err := tree.ParseEntries()
+	if err != nil {
+		return fmt.Errorf("failed to parse tree %v: %w", shasum, err)
+	}
+	rs.add(shasum, OBJ_TREE)
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			err = rs.addTree(e.ShaSum)
+		case e.Mode.IsSubmodule():
+		case !rs.has(e.ShaSum):
+			rs.add(e.ShaSum, OBJ_BLOB)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagTarget returns the shasum of the object an annotated tag points to.
+func tagTarget(tag []byte) (Hash, error) {
+	line, _, _ := strings.Cut(string(tag), "\n")
+	target, ok := strings.CutPrefix(line, "object ")
+	if !ok {
+		return Hash{}, ErrMalformedObject
+	}
+	return ParseHash(target)
+}
+
+func (r Repo) reachable(commits []Hash) (*reachability, error) {
+	dirs, done := r.objectDirs()
+	defer done()
+	// Only the repo's own bitmaps are used. Objects in alternates are found by walking.
+	index, err := dirs[0].packs.Bitmap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reachability bitmap: %w", err)
+	}
+	rs := &reachability{repo: r, commits: r.newCommitLookup(), index: index, extra: map[Hash]ObjectType{}}
+	for _, c := range commits {
+		if err = rs.addObject(c); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// ReachableObjects returns the sorted shasums of all objects reachable from the given commits (or tags).
+// Reachability bitmaps are used if the repo has them, which avoids walking most of the history.
+// Without bitmaps, every reachable commit and tree is read. Use ListObjects for paths and exclusions.
+func (r Repo) ReachableObjects(commits []Hash) ([]Hash, error) {
+	rs, err := r.reachable(commits)
+	if err != nil {
+		return nil, err
+	}
+	var objects []Hash
+	rs.bits.forEach(func(pos int) error {
+		objects = append(objects, hashFromBytes(rs.index.shaAt(pos)))
+		return nil
+	})
+	for sum := range rs.extra {
+		objects = append(objects, sum)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Compare(objects[j]) < 0
+	})
+	return objects, nil
+}
+
+// CountReachableObjects returns the number of objects of each type reachable from the given commits (or tags).
+// With reachability bitmaps, this doesn't need to look up the individual objects at all.
+func (r Repo) CountReachableObjects(commits []Hash) (ObjectCounts, error) {
+	var counts ObjectCounts
+	rs, err := r.reachable(commits)
+	if err != nil {
+		return counts, err
+	}
+	if rs.index != nil {
+		for i, t := range []ObjectType{OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG} {
+			counts.add(t, rs.bits.countAnd(rs.index.types[i]))
+		}
+	}
+	for _, t := range rs.extra {
+		counts.add(t, 1)
+	}
+	return counts, nil
+}
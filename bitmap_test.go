@@ -0,0 +1,99 @@
+package gitwood_test
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+)
+
+// readReachableObjects reads testdata/reachable-objects.txt, which has the objects reachable from two commits
+// of testdata/midx.git, and returns the sorted IDs and the counts of the objects of each commit.
+func readReachableObjects(t *testing.T) (map[gitwood.Hash][]gitwood.Hash, map[gitwood.Hash]gitwood.ObjectCounts) {
+	t.Helper()
+	f, err := os.Open("testdata/reachable-objects.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	objects := map[gitwood.Hash][]gitwood.Hash{}
+	counts := map[gitwood.Hash]gitwood.ObjectCounts{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// <commit> <object ID> <type>
+		fields := strings.Fields(s.Text())
+		commit, sum := gitwood.MustParseHash(fields[0]), gitwood.MustParseHash(fields[1])
+		objects[commit] = append(objects[commit], sum)
+		c := counts[commit]
+		switch fields[2] {
+		case "commit":
+			c.Commits++
+		case "tree":
+			c.Trees++
+		case "blob":
+			c.Blobs++
+		case "tag":
+			c.Tags++
+		}
+		counts[commit] = c
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return objects, counts
+}
+
+// TestReachableObjects checks the reachable objects against git rev-list, with the bitmap of a multi-pack-index,
+// of a pack, and without bitmaps. Only some of the commits and objects are in the bitmaps.
+func TestReachableObjects(t *testing.T) {
+	objects, counts := readReachableObjects(t)
+	dir := copyTestdata(t, "midx.git", "bitmap.git")
+	nobitmap := filepath.Join(dir, "nobitmap.git")
+	if err := os.Rename(filepath.Join(dir, "midx.git"), nobitmap); err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := filepath.Glob(filepath.Join(nobitmap, "objects/pack/*.bitmap"))
+	if err != nil || len(bitmaps) != 1 {
+		t.Fatalf("bitmaps in midx.git = %v, %v", bitmaps, err)
+	}
+	if err = os.Remove(bitmaps[0]); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		gitdir string
+		bitmap bool
+	}{
+		{"multi-pack-index bitmap", "testdata/midx.git", true},
+		{"pack bitmap", filepath.Join(dir, "bitmap.git"), true},
+		{"no bitmap", nobitmap, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := gitwood.NewPackStore(filepath.Join(tt.gitdir, "objects/pack"))
+			bi, err := s.Bitmap()
+			s.Close()
+			if err != nil || (bi != nil) != tt.bitmap {
+				t.Fatalf("Bitmap() = %v, %v, want a bitmap: %v", bi, err, tt.bitmap)
+			}
+			repo := openRepo(t, tt.gitdir)
+			for commit, want := range objects {
+				got, err := repo.ReachableObjects([]gitwood.Hash{commit})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("ReachableObjects(%v) = %v, want %v", commit, got, want)
+				}
+				n, err := repo.CountReachableObjects([]gitwood.Hash{commit})
+				if err != nil || n != counts[commit] {
+					t.Errorf("CountReachableObjects(%v) = %+v, %v, want %+v", commit, n, err, counts[commit])
+				}
+			}
+		})
+	}
+}
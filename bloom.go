@@ -0,0 +1,178 @@
+package gitwood
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Changed-path Bloom filters are stored in the commit-graph in two chunks:
+//
+//	BIDX: for each commit, the (cumulative) end offset of its filter in BDAT
+//	BDAT: header (hash version, number of hashes, bits per entry), followed by the filters
+//
+// The filter of a commit contains every path that differs from its first parent,
+// including the leading directories of changed files.
+// See https://git-scm.com/docs/gitformat-commit-graph and bloom.c in git.
+
+const (
+	chunkBloomIndexes = 0x42494458 // BIDX
+	chunkBloomData    = 0x42444154 // BDAT
+
+	bloomDataHeaderSize = 12
+	bloomSeed0          = 0x293ae76f
+	bloomSeed1          = 0x7e646e2c
+)
+
+type bloomSettings struct {
+	hashVersion  uint32
+	numHashes    uint32
+	bitsPerEntry uint32
+}
+
+// BloomFilter is the changed-path Bloom filter of a commit.
+type BloomFilter struct {
+	data     []byte
+	settings bloomSettings
+}
+
+func parseBloomChunks(bidx, bdat []byte, n int) ([]byte, []byte, bloomSettings, error) {
+	var settings bloomSettings
+	if len(bidx) != 4*n || len(bdat) < bloomDataHeaderSize {
+		return nil, nil, settings, fmt.Errorf("%w: Bloom filter chunks have the wrong size", ErrMalformedChunkFile)
+	}
+	settings.hashVersion = binary.BigEndian.Uint32(bdat)
+	settings.numHashes = binary.BigEndian.Uint32(bdat[4:])
+	settings.bitsPerEntry = binary.BigEndian.Uint32(bdat[8:])
+	if settings.hashVersion != 1 && settings.hashVersion != 2 {
+		return nil, nil, settings, fmt.Errorf("%w: unsupported Bloom filter hash version %d", ErrMalformedChunkFile, settings.hashVersion)
+	}
+	return bidx, bdat[bloomDataHeaderSize:], settings, nil
+}
+
+// bloomFilter returns the Bloom filter at the given position in the layer, if the layer has Bloom filters.
+func (l *commitGraphLayer) bloomFilter(lpos int) (*BloomFilter, bool) {
+	if l.bidx == nil {
+		return nil, false
+	}
+	var start uint32
+	if lpos > 0 {
+		start = binary.BigEndian.Uint32(l.bidx[4*(lpos-1):])
+	}
+	end := binary.BigEndian.Uint32(l.bidx[4*lpos:])
+	if start > end || int(end) > len(l.bdat) {
+		return nil, false
+	}
+	return &BloomFilter{data: l.bdat[start:end], settings: l.bloom}, true
+}
+
+// ChangedPaths returns the changed-path Bloom filter of the given commit.
+// Returns false if the commit isn't in the commit-graph, or its layer has no Bloom filters.
+func (g *CommitGraph) ChangedPaths(shasum Hash) (*BloomFilter, bool, error) {
+	pos, ok, err := g.lookupPosition(shasum)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	l, lpos, err := g.layer(pos)
+	if err != nil {
+		return nil, false, err
+	}
+	f, ok := l.bloomFilter(lpos)
+	return f, ok, nil
+}
+
+// MaybeChanged reports whether the given path may differ between the commit and its first parent.
+// False means that the path is definitely unchanged, while true means that it may or may not be changed.
+func (f *BloomFilter) MaybeChanged(path string) bool {
+	path = strings.Trim(path, "/")
+	if path == "" || path == "." {
+		return true
+	}
+	// A filter without data can't rule anything out.
+	// Commits with too many changes get a single byte filter with all bits set, which has the same effect.
+	if len(f.data) == 0 {
+		return true
+	}
+	// The filter contains the leading directories of every changed path,
+	// so if any of them is missing, the path itself can't have changed.
+	for {
+		if !f.contains(path) {
+			return false
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			return true
+		}
+		path = path[:i]
+	}
+}
+
+func (f *BloomFilter) contains(key string) bool {
+	var hash0, hash1 uint32
+	if f.settings.hashVersion == 2 {
+		hash0, hash1 = murmur3(bloomSeed0, key, false), murmur3(bloomSeed1, key, false)
+	} else {
+		hash0, hash1 = murmur3(bloomSeed0, key, true), murmur3(bloomSeed1, key, true)
+	}
+	mod := uint64(len(f.data)) * 8
+	for i := uint32(0); i < f.settings.numHashes; i++ {
+		pos := uint64(hash0+i*hash1) % mod
+		if f.data[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// murmur3 is the 32 bit murmur3 hash used by git's Bloom filters.
+// Version 1 of the filters was computed with bytes sign extended as chars (on most platforms),
+// which gives different hashes for non-ASCII paths, so signedChars must be set to read those.
+func murmur3(seed uint32, data string, signedChars bool) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+		r1 = 15
+		r2 = 13
+		m  = 5
+		n  = 0xe6546b64
+	)
+	char := func(i int) uint32 {
+		if signedChars {
+			return uint32(int32(int8(data[i])))
+		}
+		return uint32(data[i])
+	}
+	len4 := len(data) / 4
+	for i := 0; i < len4; i++ {
+		k := char(4*i) | char(4*i+1)<<8 | char(4*i+2)<<16 | char(4*i+3)<<24
+		k *= c1
+		k = bits.RotateLeft32(k, r1)
+		k *= c2
+		seed ^= k
+		seed = bits.RotateLeft32(seed, r2)*m + n
+	}
+	var k1 uint32
+	tail := 4 * len4
+	switch len(data) & 3 {
+	case 3:
+		k1 ^= char(tail+2) << 16
+		fallthrough
+	case 2:
+		k1 ^= char(tail+1) << 8
+		fallthrough
+	case 1:
+		k1 ^= char(tail)
+		k1 *= c1
+		k1 = bits.RotateLeft32(k1, r1)
+		k1 *= c2
+		seed ^= k1
+	}
+	seed ^= uint32(len(data))
+	seed ^= seed >> 16
+	seed *= 0x85ebca6b
+	seed ^= seed >> 13
+	seed *= 0xc2b2ae35
+	seed ^= seed >> 16
+	return seed
+}
@@ -0,0 +1,148 @@
+package gitwood
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		seed uint32
+		data string
+		want uint32
+	}{
+		// From t0095-bloom.sh in git.
+		{0, "", 0},
+		{0, "Hello world!", 0x627b0c2c},
+		{0, "The quick brown fox jumps over the lazy dog", 0x2e4ff723},
+		// Reference values of MurmurHash3_x86_32.
+		{1, "", 0x514e28b7},
+		{0x9747b28c, "Hello, world!", 0x24884cba},
+		{0x9747b28c, "The quick brown fox jumps over the lazy dog", 0x2fa826cd},
+	}
+	for _, tt := range tests {
+		// Signed chars only make a difference for bytes with the high bit set.
+		for _, signed := range []bool{false, true} {
+			if got := murmur3(tt.seed, tt.data, signed); got != tt.want {
+				t.Errorf("murmur3(%#x, %q, %v) = %#x, want %#x", tt.seed, tt.data, signed, got, tt.want)
+			}
+		}
+	}
+	// From t0095-bloom.sh in git 2.46, which added version 2 filters.
+	highBits := "\x99\xaa\xbb\xcc\xdd\xee\xff"
+	if got := murmur3(0, highBits, false); got != 0xa183ccfd {
+		t.Errorf("murmur3(0, %q, false) = %#x, want %#x", highBits, got, 0xa183ccfd)
+	}
+	// Version 1 filters are checked against git in TestBloomFilters.
+	if murmur3(0, highBits, true) == murmur3(0, highBits, false) {
+		t.Errorf("murmur3(0, %q) is the same with signed chars", highBits)
+	}
+}
+
+// readChanges reads testdata/bloom-changes.txt, which has the paths changed by each commit of testdata/bloom.git.
+func readChanges(t *testing.T) (map[Hash][]string, []Hash) {
+	t.Helper()
+	f, err := os.Open("testdata/bloom-changes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	changes := map[Hash][]string{}
+	var commits []Hash
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "commit "):
+			sum, err := ParseHash(strings.TrimPrefix(line, "commit "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits = append(commits, sum)
+		case line != "":
+			sum := commits[len(commits)-1]
+			changes[sum] = append(changes[sum], line)
+		}
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return changes, commits
+}
+
+func TestBloomFilters(t *testing.T) {
+	g, err := OpenCommitGraph("testdata/bloom.git/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, commits := readChanges(t)
+	var nonASCII, missed int
+	for _, sum := range commits {
+		f, ok, err := g.ChangedPaths(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("ChangedPaths(%v) found no filter", sum)
+		}
+		if f.settings.hashVersion != 1 {
+			t.Fatalf("Bloom filter hash version = %d, want 1", f.settings.hashVersion)
+		}
+		// Hashing the paths as unsigned chars, like version 2, gives other bits for non-ASCII paths.
+		unsigned := *f
+		unsigned.settings.hashVersion = 2
+		for _, p := range changes[sum] {
+			if !f.MaybeChanged(p) {
+				t.Errorf("MaybeChanged(%q) = false for commit %v, which changed it", p, sum)
+			}
+			if strings.IndexFunc(p, func(r rune) bool { return r > 0x7f }) >= 0 {
+				nonASCII++
+				if !unsigned.MaybeChanged(p) {
+					missed++
+				}
+			}
+		}
+	}
+	if nonASCII == 0 || missed == 0 {
+		t.Errorf("unsigned hashing missed %d of %d non-ASCII paths, want some", missed, nonASCII)
+	}
+}
+
+// TestLogPathBloomFilters checks that LogPath finds the same commits with and without the Bloom filters.
+func TestLogPathBloomFilters(t *testing.T) {
+	changes, commits := readChanges(t)
+	repo, err := Open("testdata/bloom.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	noGraph := *repo
+	noGraph.graphs = nil
+	for _, p := range []string{"README", "dør", "dør/fïle.txt", "dør/other.txt", "naïve.txt", "src", "src/ünïcode.go", "日本/語.txt", "missing"} {
+		var want []Hash
+		for _, sum := range commits {
+			for _, c := range changes[sum] {
+				if c == p || strings.HasPrefix(c, p+"/") {
+					want = append(want, sum)
+					break
+				}
+			}
+		}
+		for _, r := range []*Repo{repo, &noGraph} {
+			log, err := r.LogPath(repo.HeadCommit(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []Hash
+			for _, c := range log {
+				got = append(got, c.ShaSum)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("LogPath(%q) = %v, want %v", p, got, want)
+			}
+		}
+	}
+}
@@ -26,6 +26,30 @@ func openRepo(dirpath string) *gitwood.Repo {
 	return repo
 }
 
+func parseHash(s string) gitwood.Hash {
+	h, err := gitwood.ParseHash(s)
+	if err != nil {
+		fmt.Println("invalid object ID:", s)
+		os.Exit(1)
+	}
+	return h
+}
+
+// printTree prints the entries of a tree, noting modes that git wouldn't write.
+func printTree(repo *gitwood.Repo, tree []byte) {
+	entries, err := repo.ParseTree(tree)
+	for _, e := range entries {
+		if !e.Mode.IsCanonical() {
+			fmt.Printf("%v (non-canonical mode, git writes %v)\n", e, e.Mode.Canonical())
+			continue
+		}
+		fmt.Println(e)
+	}
+	if err != nil {
+		fmt.Println("failed to parse tree:", err)
+	}
+}
+
 func main() {
 	if len(os.Args) < 3 {
 		fmt.Printf("Use: %v <command> <file>\n", os.Args[0])
@@ -35,9 +59,9 @@ func main() {
 	switch os.Args[1] {
 	case "object":
 		repo := openRepo(os.Args[2])
-		var shasum string
+		var shasum gitwood.Hash
 		if len(os.Args) > 3 {
-			shasum = os.Args[3]
+			shasum = parseHash(os.Args[3])
 		}
 		otype, o, err := repo.Object(shasum)
 		if err != nil {
@@ -46,10 +70,7 @@ func main() {
 		}
 		switch otype {
 		case gitwood.OBJ_TREE:
-			entries := gitwood.ExtractTreeEntries(o)
-			for _, e := range entries {
-				fmt.Println(e)
-			}
+			printTree(repo, o)
 		case gitwood.OBJ_COMMIT:
 			var commit *gitwood.Commit
 			commit, err = gitwood.ParseCommit(shasum, string(o))
@@ -69,9 +90,9 @@ func main() {
 		}
 		repo := openRepo(os.Args[2])
 		path := os.Args[3]
-		ref := ""
+		var ref gitwood.Hash
 		if len(os.Args) > 4 {
-			ref = os.Args[4]
+			ref = parseHash(os.Args[4])
 		}
 		otype, o, err := repo.WalkToPath(ref, path, nil)
 		if err != nil {
@@ -80,10 +101,7 @@ func main() {
 		}
 		switch otype {
 		case gitwood.OBJ_TREE:
-			entries := gitwood.ExtractTreeEntries(o)
-			for _, e := range entries {
-				fmt.Println(e)
-			}
+			printTree(repo, o)
 		case gitwood.OBJ_BLOB:
 			fmt.Println(string(o))
 		default:
@@ -92,9 +110,9 @@ func main() {
 		}
 	case "log":
 		repo := openRepo(os.Args[2])
-		var shasum string
+		var shasum gitwood.Hash
 		if len(os.Args) > 3 {
-			shasum = os.Args[3]
+			shasum = parseHash(os.Args[3])
 		}
 		var commits []gitwood.Commit
 		commits, err = repo.Log(shasum)
@@ -129,14 +147,14 @@ func main() {
 		file := openFile(os.Args[2])
 		defer file.Close()
 		var start int64
-		start, err = gitwood.SearchPackIDX(os.Args[2], os.Args[3])
+		start, err = gitwood.SearchPackIDX(os.Args[2], parseHash(os.Args[3]))
 		fmt.Printf("found object at %v\n", start)
 	case "search":
 		file := openFile(os.Args[2])
 		defer file.Close()
 		// DO: Check if object exists - otherwise unpack?
 		var start int64
-		start, err = gitwood.SearchPackIDX(os.Args[2], os.Args[3])
+		start, err = gitwood.SearchPackIDX(os.Args[2], parseHash(os.Args[3]))
 		if start >= 0 {
 			fmt.Println("found object at", start)
 		}
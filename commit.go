@@ -2,13 +2,14 @@ package gitwood
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 type Commit struct {
-	ShaSum    string
-	Tree      string
-	Parents   []string
+	ShaSum    Hash
+	Tree      Hash
+	Parents   []Hash
 	Author    string
 	Committer string
 	Message   string
@@ -27,7 +28,7 @@ func (c Commit) String() string {
 	return out
 }
 
-func ParseCommit(shasum, commitDef string) (*Commit, error) {
+func ParseCommit(shasum Hash, commitDef string) (*Commit, error) {
 	var i int
 	lines := strings.Split(commitDef, "\n")
 	commit := Commit{ShaSum: shasum}
@@ -40,16 +41,24 @@ func ParseCommit(shasum, commitDef string) (*Commit, error) {
 		fs := strings.Index(lines[i], " ")
 		switch line[:fs] {
 		case "tree":
-			commit.Tree = line[fs+1:]
+			tree, err := ParseHash(line[fs+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad tree in commit %v", ErrMalformedCommit, shasum)
+			}
+			commit.Tree = tree
 		case "parent":
-			commit.Parents = append(commit.Parents, line[fs+1:])
+			parent, err := ParseHash(line[fs+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad parent in commit %v", ErrMalformedCommit, shasum)
+			}
+			commit.Parents = append(commit.Parents, parent)
 		case "author":
 			commit.Author = line[fs+1:]
 		case "committer":
 			commit.Committer = line[fs+1:]
 		}
 	}
-	if commit.Tree == "" {
+	if commit.Tree.IsZero() {
 		return nil, fmt.Errorf("no tree found in commit %v", shasum)
 	}
 	// Check for author and committer too? Not sure what's mandatory.
@@ -57,7 +66,31 @@ func ParseCommit(shasum, commitDef string) (*Commit, error) {
 	return &commit, nil
 }
 
-func (r Repo) Commit(sha string) (*Commit, error) {
+// CommitTime returns the committer timestamp of the commit, in seconds since the epoch.
+// Returns 0 if the committer line has no valid timestamp.
+func (c Commit) CommitTime() int64 {
+	return signatureTime(c.Committer)
+}
+
+// signatureTime parses the timestamp of an author or committer line,
+// i.e. "Name <email> 1600000000 +0100".
+func signatureTime(sig string) int64 {
+	i := strings.LastIndexByte(sig, '>')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(sig[i+1:])
+	if len(fields) == 0 {
+		return 0
+	}
+	t, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
+func (r Repo) Commit(sha Hash) (*Commit, error) {
 	otype, o, err := r.Object(sha)
 	if err != nil {
 		return nil, err
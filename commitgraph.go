@@ -0,0 +1,529 @@
+package gitwood
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Commit-graph format (objects/info/commit-graph), see https://git-scm.com/docs/gitformat-commit-graph:
+//
+//	header: "CGPH", version, hash version, number of chunks, number of base graphs
+//	chunk lookup table: (chunks+1) * [4 byte chunk id, 8 byte offset]
+//	chunks: OIDF, OIDL, CDAT, (GDA2), (GDO2), (EDGE), (BIDX), (BDAT), (BASE)
+//	trailer: checksum
+//
+// A commit-graph can also be split into a chain of layers in objects/info/commit-graphs,
+// listed in commit-graph-chain, base layer first. Commit positions are global across the layers.
+
+const (
+	commitGraphHeaderSize = 8
+
+	chunkCommitData         = 0x43444154 // CDAT
+	chunkGenerationData     = 0x47444132 // GDA2
+	chunkGenerationOverflow = 0x47444f32 // GDO2
+	chunkExtraEdges         = 0x45444745 // EDGE
+	chunkBaseGraphs         = 0x42415345 // BASE
+
+	graphParentNone   = 0x7000_0000
+	graphParentExtra  = 0x8000_0000
+	graphLastEdge     = 0x8000_0000
+	graphOverflowFlag = 0x8000_0000
+
+	// generationInfinity is the generation of commits that aren't in the commit-graph.
+	generationInfinity = math.MaxUint64
+)
+
+var commitGraphSignature = []byte("CGPH")
+
+type commitGraphLayer struct {
+	checksum []byte
+	fanout   [256]uint32
+	oids     []byte
+	cdat     []byte
+	gda2     []byte
+	gdo2     []byte
+	edges    []byte
+	bases    []byte
+	bidx     []byte
+	bdat     []byte
+	bloom    bloomSettings
+	// offset is the number of commits in the layers below this one.
+	offset   int
+	hashSize int
+}
+
+func parseCommitGraphLayer(data []byte) (*commitGraphLayer, error) {
+	if len(data) < commitGraphHeaderSize || !bytes.Equal(data[:4], commitGraphSignature) {
+		return nil, fmt.Errorf("%w: not a commit-graph", ErrMalformedChunkFile)
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("%w: unsupported commit-graph version %d", ErrMalformedChunkFile, data[4])
+	}
+	hashSize, ok := hashSizeForVersion(uint32(data[5]))
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported hash version %d", ErrMalformedChunkFile, data[5])
+	}
+	if len(data) < commitGraphHeaderSize+hashSize {
+		return nil, fmt.Errorf("%w: not a commit-graph", ErrMalformedChunkFile)
+	}
+	chunks, err := readChunkTable(data, commitGraphHeaderSize, int(data[6]))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range []uint32{chunkOIDFanout, chunkOIDLookup, chunkCommitData} {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("%w: missing required chunk %08x", ErrMalformedChunkFile, id)
+		}
+	}
+	l := &commitGraphLayer{checksum: data[len(data)-hashSize:], hashSize: hashSize}
+	if err = parseFanout(chunks[chunkOIDFanout], &l.fanout); err != nil {
+		return nil, err
+	}
+	n := int(l.fanout[255])
+	l.oids = chunks[chunkOIDLookup]
+	l.cdat = chunks[chunkCommitData]
+	if len(l.oids) != hashSize*n || len(l.cdat) != (hashSize+16)*n {
+		return nil, fmt.Errorf("%w: commit tables don't match the fanout table", ErrMalformedChunkFile)
+	}
+	if gda2, ok := chunks[chunkGenerationData]; ok {
+		if len(gda2) != 4*n {
+			return nil, fmt.Errorf("%w: generation data has the wrong size", ErrMalformedChunkFile)
+		}
+		l.gda2 = gda2
+		l.gdo2 = chunks[chunkGenerationOverflow]
+	}
+	l.edges = chunks[chunkExtraEdges]
+	l.bases = chunks[chunkBaseGraphs]
+	bidx, hasBIDX := chunks[chunkBloomIndexes]
+	bdat, hasBDAT := chunks[chunkBloomData]
+	// Bloom filters are optional, so the layer is still usable if they can't be read.
+	if hasBIDX && hasBDAT {
+		if bidx, bdat, settings, err := parseBloomChunks(bidx, bdat, n); err == nil {
+			l.bidx, l.bdat, l.bloom = bidx, bdat, settings
+		}
+	}
+	if len(l.bases) != hashSize*int(data[7]) {
+		return nil, fmt.Errorf("%w: expected %d base graphs", ErrMalformedChunkFile, data[7])
+	}
+	return l, nil
+}
+
+func (l *commitGraphLayer) oid(i int) []byte {
+	return l.oids[l.hashSize*i : l.hashSize*i+l.hashSize]
+}
+
+func (l *commitGraphLayer) find(sha []byte) (int, bool) {
+	var lo int
+	if sha[0] > 0 {
+		lo = int(l.fanout[sha[0]-1])
+	}
+	hi := int(l.fanout[sha[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(l.oid(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(l.oid(i), sha) {
+		return i, true
+	}
+	return -1, false
+}
+
+// CommitGraph is a parsed commit-graph, or chain of commit-graph layers.
+// It gives the parents, root tree, commit time and generation number of commits without reading the commit objects.
+type CommitGraph struct {
+	layers []*commitGraphLayer
+	// Generation number v2 (corrected commit dates) is only used if every layer has it.
+	correctedDates bool
+}
+
+// OpenCommitGraph reads the commit-graph file or chain in the given objects directory.
+// Like git, the single commit-graph file is preferred over the chain if both exist.
+// Returns an error wrapping fs.ErrNotExist if there is no commit-graph.
+func OpenCommitGraph(objectsDir string) (*CommitGraph, error) {
+	return openCommitGraph(osFS{}, []string{objectsDir})
+}
+
+// openCommitGraph reads the commit-graph of the first of the objects directories that has one,
+// which like in git are the repo's own followed by its alternates.
+// The layers of a chain are looked up in all the directories, as a chain can build on the layers of an alternate.
+func openCommitGraph(fsys fs.FS, objectsDirs []string) (*CommitGraph, error) {
+	var err error
+	for _, dir := range objectsDirs {
+		var g *CommitGraph
+		if g, err = openCommitGraphDir(fsys, dir, objectsDirs); !errors.Is(err, fs.ErrNotExist) {
+			return g, err
+		}
+	}
+	return nil, err
+}
+
+func openCommitGraphDir(fsys fs.FS, objectsDir string, objectsDirs []string) (*CommitGraph, error) {
+	data, err := fs.ReadFile(fsys, path.Join(objectsDir, "info", "commit-graph"))
+	if err == nil {
+		l, err := parseCommitGraphLayer(data)
+		if err != nil {
+			return nil, err
+		}
+		return newCommitGraph([]*commitGraphLayer{l})
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	chain, err := fs.ReadFile(fsys, path.Join(objectsDir, "info", "commit-graphs", "commit-graph-chain"))
+	if err != nil {
+		return nil, err
+	}
+	var layers []*commitGraphLayer
+	sc := bufio.NewScanner(bytes.NewReader(chain))
+	for sc.Scan() {
+		name := strings.TrimSpace(sc.Text())
+		if name == "" {
+			continue
+		}
+		data, err = readCommitGraphLayer(fsys, objectsDirs, name)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseCommitGraphLayer(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse commit-graph layer %v: %w", name, err)
+		}
+		// The layer file is named after its checksum.
+		if hex.EncodeToString(l.checksum) != name {
+			return nil, fmt.Errorf("%w: commit-graph layer %v has the wrong checksum", ErrMalformedChunkFile, name)
+		}
+		layers = append(layers, l)
+	}
+	return newCommitGraph(layers)
+}
+
+// readCommitGraphLayer reads the named layer of a commit-graph chain from the first of the objects directories that has it.
+func readCommitGraphLayer(fsys fs.FS, objectsDirs []string, name string) ([]byte, error) {
+	var err error
+	for _, dir := range objectsDirs {
+		var data []byte
+		data, err = fs.ReadFile(fsys, path.Join(dir, "info", "commit-graphs", "graph-"+name+".graph"))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	return nil, err
+}
+
+func newCommitGraph(layers []*commitGraphLayer) (*CommitGraph, error) {
+	g := &CommitGraph{layers: layers, correctedDates: true}
+	var offset int
+	for i, l := range layers {
+		if l.hashSize != layers[0].hashSize {
+			return nil, fmt.Errorf("%w: commit-graph layers use different hash functions", ErrMalformedChunkFile)
+		}
+		// Each layer lists the checksums of all layers below it.
+		size := l.hashSize
+		if len(l.bases) != size*i {
+			return nil, fmt.Errorf("%w: commit-graph layer %d has %d bases", ErrMalformedChunkFile, i, len(l.bases)/size)
+		}
+		for j := 0; j < i; j++ {
+			if !bytes.Equal(l.bases[size*j:size*j+size], layers[j].checksum) {
+				return nil, fmt.Errorf("%w: commit-graph chain is inconsistent", ErrMalformedChunkFile)
+			}
+		}
+		l.offset = offset
+		offset += int(l.fanout[255])
+		if l.gda2 == nil {
+			g.correctedDates = false
+		}
+	}
+	return g, nil
+}
+
+// NumCommits returns the number of commits in the commit-graph.
+func (g *CommitGraph) NumCommits() int {
+	var n int
+	for _, l := range g.layers {
+		n += int(l.fanout[255])
+	}
+	return n
+}
+
+// position returns the global position of the commit with the given binary shasum.
+func (g *CommitGraph) position(sha []byte) (int, bool) {
+	// Search the top layer first, since that's where the most recent commits are.
+	for i := len(g.layers) - 1; i >= 0; i-- {
+		if lpos, ok := g.layers[i].find(sha); ok {
+			return g.layers[i].offset + lpos, true
+		}
+	}
+	return -1, false
+}
+
+// layer returns the layer containing the given global position, and the position within that layer.
+func (g *CommitGraph) layer(pos int) (*commitGraphLayer, int, error) {
+	for i := len(g.layers) - 1; i >= 0; i-- {
+		l := g.layers[i]
+		if pos >= l.offset {
+			if pos-l.offset >= int(l.fanout[255]) {
+				break
+			}
+			return l, pos - l.offset, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: commit-graph position %d out of range", ErrMalformedChunkFile, pos)
+}
+
+func (g *CommitGraph) shasumAt(pos int) (Hash, error) {
+	l, lpos, err := g.layer(pos)
+	if err != nil {
+		return Hash{}, err
+	}
+	return hashFromBytes(l.oid(lpos)), nil
+}
+
+// hashSize returns the size of the object IDs in the commit-graph.
+func (g *CommitGraph) hashSize() int {
+	if len(g.layers) == 0 {
+		return 0
+	}
+	return g.layers[0].hashSize
+}
+
+func (g *CommitGraph) lookupPosition(shasum Hash) (int, bool, error) {
+	if shasum.Size() != g.hashSize() {
+		return -1, false, ErrMalformedShasum
+	}
+	pos, ok := g.position(shasum.Bytes())
+	return pos, ok, nil
+}
+
+// Lookup returns the commit info stored in the commit-graph for the given commit,
+// or false if the commit isn't in the commit-graph.
+func (g *CommitGraph) Lookup(shasum Hash) (*CommitInfo, bool, error) {
+	pos, ok, err := g.lookupPosition(shasum)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	ci, err := g.commitAt(pos)
+	if err != nil {
+		return nil, false, err
+	}
+	return ci, true, nil
+}
+
+func (g *CommitGraph) commitAt(pos int) (*CommitInfo, error) {
+	l, lpos, err := g.layer(pos)
+	if err != nil {
+		return nil, err
+	}
+	// Each record is the tree ID, two parent positions, and the generation and commit time.
+	size := l.hashSize + 16
+	cdat := l.cdat[size*lpos : size*lpos+size]
+	ci := &CommitInfo{
+		ShaSum: hashFromBytes(l.oid(lpos)),
+		Tree:   hashFromBytes(cdat[:l.hashSize]),
+	}
+	cdat = cdat[l.hashSize:]
+	parents := []uint32{binary.BigEndian.Uint32(cdat)}
+	p2 := binary.BigEndian.Uint32(cdat[4:])
+	if p2&graphParentExtra != 0 {
+		// Octopus merge: the second and later parents are in the extra edges list.
+		for i := int(p2 & ^uint32(graphParentExtra)); ; i++ {
+			if 4*i+4 > len(l.edges) {
+				return nil, fmt.Errorf("%w: extra edge %d out of range", ErrMalformedChunkFile, i)
+			}
+			e := binary.BigEndian.Uint32(l.edges[4*i:])
+			parents = append(parents, e&^uint32(graphLastEdge))
+			if e&graphLastEdge != 0 {
+				break
+			}
+		}
+	} else {
+		parents = append(parents, p2)
+	}
+	for _, p := range parents {
+		if p == graphParentNone {
+			continue
+		}
+		sum, err := g.shasumAt(int(p))
+		if err != nil {
+			return nil, err
+		}
+		ci.Parents = append(ci.Parents, sum)
+	}
+	// The topological level is stored in the upper 30 bits, the commit time in the lower 34.
+	genTime := binary.BigEndian.Uint64(cdat[8:])
+	ci.CommitTime = int64(genTime & (1<<34 - 1))
+	ci.Generation = genTime >> 34
+	if g.correctedDates {
+		off := uint64(binary.BigEndian.Uint32(l.gda2[4*lpos:]))
+		if off&graphOverflowFlag != 0 {
+			i := int(off &^ graphOverflowFlag)
+			if 8*i+8 > len(l.gdo2) {
+				return nil, fmt.Errorf("%w: generation overflow %d out of range", ErrMalformedChunkFile, i)
+			}
+			off = binary.BigEndian.Uint64(l.gdo2[8*i:])
+		}
+		ci.Generation = uint64(ci.CommitTime) + off
+	}
+	return ci, nil
+}
+
+// CommitInfo is the part of a commit needed for walking history.
+type CommitInfo struct {
+	ShaSum     Hash
+	Tree       Hash
+	Parents    []Hash
+	CommitTime int64
+	// Generation is the generation number of the commit, if known from the commit-graph.
+	// A commit's generation is always greater than the generations of its ancestors.
+	// Commits that aren't in the commit-graph have the maximum generation.
+	Generation uint64
+}
+
+// commitGraphs holds the commit-graph of a repo. It's loaded on first use, and reloaded when the commit-graph files
+// have changed, which is checked when a commit isn't found in it, like PackStore rescans the packs.
+type commitGraphs struct {
+	mu     sync.RWMutex
+	loaded bool
+	graph  *CommitGraph
+	// stamp identifies the commit-graph files the graph was loaded from, see commitGraphStamp.
+	stamp string
+}
+
+// commitGraph returns the commit-graph of the repo, or nil if it doesn't have one or it can't be used.
+// The commit-graph of the first of the objects directory and its alternates that has one is used, like in git.
+// A stale commit-graph is still valid, as commits that aren't in it are parsed from their objects instead.
+func (r Repo) commitGraph() *CommitGraph {
+	if r.graphs == nil {
+		return nil
+	}
+	r.graphs.mu.RLock()
+	graph, loaded := r.graphs.graph, r.graphs.loaded
+	r.graphs.mu.RUnlock()
+	if loaded {
+		return graph
+	}
+	return r.reloadCommitGraph()
+}
+
+// reloadCommitGraph reads the commit-graph again if its files have changed since it was loaded, and returns it.
+func (r Repo) reloadCommitGraph() *CommitGraph {
+	if r.graphs == nil {
+		return nil
+	}
+	dirs, done := r.objectDirs()
+	defer done()
+	paths := make([]string, len(dirs))
+	for i, d := range dirs {
+		paths[i] = d.path
+	}
+	stamp := commitGraphStamp(r.storage(), paths)
+	r.graphs.mu.Lock()
+	defer r.graphs.mu.Unlock()
+	if r.graphs.loaded && r.graphs.stamp == stamp {
+		return r.graphs.graph
+	}
+	r.graphs.loaded, r.graphs.stamp, r.graphs.graph = true, stamp, nil
+	if !r.commitGraphUsable() {
+		return nil
+	}
+	// A missing or broken commit-graph is not an error, it's just not used.
+	graph, err := openCommitGraph(r.storage(), paths)
+	if err == nil && graph.hashSize() == r.hashSize() {
+		r.graphs.graph = graph
+	}
+	return r.graphs.graph
+}
+
+// commitGraphStamp returns the sizes and modification times of the commit-graph files and chains in the objects directories.
+// git writes new commit-graphs to a temporary file that is renamed into place, so the stamp changes when they're rewritten.
+func commitGraphStamp(fsys fs.FS, objectsDirs []string) string {
+	var sb strings.Builder
+	for _, dir := range objectsDirs {
+		for _, name := range []string{"info/commit-graph", "info/commit-graphs/commit-graph-chain"} {
+			if fi, err := fs.Stat(fsys, path.Join(dir, name)); err == nil {
+				fmt.Fprintf(&sb, "%s %d %d\n", path.Join(dir, name), fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+	}
+	return sb.String()
+}
+
+// commitGraphUsable reports whether the parents of commits may differ from what's recorded in the commit-graph,
+// which is the case for shallow clones and repos with grafts or replace refs.
+func (r Repo) commitGraphUsable() bool {
+	for _, f := range []string{"shallow", "info/grafts"} {
+		if _, err := fs.Stat(r.storage(), path.Join(r.GitDir, f)); err == nil {
+			return false
+		}
+	}
+	if replace, err := fs.ReadDir(r.storage(), path.Join(r.GitDir, "refs", "replace")); err == nil && len(replace) > 0 {
+		return false
+	}
+	if packed, err := fs.ReadFile(r.storage(), path.Join(r.GitDir, "packed-refs")); err == nil && bytes.Contains(packed, []byte(" refs/replace/")) {
+		return false
+	}
+	return true
+}
+
+// CommitInfo returns the parents, tree, commit time and generation number of the given commit.
+// The commit-graph is used if the commit is in it, otherwise the commit object is parsed.
+func (r Repo) CommitInfo(shasum Hash) (*CommitInfo, error) {
+	return r.newCommitLookup().info(shasum)
+}
+
+// commitLookup looks up commits for one query, like a history walk.
+// Commits that aren't in the commit-graph may have been added to it since it was loaded,
+// so it's reloaded if it has changed, but only once per query, so that walking commits
+// that aren't in the commit-graph doesn't check its files for every commit.
+type commitLookup struct {
+	repo     Repo
+	graph    *CommitGraph
+	reloaded bool
+}
+
+func (r Repo) newCommitLookup() *commitLookup {
+	return &commitLookup{repo: r, graph: r.commitGraph()}
+}
+
+// info is CommitInfo within the query.
+func (l *commitLookup) info(shasum Hash) (*CommitInfo, error) {
+	for {
+		if l.graph != nil {
+			ci, ok, err := l.graph.Lookup(shasum)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return ci, nil
+			}
+		}
+		if l.reloaded {
+			break
+		}
+		l.reloaded = true
+		reloaded := l.repo.reloadCommitGraph()
+		if reloaded == l.graph {
+			break
+		}
+		l.graph = reloaded
+	}
+	commit, err := l.repo.Commit(shasum)
+	if err != nil {
+		return nil, err
+	}
+	return &CommitInfo{
+		ShaSum:     commit.ShaSum,
+		Tree:       commit.Tree,
+		Parents:    commit.Parents,
+		CommitTime: commit.CommitTime(),
+		Generation: generationInfinity,
+	}, nil
+}
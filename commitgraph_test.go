@@ -0,0 +1,243 @@
+package gitwood_test
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haflan/gitwood"
+)
+
+// copyTestdata copies the named repos in testdata to a temporary directory, which is returned.
+func copyTestdata(t *testing.T, repos ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, repo := range repos {
+		err := filepath.Walk(filepath.Join("testdata", repo), func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel("testdata", p)
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(rel)), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, rel), data, 0o644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func openRepo(t *testing.T, gitdir string) *gitwood.Repo {
+	t.Helper()
+	repo, err := gitwood.Open(gitdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// inGraph returns the messages of the first parent history of HEAD, and whether the commit-graph has each commit.
+// The commit infos are checked against the commit objects.
+func inGraph(t *testing.T, repo *gitwood.Repo) map[string]bool {
+	t.Helper()
+	found := map[string]bool{}
+	for sum := repo.HeadCommit(); !sum.IsZero(); {
+		ci, err := repo.CommitInfo(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := repo.Commit(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.Tree != c.Tree || ci.CommitTime != c.CommitTime() || len(ci.Parents) != len(c.Parents) {
+			t.Fatalf("CommitInfo(%v) = %+v doesn't match the commit", sum, ci)
+		}
+		found[c.Message] = ci.Generation != math.MaxUint64
+		sum = gitwood.Hash{}
+		if len(c.Parents) > 0 {
+			sum = c.Parents[0]
+		}
+	}
+	return found
+}
+
+func checkInGraph(t *testing.T, repo *gitwood.Repo, want map[string]bool) {
+	t.Helper()
+	got := inGraph(t, repo)
+	for msg, in := range want {
+		if got[msg] != in {
+			t.Errorf("commit %q in commit-graph = %v, want %v", msg, got[msg], in)
+		}
+	}
+}
+
+func allInGraph(in bool) map[string]bool {
+	want := map[string]bool{}
+	for i := 1; i <= 8; i++ {
+		want[fmt.Sprintf("commit %d\n", i)] = in
+	}
+	return want
+}
+
+// TestCommitGraphAlternates reads a commit-graph chain whose first layers are in an alternate.
+func TestCommitGraphAlternates(t *testing.T) {
+	checkInGraph(t, openRepo(t, "testdata/alt.git"), allInGraph(true))
+}
+
+// TestCommitGraphOfAlternate uses the commit-graph of an alternate, when the repo has none of its own.
+func TestCommitGraphOfAlternate(t *testing.T) {
+	dir := copyTestdata(t, "split.git", "alt.git")
+	if err := os.RemoveAll(filepath.Join(dir, "alt.git", "objects", "info", "commit-graphs")); err != nil {
+		t.Fatal(err)
+	}
+	want := allInGraph(true)
+	want["commit 7\n"], want["commit 8\n"] = false, false
+	checkInGraph(t, openRepo(t, filepath.Join(dir, "alt.git")), want)
+}
+
+// TestCommitGraphReload reads commits before and after their commit-graph is written.
+func TestCommitGraphReload(t *testing.T) {
+	dir := copyTestdata(t, "split.git")
+	chain := filepath.Join(dir, "split.git", "objects", "info", "commit-graphs", "commit-graph-chain")
+	data, err := os.ReadFile(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(chain); err != nil {
+		t.Fatal(err)
+	}
+	repo := openRepo(t, filepath.Join(dir, "split.git"))
+	want := allInGraph(false)
+	delete(want, "commit 7\n")
+	delete(want, "commit 8\n")
+	checkInGraph(t, repo, want)
+
+	// Only the first layer of the chain.
+	if err = os.WriteFile(chain, data[:41], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want["commit 1\n"], want["commit 2\n"], want["commit 3\n"] = true, true, true
+	checkInGraph(t, repo, want)
+
+	if err = os.WriteFile(chain, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want["commit 4\n"], want["commit 5\n"], want["commit 6\n"] = true, true, true
+	checkInGraph(t, repo, want)
+}
+
+// TestIsAncestorMergeBase checks IsAncestor and MergeBase for every pair of commits in the linear history of
+// testdata/split.git, with the whole commit-graph chain, with only its first layer, and without a commit-graph.
+func TestIsAncestorMergeBase(t *testing.T) {
+	dir := copyTestdata(t, "split.git")
+	chain := filepath.Join(dir, "split.git", "objects", "info", "commit-graphs", "commit-graph-chain")
+	data, err := os.ReadFile(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		chain []byte
+	}{
+		{"graph", data},
+		{"first layer", data[:41]},
+		{"no graph", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.chain == nil {
+				err = os.Remove(chain)
+			} else {
+				err = os.WriteFile(chain, tt.chain, 0o644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := openRepo(t, filepath.Join(dir, "split.git"))
+			log, err := repo.Log(repo.HeadCommit())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// commits[i] is commit i+1.
+			commits := make([]gitwood.Hash, len(log))
+			for i, c := range log {
+				commits[len(log)-1-i] = c.ShaSum
+			}
+			for i, a := range commits {
+				for j, b := range commits {
+					if ok, err := repo.IsAncestor(a, b); err != nil || ok != (i <= j) {
+						t.Errorf("IsAncestor(commit %d, commit %d) = %v, %v, want %v", i+1, j+1, ok, err, i <= j)
+					}
+					want := commits[i]
+					if j < i {
+						want = commits[j]
+					}
+					if bases, err := repo.MergeBase(a, b); err != nil || len(bases) != 1 || bases[0] != want {
+						t.Errorf("MergeBase(commit %d, commit %d) = %v, %v, want %v", i+1, j+1, bases, err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// countingFS counts the files opened in a directory whose names contain "commit-graph".
+type countingFS struct {
+	fs.FS
+	opened atomic.Int64
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	if strings.Contains(name, "commit-graph") {
+		c.opened.Add(1)
+	}
+	return c.FS.Open(name)
+}
+
+// TestCommitGraphReloadOnce checks that walking commits that aren't in the commit-graph
+// checks the commit-graph files once per walk, not once per commit.
+func TestCommitGraphReloadOnce(t *testing.T) {
+	dir := copyTestdata(t, "split.git")
+	if err := os.RemoveAll(filepath.Join(dir, "split.git", "objects", "info", "commit-graphs")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &countingFS{FS: os.DirFS(filepath.Join(dir, "split.git"))}
+	repo, err := gitwood.OpenFS(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	head := repo.HeadCommit()
+	// The commit-graph is loaded on first use.
+	if _, err = repo.CommitInfo(head); err != nil {
+		t.Fatal(err)
+	}
+	before := fsys.opened.Load()
+	log, err := repo.LogInfo(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) < 2 {
+		t.Fatalf("LogInfo() returned %d commits, want more", len(log))
+	}
+	// Each check stats the commit-graph file and chain.
+	if n := fsys.opened.Load() - before; n > 2 {
+		t.Errorf("LogInfo() of %d commits opened commit-graph files %d times, want at most 2", len(log), n)
+	}
+}
@@ -0,0 +1,112 @@
+package gitwood
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// readConfig reads the repo's config file into a map from "section.key" or "section.subsection.key" to value.
+// Section and key names are lowercased, as they're case-insensitive in git, while subsections are kept as they are.
+// This is just enough of the config format for the settings gitwood needs: includes aren't followed,
+// and for keys that are set more than once, the last value wins.
+// A missing config file is the same as an empty one.
+func readConfig(fsys fs.FS, gitdir string) (map[string]string, error) {
+	data, err := fs.ReadFile(fsys, path.Join(gitdir, "config"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	config := map[string]string{}
+	var section string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("bad config section header %q", line)
+			}
+			name, sub, hasSub := strings.Cut(line[1:end], " ")
+			section = strings.ToLower(name)
+			if hasSub {
+				section += "." + strings.Trim(strings.TrimSpace(sub), `"`)
+			}
+			// A key can follow the header on the same line.
+			if line = strings.TrimSpace(line[end+1:]); line == "" {
+				continue
+			}
+		}
+		key, value, hasValue := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !hasValue {
+			// A key without a value is a boolean true.
+			value = "true"
+		}
+		config[section+"."+key] = configValue(value)
+	}
+	return config, nil
+}
+
+// configValue strips the comments and quotes from a config value, like git does.
+// Whitespace outside quotes is dropped at the ends, and otherwise kept as spaces.
+func configValue(value string) string {
+	var sb strings.Builder
+	var quoted bool
+	var spaces int
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !quoted {
+			if c == ' ' || c == '\t' {
+				if sb.Len() > 0 {
+					spaces++
+				}
+				continue
+			}
+			if c == '#' || c == ';' {
+				break
+			}
+		}
+		for ; spaces > 0; spaces-- {
+			sb.WriteByte(' ')
+		}
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(value[i])
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// readObjectFormat returns the object format set by extensions.objectFormat in the repo's config.
+func readObjectFormat(fsys fs.FS, gitdir string) (ObjectFormat, error) {
+	config, err := readConfig(fsys, gitdir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config: %w", err)
+	}
+	format, ok := config["extensions.objectformat"]
+	if !ok {
+		return SHA1, nil
+	}
+	switch f := ObjectFormat(strings.ToLower(format)); f {
+	case SHA1, SHA256:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedObjectFormat, format)
+	}
+}
@@ -0,0 +1,148 @@
+package gitwood
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"sections", "[core]\n\tbare = true\n[Extensions]\n\tObjectFormat = sha256\n", map[string]string{
+			"core.bare":               "true",
+			"extensions.objectformat": "sha256",
+		}},
+		{"subsections", "[remote \"origin\"]\n\turl = https://example.com/Repo.git\n[branch \"Main\"]\n\tremote = origin\n", map[string]string{
+			"remote.origin.url":  "https://example.com/Repo.git",
+			"branch.Main.remote": "origin",
+		}},
+		{"comments", "# comment\n; comment\n[core]\n\tbare = false # comment\n\tname = a;b\n", map[string]string{
+			"core.bare": "false",
+			"core.name": "a",
+		}},
+		{"quotes and escapes", "[core]\n\ta = \" spaced # not a comment \"\n\tb = tab\\tnewline\\n\\\"quote\\\"\n", map[string]string{
+			"core.a": " spaced # not a comment ",
+			"core.b": "tab\tnewline\n\"quote\"",
+		}},
+		{"whitespace", "[core]\n\tc = x  \t y  # comment\n\td = \"\" lead\n", map[string]string{
+			"core.c": "x    y",
+			"core.d": "lead",
+		}},
+		{"key without value", "[core]\n\tbare\n", map[string]string{"core.bare": "true"}},
+		{"key after header", "[core] bare = true\n", map[string]string{"core.bare": "true"}},
+		{"last value wins", "[core]\n\tbare = true\n[core]\n\tbare = false\n", map[string]string{"core.bare": "false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"repo/config": {Data: []byte(tt.config)}}
+			config, err := readConfig(fsys, "repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("readConfig() = %q, want %q", config, tt.want)
+			}
+		})
+	}
+	if config, err := readConfig(fstest.MapFS{}, "repo"); err != nil || len(config) != 0 {
+		t.Errorf("readConfig() of a missing config = %v, %v, want an empty config", config, err)
+	}
+	if _, err := readConfig(fstest.MapFS{"repo/config": {Data: []byte("[core\n")}}, "repo"); err == nil {
+		t.Error("readConfig() of a bad section header succeeded")
+	}
+}
+
+func TestReadObjectFormat(t *testing.T) {
+	tests := []struct {
+		config string
+		want   ObjectFormat
+		err    error
+	}{
+		{"", SHA1, nil},
+		{"[core]\n\trepositoryformatversion = 0\n", SHA1, nil},
+		{"[extensions]\n\tobjectFormat = sha1\n", SHA1, nil},
+		{"[extensions]\n\tobjectformat = sha256\n", SHA256, nil},
+		{"[Extensions]\n\tObjectFormat = SHA256\n", SHA256, nil},
+		{"[extensions]\n\tobjectformat = sha3\n", "", ErrUnsupportedObjectFormat},
+	}
+	for _, tt := range tests {
+		fsys := fstest.MapFS{"repo/config": {Data: []byte(tt.config)}}
+		format, err := readObjectFormat(fsys, "repo")
+		if format != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("readObjectFormat(%q) = %q, %v, want %q, %v", tt.config, format, err, tt.want, tt.err)
+		}
+	}
+}
+
+// TestOpenSHA256 reads testdata/sha256.git, which git wrote with a pack, loose objects and a commit-graph.
+func TestOpenSHA256(t *testing.T) {
+	f, err := os.Open("testdata/sha256-log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Each line is a commit ID and its tree ID, newest first.
+	var want [][2]Hash
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var ids [2]Hash
+		for i, field := range strings.Fields(s.Text()) {
+			if ids[i], err = ParseHash(field); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want = append(want, ids)
+	}
+
+	repo, err := Open("testdata/sha256.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	repo.Verify = true
+	if repo.ObjectFormat() != SHA256 {
+		t.Fatalf("ObjectFormat() = %v, want %v", repo.ObjectFormat(), SHA256)
+	}
+	log, err := repo.Log(repo.HeadCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != len(want) {
+		t.Fatalf("Log() returned %d commits, want %d", len(log), len(want))
+	}
+	for i, c := range log {
+		if c.ShaSum != want[i][0] || c.Tree != want[i][1] {
+			t.Errorf("commit %d = %v with tree %v, want %v with tree %v", i, c.ShaSum, c.Tree, want[i][0], want[i][1])
+		}
+		ci, err := repo.CommitInfo(c.ShaSum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.Generation == math.MaxUint64 {
+			t.Errorf("commit %v isn't in the commit-graph", c.ShaSum)
+		}
+	}
+	var n int
+	err = repo.ForEachObject(func(o ObjectInfo) error {
+		n++
+		_, _, err := repo.Object(o.ShaSum)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each commit adds a commit, a root tree, a subtree and a blob.
+	if n != 4*len(want) {
+		t.Errorf("ForEachObject() found %d objects, want %d", n, 4*len(want))
+	}
+}
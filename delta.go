@@ -0,0 +1,111 @@
+package gitwood
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Delta format, see https://git-scm.com/docs/gitformat-pack#_deltified_representation:
+//
+//	header: base size, target size (little-endian base 128 varints)
+//	instructions: copy (MSB set), insert (1-127 bytes follow), or 0 (reserved)
+//
+// A copy instruction has 7 flag bits, saying which bytes of the 4 byte little-endian base offset
+// and 3 byte size follow. A size of 0 means 0x10000.
+
+// DeltaError is returned when a delta can't be applied to its base.
+// It matches ErrMalformedDelta with errors.Is.
+type DeltaError struct {
+	// Offset is the position in the delta of the header field or instruction that is invalid,
+	// or the length of the delta if it ends too early.
+	Offset int
+	Reason string
+}
+
+func (e *DeltaError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %v", ErrMalformedDelta, e.Offset, e.Reason)
+}
+
+func (e *DeltaError) Is(target error) bool {
+	return target == ErrMalformedDelta
+}
+
+func deltaError(off int, format string, args ...any) error {
+	return &DeltaError{Offset: off, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ApplyDelta returns the object that results from applying a git delta, as stored in packs, to its base object.
+// The delta is checked against the base and the target size it declares, so that deltas from untrusted packs
+// return a *DeltaError instead of reading out of bounds or producing the wrong object.
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, deltaError(0, "bad base size")
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, deltaError(0, "base size %d doesn't match the base of %d bytes", baseSize, len(base))
+	}
+	pos := n
+	targetSize, n := binary.Uvarint(delta[pos:])
+	if n <= 0 {
+		return nil, deltaError(pos, "bad target size")
+	}
+	pos += n
+	// The target size is only trusted as far as the delta can plausibly produce it.
+	// Deltas that copy the same data many times grow the buffer as they go.
+	hint := targetSize
+	if max := uint64(len(base) + len(delta)); hint > max {
+		hint = max
+	}
+	target := makeBuffer(hint)
+	for pos < len(delta) {
+		start := pos
+		inst := delta[pos]
+		pos++
+		switch {
+		case inst&0x80 != 0:
+			var offset, size uint64
+			for i := 0; i < 7; i++ {
+				if inst&(1<<i) == 0 {
+					continue
+				}
+				if pos == len(delta) {
+					return nil, deltaError(start, "truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= uint64(delta[pos]) << (8 * i)
+				} else {
+					size |= uint64(delta[pos]) << (8 * (i - 4))
+				}
+				pos++
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			// Neither can overflow, as the offset has 32 bits and the size 24.
+			if offset+size > uint64(len(base)) {
+				return nil, deltaError(start, "copy of %d bytes at offset %d is outside the base of %d bytes", size, offset, len(base))
+			}
+			if uint64(len(target))+size > targetSize {
+				return nil, deltaError(start, "copy of %d bytes exceeds the target size %d", size, targetSize)
+			}
+			target = append(target, base[offset:offset+size]...)
+		case inst != 0:
+			size := int(inst)
+			if size > len(delta)-pos {
+				return nil, deltaError(start, "insert of %d bytes is truncated", size)
+			}
+			if uint64(len(target)+size) > targetSize {
+				return nil, deltaError(start, "insert of %d bytes exceeds the target size %d", size, targetSize)
+			}
+			target = append(target, delta[pos:pos+size]...)
+			pos += size
+		default:
+			return nil, deltaError(start, "reserved instruction 0")
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, deltaError(pos, "delta produced %d bytes, but declares %d", len(target), targetSize)
+	}
+	return target, nil
+}
@@ -0,0 +1,123 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// delta builds a delta from its header sizes and instructions.
+func delta(baseSize, targetSize uint64, insts ...[]byte) []byte {
+	d := binary.AppendUvarint(nil, baseSize)
+	d = binary.AppendUvarint(d, targetSize)
+	for _, inst := range insts {
+		d = append(d, inst...)
+	}
+	return d
+}
+
+// copyInst returns a copy instruction with all offset and size bytes present.
+func copyInst(offset, size uint32) []byte {
+	return []byte{0xff, byte(offset), byte(offset >> 8), byte(offset >> 16), byte(offset >> 24), byte(size), byte(size >> 8), byte(size >> 16)}
+}
+
+func insertInst(data string) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+var deltaBase = []byte("hello, world\n")
+
+func TestApplyDelta(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 0x10000)
+	tests := []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  string
+	}{
+		{"copy", deltaBase, delta(13, 5, copyInst(0, 5)), "hello"},
+		{"insert", deltaBase, delta(13, 3, insertInst("abc")), "abc"},
+		{"copy and insert", deltaBase, delta(13, 12, copyInst(7, 5), insertInst(", "), copyInst(0, 5)), "world, hello"},
+		// Only the offset and size bytes with their flag set follow the instruction.
+		{"sparse copy", deltaBase, delta(13, 4, []byte{0x91, 7, 4}), "worl"},
+		{"copy size 0 means 0x10000", big, delta(0x10000, 0x10000, []byte{0x80}), string(big)},
+		{"empty target", deltaBase, delta(13, 0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyDelta(tt.base, tt.delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ApplyDelta() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		delta  []byte
+		offset int
+		reason string
+	}{
+		{"empty", nil, 0, "bad base size"},
+		{"truncated base size varint", []byte{0x8d}, 0, "bad base size"},
+		{"base size mismatch", delta(12, 5, copyInst(0, 5)), 0, "base size 12 doesn't match"},
+		{"truncated target size varint", []byte{13, 0x85}, 1, "bad target size"},
+		{"target size too large", delta(13, 6, copyInst(0, 5)), 10, "delta produced 5 bytes, but declares 6"},
+		{"target size too small", delta(13, 4, copyInst(0, 5)), 2, "exceeds the target size 4"},
+		{"copy past the base", delta(13, 5, copyInst(10, 5)), 2, "outside the base of 13 bytes"},
+		{"copy offset overflow", delta(13, 5, copyInst(0xffffffff, 5)), 2, "outside the base"},
+		{"copy size 0 past the base", delta(13, 5, []byte{0x80}), 2, "copy of 65536 bytes"},
+		{"truncated copy", delta(13, 5, copyInst(0, 5)[:4]), 2, "truncated copy instruction"},
+		{"reserved instruction", delta(13, 5, []byte{0}, copyInst(0, 5)), 2, "reserved instruction 0"},
+		{"truncated insert", delta(13, 3, insertInst("abc")[:3]), 2, "insert of 3 bytes is truncated"},
+		{"insert past the target size", delta(13, 2, insertInst("abc")), 2, "insert of 3 bytes exceeds the target size 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ApplyDelta(deltaBase, tt.delta)
+			if !errors.Is(err, ErrMalformedDelta) {
+				t.Fatalf("ApplyDelta() error = %v, want %v", err, ErrMalformedDelta)
+			}
+			var de *DeltaError
+			if !errors.As(err, &de) {
+				t.Fatalf("ApplyDelta() error = %T, want *DeltaError", err)
+			}
+			if de.Offset != tt.offset || !strings.Contains(de.Reason, tt.reason) {
+				t.Errorf("ApplyDelta() error = %q at offset %d, want %q at offset %d", de.Reason, de.Offset, tt.reason, tt.offset)
+			}
+		})
+	}
+}
+
+func FuzzApplyDelta(f *testing.F) {
+	f.Add(deltaBase, delta(13, 12, copyInst(7, 5), insertInst(", "), copyInst(0, 5)))
+	f.Add(deltaBase, delta(13, 4, []byte{0x91, 7, 4}))
+	f.Add(deltaBase, delta(13, 5, copyInst(0, 5)[:4]))
+	f.Add(deltaBase, delta(13, 3, insertInst("abc")[:3]))
+	f.Add(deltaBase, delta(13, 5, copyInst(0xffffffff, 5)))
+	f.Add(deltaBase, delta(13, 1<<62, []byte{0x80}))
+	f.Add(deltaBase, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{}, []byte{0, 0, 0})
+	f.Fuzz(func(t *testing.T, base, d []byte) {
+		target, err := ApplyDelta(base, d)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedDelta) {
+				t.Fatalf("ApplyDelta() error = %v, want %v", err, ErrMalformedDelta)
+			}
+			return
+		}
+		// A delta that applies produces as many bytes as it declares.
+		_, n := binary.Uvarint(d)
+		targetSize, _ := binary.Uvarint(d[n:])
+		if uint64(len(target)) != targetSize {
+			t.Fatalf("ApplyDelta() returned %d bytes, delta declares %d", len(target), targetSize)
+		}
+	})
+}
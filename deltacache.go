@@ -0,0 +1,53 @@
+package gitwood
+
+import (
+	"io"
+)
+
+// DeltaBaseCache is a size-bounded LRU cache of resolved delta base objects.
+// Objects in packs are often stored as deltas against other objects, in chains that can be deep,
+// and without a cache every base in the chain is read and inflated again for every object.
+// Set Repo.DeltaBaseCache to use one. A DeltaBaseCache is safe for concurrent use,
+// and may be shared between repos.
+type DeltaBaseCache struct {
+	lru *lru[deltaBaseKey]
+}
+
+// deltaBaseKey identifies a base object by its pack and pack offset.
+// Packs are identified by their name, which has the checksum of the pack, so that bases are found again
+// after the pack is reopened, as repos that aren't created by Open do on every read, or rescanned,
+// and in other repos sharing the cache. Other files are identified by the file itself.
+type deltaBaseKey struct {
+	pack string
+	file io.ReaderAt
+	off  uint64
+}
+
+func newDeltaBaseKey(file io.ReaderAt, off uint64) deltaBaseKey {
+	if p, ok := file.(*Pack); ok {
+		return deltaBaseKey{pack: p.Name, off: off}
+	}
+	return deltaBaseKey{file: file, off: off}
+}
+
+// NewDeltaBaseCache returns a cache that holds at most maxSize bytes of object data.
+func NewDeltaBaseCache(maxSize int) *DeltaBaseCache {
+	return &DeltaBaseCache{lru: newLRU[deltaBaseKey](maxSize)}
+}
+
+// Size returns the number of bytes of object data in the cache.
+func (c *DeltaBaseCache) Size() int {
+	_, size := c.lru.len()
+	return size
+}
+
+// get returns the cached base at the given pack offset.
+// The returned data is shared, and must not be modified.
+func (c *DeltaBaseCache) get(pack io.ReaderAt, off uint64) (ObjectType, []byte, bool) {
+	return c.lru.get(newDeltaBaseKey(pack, off))
+}
+
+// add caches the base at the given pack offset.
+func (c *DeltaBaseCache) add(pack io.ReaderAt, off uint64, otype ObjectType, data []byte) {
+	c.lru.add(newDeltaBaseKey(pack, off), otype, data)
+}
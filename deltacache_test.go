@@ -0,0 +1,96 @@
+package gitwood
+
+import (
+	"bytes"
+	"compress/zlib"
+	"sync"
+	"testing"
+)
+
+// packEntry returns a pack entry of the given type, with the header, any ofs-delta base offset, and the deflated data.
+func packEntry(otype ObjectType, baseOffset []byte, data []byte) []byte {
+	size := len(data)
+	entry := []byte{byte(otype)<<4 | byte(size&0xf)}
+	for size >>= 4; size > 0; size >>= 7 {
+		entry[len(entry)-1] |= 0x80
+		entry = append(entry, byte(size&0x7f))
+	}
+	entry = append(entry, baseOffset...)
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return append(entry, buf.Bytes()...)
+}
+
+// recordingFile is a pack file that records the offsets it's read at.
+type recordingFile struct {
+	*bytes.Reader
+	mu    sync.Mutex
+	reads []int64
+}
+
+func (f *recordingFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.reads = append(f.reads, off)
+	f.mu.Unlock()
+	return f.Reader.ReadAt(b, off)
+}
+
+func (f *recordingFile) Close() error {
+	return nil
+}
+
+func (f *recordingFile) readAt(off int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, o := range f.reads {
+		if o == off {
+			return true
+		}
+	}
+	return false
+}
+
+// TestDeltaBaseCacheReopenedPack reads a delta twice, from two Packs for the same pack file,
+// like repos that aren't created by Open do. The second read must find the base in the cache.
+func TestDeltaBaseCacheReopenedPack(t *testing.T) {
+	base := []byte("hello, world\n")
+	const baseOff = 12
+	pack := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x02"), packEntry(OBJ_BLOB, nil, base)...)
+	deltaOff := uint64(len(pack))
+	// The base is deltaOff-baseOff bytes back, which fits in one byte of the offset encoding.
+	pack = append(pack, packEntry(OBJ_OFS_DELTA, []byte{byte(deltaOff - baseOff)}, delta(13, 12, copyInst(7, 5), insertInst(", "), copyInst(0, 5)))...)
+	open := func() (*Pack, *recordingFile) {
+		f := &recordingFile{Reader: bytes.NewReader(pack)}
+		return &Pack{Name: "pack-1234", file: f, hashSize: SHA1Size}, f
+	}
+
+	cache := NewDeltaBaseCache(1 << 20)
+	r := &Repo{DeltaBaseCache: cache, format: SHA1}
+	for i := 0; i < 2; i++ {
+		p, f := open()
+		otype, o, err := r.readFromPack(p, deltaOff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if otype != OBJ_BLOB || string(o) != "world, hello" {
+			t.Fatalf("readFromPack() = %v %q", otype, o)
+		}
+		if readBase := f.readAt(baseOff); readBase != (i == 0) {
+			t.Errorf("read %d: base read from the pack = %v, want %v", i, readBase, i == 0)
+		}
+	}
+	if cache.Size() != len(base) {
+		t.Errorf("cache size = %d, want %d", cache.Size(), len(base))
+	}
+	// Packs with other names don't share the cached base.
+	other, f := open()
+	other.Name = "pack-5678"
+	if _, _, err := r.readFromPack(other, deltaOff); err != nil {
+		t.Fatal(err)
+	}
+	if !f.readAt(baseOff) {
+		t.Error("base of another pack was found in the cache")
+	}
+}
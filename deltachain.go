@@ -0,0 +1,159 @@
+package gitwood
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// DefaultMaxDeltaDepth is the longest delta chain that is followed when Repo.MaxDeltaDepth isn't set.
+// git writes chains of at most 4095 deltas, and 50 by default, so this only stops broken or hostile packs.
+const DefaultMaxDeltaDepth = 10000
+
+// DeltaChainEntry is a pack entry in a delta chain.
+type DeltaChainEntry struct {
+	// Pack is the pack file the entry is in, and Offset its pack offset.
+	Pack   string
+	Offset uint64
+	// ShaSum is the ID of entries that were looked up as the base of a ref-delta, and zero for others.
+	ShaSum Hash
+}
+
+func (e DeltaChainEntry) String() string {
+	s := fmt.Sprintf("offset %d", e.Offset)
+	if e.Pack != "" {
+		s = path.Base(e.Pack) + "@" + fmt.Sprint(e.Offset)
+	}
+	if !e.ShaSum.IsZero() {
+		s = e.ShaSum.String() + " (" + s + ")"
+	}
+	return s
+}
+
+// DeltaChainError is returned when an object can't be read because its delta chain is longer than
+// the repo's MaxDeltaDepth, or leads back to an entry that is already in the chain.
+// It matches ErrDeltaChainTooDeep or ErrDeltaCycle with errors.Is.
+type DeltaChainError struct {
+	// Chain are the entries that were followed, starting with the object that was read.
+	// For cycles, the last entry is the one that was seen before.
+	Chain []DeltaChainEntry
+	Err   error
+}
+
+// maxChainErrorEntries is how many chain entries are listed in error messages.
+// Longer chains are shortened to their ends.
+const maxChainErrorEntries = 8
+
+func (e *DeltaChainError) Error() string {
+	var entries []string
+	for i, c := range e.Chain {
+		if len(e.Chain) > maxChainErrorEntries && i == maxChainErrorEntries/2 {
+			entries = append(entries, fmt.Sprintf("... (%d entries)", len(e.Chain)-maxChainErrorEntries))
+		}
+		if len(e.Chain) > maxChainErrorEntries && i >= maxChainErrorEntries/2 && i < len(e.Chain)-maxChainErrorEntries/2 {
+			continue
+		}
+		entries = append(entries, c.String())
+	}
+	return fmt.Sprintf("%v: %v", e.Err, strings.Join(entries, " -> "))
+}
+
+func (e *DeltaChainError) Unwrap() error {
+	return e.Err
+}
+
+// maxDeltaDepth returns the longest delta chain the repo follows.
+func (r *Repo) maxDeltaDepth() int {
+	if r.MaxDeltaDepth > 0 {
+		return r.MaxDeltaDepth
+	}
+	return DefaultMaxDeltaDepth
+}
+
+// deltaLink is a pack entry in a delta chain.
+type deltaLink struct {
+	file io.ReaderAt
+	off  uint64
+	// sum is the ID of an entry that was looked up as the base of a ref-delta.
+	sum Hash
+	h   entryHeader
+}
+
+// deltaChain follows delta chains from an object to its base iteratively, so that chains can be
+// as deep as the repo allows, and ref-deltas that lead back to themselves are caught instead of looping.
+type deltaChain struct {
+	repo  *Repo
+	links []deltaLink
+	seen  map[deltaBaseKey]bool
+	// dirs are the object directories that ref-delta bases are looked up in, opened on first use.
+	dirs []*objectDir
+	done func()
+}
+
+func newDeltaChain(r *Repo, file io.ReaderAt, off uint64) (*deltaChain, deltaLink) {
+	c := &deltaChain{repo: r, seen: map[deltaBaseKey]bool{newDeltaBaseKey(file, off): true}}
+	return c, deltaLink{file: file, off: off}
+}
+
+// close closes the object directories opened for ref-delta bases.
+func (c *deltaChain) close() {
+	if c.done != nil {
+		c.done()
+	}
+}
+
+// read reads the entry header of the link.
+func (c *deltaChain) read(l deltaLink) (deltaLink, error) {
+	h, err := readEntry(l.file, l.off, c.repo.hashSize())
+	if err != nil {
+		if len(c.links) > 0 {
+			err = fmt.Errorf("failed to read delta base %v: %w", c.entry(l), err)
+		}
+		return l, err
+	}
+	l.h = h
+	return l, nil
+}
+
+// next adds a delta to the chain, and returns the entry it's based on.
+func (c *deltaChain) next(l deltaLink) (deltaLink, error) {
+	c.links = append(c.links, l)
+	if len(c.links) > c.repo.maxDeltaDepth() {
+		return l, c.error(ErrDeltaChainTooDeep, nil)
+	}
+	base := deltaLink{file: l.file, off: l.h.baseOff}
+	if l.h.otype == OBJ_REF_DELTA {
+		// Packs on disk are self contained, so ref-delta bases are only looked up in packs.
+		if c.dirs == nil {
+			c.dirs, c.done = c.repo.objectDirs()
+		}
+		pack, off, err := findPacked(c.dirs, l.h.baseSum, true)
+		if err != nil {
+			return l, fmt.Errorf("failed to find delta base %v: %w", l.h.baseSum, err)
+		}
+		base = deltaLink{file: pack, off: off, sum: l.h.baseSum}
+	}
+	key := newDeltaBaseKey(base.file, base.off)
+	if c.seen[key] {
+		return base, c.error(ErrDeltaCycle, &base)
+	}
+	c.seen[key] = true
+	return base, nil
+}
+
+func (c *deltaChain) entry(l deltaLink) DeltaChainEntry {
+	return DeltaChainEntry{Pack: packFileName(l.file), Offset: l.off, ShaSum: l.sum}
+}
+
+// error returns a DeltaChainError for the chain, followed by last if it isn't nil.
+func (c *deltaChain) error(err error, last *deltaLink) error {
+	e := &DeltaChainError{Err: err}
+	for _, l := range c.links {
+		e.Chain = append(e.Chain, c.entry(l))
+	}
+	if last != nil {
+		e.Chain = append(e.Chain, c.entry(*last))
+	}
+	return e
+}
@@ -0,0 +1,117 @@
+package gitwood_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// deltaChainHistory returns a builder with versions of a blob, which are deltas of the previous version in packs with deltas.
+func deltaChainHistory(versions int) (*gitwoodtest.Builder, []gitwood.Hash) {
+	b := gitwoodtest.New()
+	var blobs []gitwood.Hash
+	text := strings.Repeat("a line of text\n", 20)
+	for i := 0; i < versions; i++ {
+		text += fmt.Sprintf("version %d\n", i)
+		blobs = append(blobs, b.Blob(text))
+	}
+	return b, blobs
+}
+
+func TestMaxDeltaDepth(t *testing.T) {
+	b, blobs := deltaChainHistory(6)
+	for name, deltas := range map[string]gitwoodtest.Deltas{"ofs-deltas": gitwoodtest.OfsDeltas, "ref-deltas": gitwoodtest.RefDeltas} {
+		t.Run(name, func(t *testing.T) {
+			repo := b.Repo(t, gitwoodtest.Options{Pack: true, Deltas: deltas})
+			repo.MaxDeltaDepth = 3
+			// blobs[i] is at the end of a chain of i deltas.
+			for i, sum := range blobs {
+				_, _, err := repo.Object(sum)
+				if i <= 3 {
+					if err != nil {
+						t.Errorf("Object() of blob %d: %v", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, gitwood.ErrDeltaChainTooDeep) {
+					t.Fatalf("Object() of blob %d error = %v, want %v", i, err, gitwood.ErrDeltaChainTooDeep)
+				}
+				var chainErr *gitwood.DeltaChainError
+				if !errors.As(err, &chainErr) {
+					t.Fatalf("Object() of blob %d error = %v, want a DeltaChainError", i, err)
+				}
+				// The chain has one more delta than is allowed.
+				if len(chainErr.Chain) != 4 {
+					t.Errorf("Object() of blob %d error has chain %v, want 4 entries", i, chainErr.Chain)
+				}
+				if deltas == gitwoodtest.RefDeltas {
+					// Ref-delta bases are looked up by ID, and the base of blob i is blob i-1.
+					for j, e := range chainErr.Chain[1:] {
+						if want := blobs[i-1-j]; e.ShaSum != want {
+							t.Errorf("chain entry %d of blob %d = %v, want %v", j+1, i, e.ShaSum, want)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDeltaCycle reads ref-deltas whose bases lead back to themselves.
+func TestDeltaCycle(t *testing.T) {
+	b, blobs := deltaChainHistory(3)
+	dir := t.TempDir()
+	if err := b.Write(dir, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.RefDeltas}); err != nil {
+		t.Fatal(err)
+	}
+	s := gitwood.NewPackStore(filepath.Join(dir, "objects", "pack"))
+	p, off, err := s.Find(blobs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "objects", "pack", p.Name+".pack")
+	s.Close()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make blob 1 a delta of blob 2, which is a delta of blob 1.
+	i := bytes.Index(data[off:], blobs[0].Bytes())
+	if i < 0 {
+		t.Fatal("no delta base in the pack entry")
+	}
+	copy(data[int(off)+i:], blobs[2].Bytes())
+	if err = os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := gitwood.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if _, _, err = repo.Object(blobs[0]); err != nil {
+		t.Errorf("Object() of blob 0, which isn't in the cycle: %v", err)
+	}
+	for _, sum := range blobs[1:] {
+		_, _, err := repo.Object(sum)
+		if !errors.Is(err, gitwood.ErrDeltaCycle) {
+			t.Fatalf("Object(%v) error = %v, want %v", sum, err, gitwood.ErrDeltaCycle)
+		}
+		var chainErr *gitwood.DeltaChainError
+		if !errors.As(err, &chainErr) {
+			t.Fatalf("Object(%v) error = %v, want a DeltaChainError", sum, err)
+		}
+		// The chain goes from the object to the other one, and back to the object.
+		chain := chainErr.Chain
+		if len(chain) != 3 || chain[2].Offset != chain[0].Offset || chain[2].ShaSum != sum {
+			t.Errorf("Object(%v) error has chain %v, want one back to the object", sum, chain)
+		}
+	}
+}
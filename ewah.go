@@ -0,0 +1,134 @@
+package gitwood
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// EWAH is the compressed bitmap format used by reachability bitmaps.
+// A serialized EWAH bitmap consists of:
+//
+//	4 bytes: number of bits
+//	4 bytes: number of 64 bit words
+//	words:   big endian 64 bit words
+//	4 bytes: position of the last run length word
+//
+// The words are a sequence of "run length words", each followed by a number of literal words.
+// A run length word has the running bit in bit 0, the run length (in words) in bits 1-32
+// and the number of literal words that follow in bits 33-63.
+// See https://git-scm.com/docs/bitmap-format and ewah/ in git.
+
+const (
+	ewahRunLengthBits = 32
+	ewahLiteralBits   = 31
+)
+
+// readEWAH returns the raw serialized EWAH bitmap at the start of data, and the number of bytes it occupies.
+func readEWAH(data []byte) ([]byte, int, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("%w: truncated EWAH bitmap", ErrMalformedBitmap)
+	}
+	words := int(binary.BigEndian.Uint32(data[4:]))
+	size := 8 + 8*words + 4
+	if words < 0 || len(data) < size {
+		return nil, 0, fmt.Errorf("%w: truncated EWAH bitmap", ErrMalformedBitmap)
+	}
+	return data[:size], size, nil
+}
+
+// decodeEWAH inflates a serialized EWAH bitmap of at most maxBits bits into a plain bitmap, with bit i in word i/64.
+// The sizes in the header are checked before anything is allocated, so corrupt bitmaps can't allocate more than
+// maxBits allow. git may round the number of bits up to a whole word.
+func decodeEWAH(raw []byte, maxBits int) ([]uint64, error) {
+	if len(raw) < 8 {
+		return nil, fmt.Errorf("%w: truncated EWAH bitmap", ErrMalformedBitmap)
+	}
+	numBits := int(binary.BigEndian.Uint32(raw))
+	numWords := int(binary.BigEndian.Uint32(raw[4:]))
+	if (numBits+63)/64 > (maxBits+63)/64 {
+		return nil, fmt.Errorf("%w: EWAH bitmap of %d bits for %d objects", ErrMalformedBitmap, numBits, maxBits)
+	}
+	if numWords > (len(raw)-8)/8 {
+		return nil, fmt.Errorf("%w: truncated EWAH bitmap", ErrMalformedBitmap)
+	}
+	words := raw[8 : 8+8*numWords]
+	out := make([]uint64, 0, (numBits+63)/64)
+	for i := 0; i < numWords; {
+		rlw := binary.BigEndian.Uint64(words[8*i:])
+		i++
+		runBit := rlw & 1
+		runLen := int((rlw >> 1) & (1<<ewahRunLengthBits - 1))
+		literals := int(rlw >> (1 + ewahRunLengthBits))
+		if i+literals > numWords || len(out)+runLen+literals > (numBits+63)/64+1 {
+			return nil, fmt.Errorf("%w: EWAH bitmap overruns its size", ErrMalformedBitmap)
+		}
+		var fill uint64
+		if runBit == 1 {
+			fill = ^uint64(0)
+		}
+		for j := 0; j < runLen; j++ {
+			out = append(out, fill)
+		}
+		for j := 0; j < literals; j++ {
+			out = append(out, binary.BigEndian.Uint64(words[8*(i+j):]))
+		}
+		i += literals
+	}
+	return out, nil
+}
+
+// bitmap is an uncompressed bitmap, with bit i in word i/64.
+type bitmap []uint64
+
+func (b bitmap) get(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitmap) set(i int) {
+	for i/64 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+func (b *bitmap) or(o bitmap) {
+	for len(*b) < len(o) {
+		*b = append(*b, 0)
+	}
+	for i, w := range o {
+		(*b)[i] |= w
+	}
+}
+
+func (b *bitmap) xor(o bitmap) {
+	for len(*b) < len(o) {
+		*b = append(*b, 0)
+	}
+	for i, w := range o {
+		(*b)[i] ^= w
+	}
+}
+
+// countAnd returns the number of bits set in both b and o.
+func (b bitmap) countAnd(o bitmap) int {
+	var n int
+	for i := 0; i < len(b) && i < len(o); i++ {
+		n += bits.OnesCount64(b[i] & o[i])
+	}
+	return n
+}
+
+// forEach calls fn with the position of each set bit.
+func (b bitmap) forEach(fn func(int) error) error {
+	for i, w := range b {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if err := fn(64*i + t); err != nil {
+				return err
+			}
+			w &= w - 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// ewah serializes an EWAH bitmap with the given header sizes and words.
+func ewah(numBits, numWords uint32, words ...uint64) []byte {
+	b := binary.BigEndian.AppendUint32(nil, numBits)
+	b = binary.BigEndian.AppendUint32(b, numWords)
+	for _, w := range words {
+		b = binary.BigEndian.AppendUint64(b, w)
+	}
+	return binary.BigEndian.AppendUint32(b, 0)
+}
+
+// rlw returns a run length word.
+func rlw(runBit uint64, runLen, literals uint64) uint64 {
+	return runBit | runLen<<1 | literals<<(1+ewahRunLengthBits)
+}
+
+func TestDecodeEWAH(t *testing.T) {
+	// git rounds the number of bits up to whole words, so there may be more bits than objects.
+	raw := ewah(192, 3, rlw(1, 2, 1), 0x5, rlw(0, 0, 0))
+	got, err := decodeEWAH(raw, 130)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{^uint64(0), ^uint64(0), 0x5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeEWAH() = %x, want %x", got, want)
+	}
+}
+
+func TestDecodeEWAHMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		maxBits int
+	}{
+		{"truncated header", []byte{0, 0, 0}, 10},
+		// The bit count was used to size the output before anything else was checked.
+		{"more bits than objects", ewah(0xffffffff, 1, rlw(0, 0, 0)), 100},
+		{"more words than objects", ewah(129, 1, rlw(0, 0, 0)), 128},
+		{"more words than data", ewah(64, 0xffffffff, rlw(0, 0, 0)), 64},
+		{"literals past the words", ewah(128, 1, rlw(0, 0, 1)), 128},
+		{"run past the bits", ewah(64, 1, rlw(1, 1<<31, 0)), 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeEWAH(tt.raw, tt.maxBits); !errors.Is(err, ErrMalformedBitmap) {
+				t.Errorf("decodeEWAH() error = %v, want %v", err, ErrMalformedBitmap)
+			}
+		})
+	}
+}
+
+func TestParseBitmapIndexSizes(t *testing.T) {
+	checksum := bytes.Repeat([]byte{1}, SHA1Size)
+	header := func(numEntries uint32) []byte {
+		b := append([]byte("BITM"), 0, 1, 0, bitmapOptFullDAG)
+		b = binary.BigEndian.AppendUint32(b, numEntries)
+		return append(b, checksum...)
+	}
+	empty := ewah(0, 0)
+	types := bytes.Repeat(empty, 4)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"type bitmap larger than the pack", append(append(header(0), ewah(0xffffffff, 0)...), bytes.Repeat(empty, 3)...)},
+		{"more entries than objects", append(header(0xffffffff), types...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseBitmapIndex(tt.data, checksum, 10); !errors.Is(err, ErrMalformedBitmap) {
+				t.Errorf("parseBitmapIndex() error = %v, want %v", err, ErrMalformedBitmap)
+			}
+		})
+	}
+	if _, err := parseBitmapIndex(append(header(0), types...), checksum, 10); err != nil {
+		t.Errorf("parseBitmapIndex() error = %v for a valid bitmap", err)
+	}
+}
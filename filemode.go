@@ -0,0 +1,114 @@
+package gitwood
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// FileMode is the mode of a tree entry, which says what kind of object the entry refers to.
+// git only writes the modes below, but older versions of git and other tools have written others.
+// The predicates look at the type bits only, like git does when reading trees.
+type FileMode uint32
+
+const (
+	ModeDir        FileMode = 0o40000
+	ModeFile       FileMode = 0o100644
+	ModeExecutable FileMode = 0o100755
+	ModeSymlink    FileMode = 0o120000
+	// ModeSubmodule is the mode of gitlinks, which refer to a commit in a submodule.
+	ModeSubmodule FileMode = 0o160000
+	// ModeGroupWritable is the mode of regular files in trees written by early versions of git.
+	// git still accepts it, but git fsck --strict reports it.
+	ModeGroupWritable FileMode = 0o100664
+)
+
+// modeTypeMask masks the type bits of a mode, like S_IFMT.
+const modeTypeMask = 0o170000
+
+// ParseFileMode parses the octal mode of a tree entry.
+func ParseFileMode(s string) (FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrBadTreeMode, s)
+	}
+	return FileMode(m), nil
+}
+
+// String returns the mode in octal, as it's written in trees.
+func (m FileMode) String() string {
+	return strconv.FormatUint(uint64(m), 8)
+}
+
+// IsDir reports whether the entry is a tree.
+func (m FileMode) IsDir() bool {
+	return m&modeTypeMask == ModeDir
+}
+
+// IsRegular reports whether the entry is a regular file, executable or not.
+func (m FileMode) IsRegular() bool {
+	return m&modeTypeMask == 0o100000
+}
+
+// IsExecutable reports whether the entry is an executable regular file.
+func (m FileMode) IsExecutable() bool {
+	return m.IsRegular() && m&0o100 != 0
+}
+
+// IsSymlink reports whether the entry is a symbolic link, whose target is the content of the blob.
+func (m FileMode) IsSymlink() bool {
+	return m&modeTypeMask == ModeSymlink
+}
+
+// IsSubmodule reports whether the entry is a gitlink, which refers to a commit in a submodule rather than an object in the repo.
+func (m FileMode) IsSubmodule() bool {
+	return m&modeTypeMask == ModeSubmodule
+}
+
+// IsCanonical reports whether the mode is one of the modes git writes.
+func (m FileMode) IsCanonical() bool {
+	switch m {
+	case ModeDir, ModeFile, ModeExecutable, ModeSymlink, ModeSubmodule:
+		return true
+	}
+	return false
+}
+
+// IsValid reports whether git fsck accepts the mode, which is the canonical modes and ModeGroupWritable.
+func (m FileMode) IsValid() bool {
+	return m.IsCanonical() || m == ModeGroupWritable
+}
+
+// Canonical returns the mode git would write for an entry with the mode, like canon_mode in git.
+// Regular files are executable if the owner may execute them, and modes with unknown types are gitlinks.
+func (m FileMode) Canonical() FileMode {
+	switch {
+	case m.IsDir():
+		return ModeDir
+	case m.IsExecutable():
+		return ModeExecutable
+	case m.IsRegular():
+		return ModeFile
+	case m.IsSymlink():
+		return ModeSymlink
+	}
+	return ModeSubmodule
+}
+
+// OSFileMode returns the mode a checkout of the entry would have.
+// Submodules are directories, like the empty directory git creates for a submodule that isn't checked out.
+// Modes with unknown types return an error.
+func (m FileMode) OSFileMode() (os.FileMode, error) {
+	switch {
+	case m.IsDir(), m.IsSubmodule():
+		return fs.ModeDir | 0o755, nil
+	case m.IsExecutable():
+		return 0o755, nil
+	case m.IsRegular():
+		return 0o644, nil
+	case m.IsSymlink():
+		return fs.ModeSymlink | 0o777, nil
+	}
+	return 0, fmt.Errorf("%w: %v has no file type", ErrBadTreeMode, m)
+}
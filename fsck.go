@@ -0,0 +1,514 @@
+package gitwood
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FsckSeverity is how serious a problem found by Fsck is.
+type FsckSeverity int
+
+const (
+	FsckInfo FsckSeverity = iota
+	FsckWarning
+	FsckError
+)
+
+func (s FsckSeverity) String() string {
+	switch s {
+	case FsckInfo:
+		return "info"
+	case FsckWarning:
+		return "warning"
+	case FsckError:
+		return "error"
+	default:
+		return "INVALID"
+	}
+}
+
+// FsckProblem is a problem found by Fsck.
+type FsckProblem struct {
+	Severity FsckSeverity
+	// ID is the kind of problem. Problems in the content of objects have the message IDs of git fsck,
+	// like "treeNotSorted" or "missingAuthor". The other IDs are "badObject" for objects that can't be read
+	// or don't match their ID, "badRefContent" for refs that don't contain an object ID, "brokenLink" for
+	// references to missing objects, and "danglingObject" and "unreachableObject".
+	ID string
+	// ShaSum and Type are the object the problem is in, if any.
+	ShaSum  Hash
+	Type    ObjectType
+	Message string
+}
+
+func (p FsckProblem) String() string {
+	if p.ShaSum.IsZero() {
+		return fmt.Sprintf("%v: %v: %v", p.Severity, p.ID, p.Message)
+	}
+	return fmt.Sprintf("%v in %v %v: %v: %v", p.Severity, p.Type, p.ShaSum, p.ID, p.Message)
+}
+
+// FsckOptions control which problems Fsck reports.
+type FsckOptions struct {
+	// Unreachable reports every object that can't be reached from HEAD, a ref or a reflog, like `git fsck --unreachable`.
+	// By default only dangling objects are reported, which are unreachable objects that no other unreachable object refers to.
+	Unreachable bool
+	// Strict reports tree entries with mode 100664, which old versions of git wrote for group writable files,
+	// like `git fsck --strict`.
+	Strict bool
+}
+
+// Fsck checks the objects, refs and connectivity of the repo, like `git fsck`.
+// Every loose and packed object in the objects directory is read and checked against its ID,
+// and commits, trees and tags are checked for malformed content.
+// Then all objects reachable from HEAD, refs and reflogs, including those in alternates, must exist.
+// The index isn't read, so objects that are only referenced by it are reported as dangling.
+// Problems in the repo are returned in the order they're found, with the objects checked in ID order.
+// The error is only for failures to run the check, like directories that can't be read.
+func (r Repo) Fsck(opts FsckOptions) ([]FsckProblem, error) {
+	c := &fsck{
+		repo:     r,
+		opts:     opts,
+		hashSize: r.hashSize(),
+		types:    map[Hash]ObjectType{},
+		links:    map[Hash][]fsckLink{},
+		bad:      map[Hash]bool{},
+	}
+	// Objects must be read from disk to be checked.
+	c.repo.Verify = true
+	c.repo.Cache = nil
+	ids, err := r.localObjectIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		c.checkObject(id, true)
+	}
+	roots, err := c.roots()
+	if err != nil {
+		return nil, err
+	}
+	c.checkConnectivity(ids, roots)
+	return c.problems, nil
+}
+
+// localObjectIDs returns the IDs of all loose and packed objects in the repo's objects directory,
+// leaving out alternates, in sorted order.
+func (r Repo) localObjectIDs() ([]Hash, error) {
+	dirs, done := r.objectDirs()
+	defer done()
+	seen := map[Hash]bool{}
+	err := forEachLooseID(r.storage(), dirs[0].path, r.hashSize(), func(id Hash) error {
+		seen[id] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dirs[0].packs.forEachPacked(func(_ *Pack, id Hash, _ uint64) error {
+		seen[id] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]Hash, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+	return ids, nil
+}
+
+// fsckLink is a reference from one object to another, of the type the referring object says it has.
+type fsckLink struct {
+	sum   Hash
+	otype ObjectType
+}
+
+type fsck struct {
+	repo     Repo
+	opts     FsckOptions
+	hashSize int
+	problems []FsckProblem
+	// types are the types of the objects that have been checked, and links the objects they refer to.
+	types map[Hash]ObjectType
+	links map[Hash][]fsckLink
+	// bad are the objects that couldn't be read, which have already been reported.
+	bad map[Hash]bool
+}
+
+func (c *fsck) report(severity FsckSeverity, id string, sum Hash, otype ObjectType, format string, args ...any) {
+	c.problems = append(c.problems, FsckProblem{
+		Severity: severity,
+		ID:       id,
+		ShaSum:   sum,
+		Type:     otype,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkObject reads and checks the object, and records its type and links.
+// Returns false if the object doesn't exist. Objects that were found in the objects directory
+// are listed, and are bad rather than missing if they can't be read, like a delta whose base is missing.
+func (c *fsck) checkObject(sum Hash, listed bool) bool {
+	// Object would read HEAD for the zero Hash.
+	otype, o, err := c.repo.openObject(sum)
+	if errors.Is(err, ErrObjectNotFound) && !listed {
+		return false
+	}
+	c.types[sum] = otype
+	if err != nil {
+		c.bad[sum] = true
+		c.report(FsckError, "badObject", sum, otype, "%v", err)
+		return true
+	}
+	switch otype {
+	case OBJ_COMMIT:
+		c.checkCommit(sum, o)
+	case OBJ_TREE:
+		c.checkTree(sum, o)
+	case OBJ_TAG:
+		c.checkTag(sum, o)
+	}
+	return true
+}
+
+// checkTree checks that the entries of a tree are well-formed and sorted, reporting each kind of problem once per tree.
+func (c *fsck) checkTree(sum Hash, tree []byte) {
+	found := map[string]bool{}
+	problem := func(severity FsckSeverity, id, msg string) {
+		if !found[id] {
+			found[id] = true
+			c.report(severity, id, sum, OBJ_TREE, "%s", msg)
+		}
+	}
+	var links []fsckLink
+	var prevName string
+	var prevDir bool
+	for first := true; len(tree) > 0; first = false {
+		sp := bytes.IndexByte(tree, ' ')
+		nul := bytes.IndexByte(tree, 0)
+		if sp <= 0 || nul < sp || nul+1+c.hashSize > len(tree) {
+			problem(FsckError, "badTree", "cannot be parsed as a tree")
+			break
+		}
+		mode, err := ParseFileMode(string(tree[:sp]))
+		if err != nil {
+			problem(FsckError, "badTree", "cannot be parsed as a tree")
+			break
+		}
+		name := string(tree[sp+1 : nul])
+		entry := hashFromBytes(tree[nul+1 : nul+1+c.hashSize])
+		if tree[0] == '0' {
+			problem(FsckWarning, "zeroPaddedFilemode", "contains zero-padded file modes")
+		}
+		tree = tree[nul+1+c.hashSize:]
+		if !mode.IsValid() || !mode.IsCanonical() && c.opts.Strict {
+			problem(FsckWarning, "badFilemode", "contains bad file modes")
+		}
+		switch {
+		case strings.Contains(name, "/"):
+			problem(FsckWarning, "fullPathname", "contains full pathnames")
+		case name == "":
+			problem(FsckWarning, "emptyName", "contains empty pathname")
+		case name == ".":
+			problem(FsckWarning, "hasDot", "contains '.'")
+		case name == "..":
+			problem(FsckWarning, "hasDotdot", "contains '..'")
+		case strings.EqualFold(name, ".git"):
+			problem(FsckWarning, "hasDotgit", "contains '.git'")
+		}
+		if entry.isNull() {
+			problem(FsckWarning, "nullSha1", "contains entries pointing to null sha1")
+		}
+		isDir := mode == ModeDir
+		if !first {
+			// git sorts trees as if their names end with a slash.
+			if name == prevName {
+				problem(FsckError, "duplicateEntries", "contains duplicate file entries")
+			} else if treeSortKey(prevName, prevDir) > treeSortKey(name, isDir) {
+				problem(FsckError, "treeNotSorted", "not properly sorted")
+			}
+		}
+		prevName, prevDir = name, isDir
+		switch {
+		case isDir:
+			links = append(links, fsckLink{entry, OBJ_TREE})
+		case mode == ModeSubmodule:
+			// Submodule commits aren't part of the repo.
+		default:
+			links = append(links, fsckLink{entry, OBJ_BLOB})
+		}
+	}
+	c.links[sum] = links
+}
+
+func treeSortKey(name string, isDir bool) string {
+	if isDir {
+		return name + "/"
+	}
+	return name
+}
+
+// headerLines returns the header lines of a commit or tag, and checks that the header is terminated by an empty line.
+func (c *fsck) headerLines(sum Hash, otype ObjectType, data []byte) []string {
+	end := bytes.Index(data, []byte("\n\n"))
+	if end < 0 {
+		// An object without a message may end right after the header.
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			c.report(FsckError, "unterminatedHeader", sum, otype, "unterminated header")
+			return nil
+		}
+		end = len(data) - 1
+	}
+	if i := bytes.IndexByte(data[:end], 0); i >= 0 {
+		c.report(FsckError, "nulInHeader", sum, otype, "unterminated header: NUL at offset %d", i)
+		return nil
+	}
+	return strings.Split(string(data[:end]), "\n")
+}
+
+// checkCommit checks the tree, parent, author and committer lines, which must come first and in that order.
+func (c *fsck) checkCommit(sum Hash, commit []byte) {
+	lines := c.headerLines(sum, OBJ_COMMIT, commit)
+	if lines == nil {
+		return
+	}
+	var links []fsckLink
+	defer func() { c.links[sum] = links }()
+	tree, ok := strings.CutPrefix(lines[0], "tree ")
+	if !ok {
+		c.report(FsckError, "missingTree", sum, OBJ_COMMIT, "invalid format - expected 'tree' line")
+		return
+	}
+	treeSum, err := ParseHash(tree)
+	if err != nil || treeSum.Size() != c.hashSize {
+		c.report(FsckError, "badTreeSha1", sum, OBJ_COMMIT, "invalid 'tree' line format - bad sha1")
+		return
+	}
+	links = append(links, fsckLink{treeSum, OBJ_TREE})
+	lines = lines[1:]
+	for len(lines) > 0 {
+		parent, ok := strings.CutPrefix(lines[0], "parent ")
+		if !ok {
+			break
+		}
+		parentSum, err := ParseHash(parent)
+		if err != nil || parentSum.Size() != c.hashSize {
+			c.report(FsckError, "badParentSha1", sum, OBJ_COMMIT, "invalid 'parent' line format - bad sha1")
+			return
+		}
+		links = append(links, fsckLink{parentSum, OBJ_COMMIT})
+		lines = lines[1:]
+	}
+	var authors int
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "author ") {
+		if id, msg := checkIdent(strings.TrimPrefix(lines[0], "author ")); id != "" {
+			c.report(FsckError, id, sum, OBJ_COMMIT, "%s", msg)
+			return
+		}
+		authors++
+		lines = lines[1:]
+	}
+	switch {
+	case authors == 0:
+		c.report(FsckError, "missingAuthor", sum, OBJ_COMMIT, "invalid format - expected 'author' line")
+		return
+	case authors > 1:
+		c.report(FsckError, "multipleAuthors", sum, OBJ_COMMIT, "invalid format - multiple 'author' lines")
+		return
+	}
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "committer ") {
+		c.report(FsckError, "missingCommitter", sum, OBJ_COMMIT, "invalid format - expected 'committer' line")
+		return
+	}
+	if id, msg := checkIdent(strings.TrimPrefix(lines[0], "committer ")); id != "" {
+		c.report(FsckError, id, sum, OBJ_COMMIT, "%s", msg)
+	}
+}
+
+// checkTag checks the object, type, tag and tagger lines of a tag.
+func (c *fsck) checkTag(sum Hash, tag []byte) {
+	lines := c.headerLines(sum, OBJ_TAG, tag)
+	if lines == nil {
+		return
+	}
+	object, ok := strings.CutPrefix(lines[0], "object ")
+	if !ok {
+		c.report(FsckError, "missingObject", sum, OBJ_TAG, "invalid format - expected 'object' line")
+		return
+	}
+	objectSum, err := ParseHash(object)
+	if err != nil || objectSum.Size() != c.hashSize {
+		c.report(FsckError, "badObjectSha1", sum, OBJ_TAG, "invalid 'object' line format - bad sha1")
+		return
+	}
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "type ") {
+		c.report(FsckError, "missingTypeEntry", sum, OBJ_TAG, "invalid format - expected 'type' line")
+		return
+	}
+	otype := ObjectTypeFromString(strings.TrimPrefix(lines[1], "type "))
+	if otype == OBJ_INVALID {
+		c.report(FsckError, "badType", sum, OBJ_TAG, "invalid 'type' value")
+		return
+	}
+	c.links[sum] = []fsckLink{{objectSum, otype}}
+	if len(lines) < 3 || !strings.HasPrefix(lines[2], "tag ") {
+		c.report(FsckError, "missingTagEntry", sum, OBJ_TAG, "invalid format - expected 'tag' line")
+		return
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[3], "tagger ") {
+		// Very old tags have no tagger.
+		c.report(FsckInfo, "missingTaggerEntry", sum, OBJ_TAG, "invalid format - expected 'tagger' line")
+		return
+	}
+	if id, msg := checkIdent(strings.TrimPrefix(lines[3], "tagger ")); id != "" {
+		c.report(FsckError, id, sum, OBJ_TAG, "%s", msg)
+	}
+}
+
+// checkIdent checks an author, committer or tagger, i.e. "Name <email> 1600000000 +0100",
+// and returns the message ID and message of the first problem, if any.
+func checkIdent(ident string) (string, string) {
+	const prefix = "invalid author/committer line - "
+	if strings.HasPrefix(ident, "<") {
+		return "missingNameBeforeEmail", prefix + "missing space before email"
+	}
+	i := strings.IndexAny(ident, "<>")
+	switch {
+	case i >= 0 && ident[i] == '>':
+		return "badName", prefix + "bad name"
+	case i < 0:
+		return "missingEmail", prefix + "missing email"
+	case ident[i-1] != ' ':
+		return "missingSpaceBeforeEmail", prefix + "missing space before email"
+	}
+	rest := ident[i+1:]
+	i = strings.IndexAny(rest, "<>")
+	if i < 0 || rest[i] != '>' {
+		return "badEmail", prefix + "bad email"
+	}
+	rest, ok := strings.CutPrefix(rest[i+1:], " ")
+	if !ok {
+		return "missingSpaceBeforeDate", prefix + "missing space before date"
+	}
+	date, zone, _ := strings.Cut(rest, " ")
+	if len(date) > 1 && date[0] == '0' {
+		return "zeroPaddedDate", prefix + "zero-padded date"
+	}
+	if date == "" || strings.Trim(date, "0123456789") != "" || !strings.HasPrefix(rest, date+" ") {
+		return "badDate", prefix + "bad date"
+	}
+	if _, err := strconv.ParseInt(date, 10, 64); err != nil {
+		return "badDateOverflow", prefix + "date causes integer overflow"
+	}
+	if len(zone) != 5 || (zone[0] != '+' && zone[0] != '-') || strings.Trim(zone[1:], "0123456789") != "" {
+		return "badTimezone", prefix + "bad time zone"
+	}
+	return "", ""
+}
+
+// fsckRoot is an object the connectivity check starts from, and where it was found.
+type fsckRoot struct {
+	sum  Hash
+	from string
+}
+
+// roots returns HEAD, the refs and the objects in reflogs, and reports refs that can't be parsed.
+func (c *fsck) roots() ([]fsckRoot, error) {
+	var roots []fsckRoot
+	if head := c.repo.HeadCommit(); !head.IsZero() {
+		roots = append(roots, fsckRoot{head, "HEAD"})
+	}
+	refs, err := c.repo.readRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read refs: %w", err)
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if refs[name].Size() != c.hashSize {
+			c.report(FsckError, "badRefContent", Hash{}, OBJ_INVALID, "%v: invalid content", name)
+			continue
+		}
+		roots = append(roots, fsckRoot{refs[name], name})
+	}
+	logged, err := c.repo.readReflogs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reflogs: %w", err)
+	}
+	var fromLogs []fsckRoot
+	for sum, name := range logged {
+		fromLogs = append(fromLogs, fsckRoot{sum, "reflog of " + name})
+	}
+	sort.Slice(fromLogs, func(i, j int) bool {
+		return fromLogs[i].sum.Compare(fromLogs[j].sum) < 0
+	})
+	return append(roots, fromLogs...), nil
+}
+
+// checkConnectivity walks the objects reachable from the roots, reporting missing ones,
+// and then reports the local objects that weren't reached.
+func (c *fsck) checkConnectivity(ids []Hash, roots []fsckRoot) {
+	reachable := map[Hash]bool{}
+	type edge struct {
+		from string
+		fsckLink
+	}
+	var stack []edge
+	for i := len(roots) - 1; i >= 0; i-- {
+		stack = append(stack, edge{roots[i].from, fsckLink{roots[i].sum, OBJ_INVALID}})
+	}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[e.sum] {
+			continue
+		}
+		reachable[e.sum] = true
+		// Objects in alternates haven't been checked yet.
+		// Like git, the null ID is reported as a missing object.
+		if _, ok := c.types[e.sum]; !ok && (e.sum.isNull() || !c.checkObject(e.sum, false)) {
+			to := "object"
+			if e.otype != OBJ_INVALID {
+				to = e.otype.String()
+			}
+			c.report(FsckError, "brokenLink", Hash{}, OBJ_INVALID, "broken link from %v to %v %v", e.from, to, e.sum)
+			continue
+		}
+		from := fmt.Sprintf("%v %v", c.types[e.sum], e.sum)
+		links := c.links[e.sum]
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, edge{from, links[i]})
+		}
+	}
+	// Unreachable objects that other unreachable objects refer to aren't dangling.
+	referenced := map[Hash]bool{}
+	for _, id := range ids {
+		if !reachable[id] {
+			for _, l := range c.links[id] {
+				referenced[l.sum] = true
+			}
+		}
+	}
+	for _, id := range ids {
+		switch {
+		case reachable[id], c.bad[id]:
+			// Objects that can't be read have been reported, and their links are unknown.
+		case c.opts.Unreachable:
+			c.report(FsckInfo, "unreachableObject", id, c.types[id], "unreachable %v", c.types[id])
+		case !referenced[id]:
+			c.report(FsckInfo, "danglingObject", id, c.types[id], "dangling %v", c.types[id])
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package gitwood_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// fsckProblem is the part of a gitwood.FsckProblem the tests check.
+// Message is only checked to contain msg, which is how broken links name the missing object.
+type fsckProblem struct {
+	id  string
+	sum gitwood.Hash
+	msg string
+}
+
+func (p fsckProblem) String() string {
+	return fmt.Sprintf("%v in %v: %q", p.id, p.sum, p.msg)
+}
+
+// checkProblems checks that got has the wanted problems, in any order.
+func checkProblems(t *testing.T, got []gitwood.FsckProblem, want []fsckProblem) {
+	t.Helper()
+	key := func(id string, sum gitwood.Hash) string {
+		return id + " " + sum.String()
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return key(got[i].ID, got[i].ShaSum) < key(got[j].ID, got[j].ShaSum)
+	})
+	sort.Slice(want, func(i, j int) bool {
+		return key(want[i].id, want[i].sum) < key(want[j].id, want[j].sum)
+	})
+	ok := len(got) == len(want)
+	for i := 0; ok && i < len(got); i++ {
+		ok = got[i].ID == want[i].id && got[i].ShaSum == want[i].sum && strings.Contains(got[i].Message, want[i].msg)
+	}
+	if !ok {
+		t.Errorf("Fsck() = %v, want %v", got, want)
+	}
+}
+
+// rawTree returns the content of a tree with the given entries, in the given order.
+func rawTree(entries ...gitwoodtest.Entry) []byte {
+	var data []byte
+	for _, e := range entries {
+		data = append(data, e.Mode.String()+" "+e.Name+"\x00"...)
+		data = append(data, e.ShaSum.Bytes()...)
+	}
+	return data
+}
+
+func TestFsck(t *testing.T) {
+	null := gitwood.MustParseHash(strings.Repeat("0", 2*gitwood.SHA1Size))
+	missing := gitwood.MustParseHash("0123456789abcdef0123456789abcdef01234567")
+	readme := func(b *gitwoodtest.Builder) gitwood.Hash {
+		return b.TreeFromFiles(map[string]string{"README": "hello\n"})
+	}
+	tests := []struct {
+		name string
+		opts gitwood.FsckOptions
+		// build adds objects to a builder, and returns the tree of the HEAD commit and the problems Fsck should find.
+		build func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem)
+	}{
+		{"clean", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			return readme(b), nil
+		}},
+		{"malformed tree", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			blob := b.Blob("hello\n")
+			tree := b.Object(gitwood.OBJ_TREE, rawTree(
+				gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "b", ShaSum: blob},
+				gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "a", ShaSum: blob},
+			))
+			return tree, []fsckProblem{{id: "treeNotSorted", sum: tree}}
+		}},
+		{"missing link", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			tree := b.Tree(gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "gone", ShaSum: missing})
+			return tree, []fsckProblem{{id: "brokenLink", msg: "to blob " + missing.String()}}
+		}},
+		{"dangling", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			commit := b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(map[string]string{"lost": "lost\n"}), Message: "lost\n"})
+			// Only the commit is dangling, as it refers to the other unreachable objects.
+			return readme(b), []fsckProblem{{id: "danglingObject", sum: commit}}
+		}},
+		{"unreachable", gitwood.FsckOptions{Unreachable: true}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			blob := b.Blob("lost\n")
+			tree := b.TreeFromFiles(map[string]string{"lost": "lost\n"})
+			commit := b.Commit(gitwoodtest.Commit{Tree: tree, Message: "lost\n"})
+			return readme(b), []fsckProblem{
+				{id: "unreachableObject", sum: blob},
+				{id: "unreachableObject", sum: tree},
+				{id: "unreachableObject", sum: commit},
+			}
+		}},
+		{"bad ident", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			root := readme(b)
+			commit := b.Object(gitwood.OBJ_COMMIT, []byte(fmt.Sprintf("tree %v\n"+
+				"author A U Thor author@example.com 1600000000 +0000\n"+
+				"committer C O Mitter <committer@example.com> 1600000000 +0000\n\nbad author\n", root)))
+			b.Ref("refs/heads/bad", commit)
+			return root, []fsckProblem{{id: "missingEmail", sum: commit}}
+		}},
+		{"null tree entry", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			tree := b.Tree(gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "null", ShaSum: null})
+			return tree, []fsckProblem{
+				{id: "nullSha1", sum: tree},
+				{id: "brokenLink", msg: "to blob " + null.String()},
+			}
+		}},
+		{"null parent", gitwood.FsckOptions{}, func(b *gitwoodtest.Builder) (gitwood.Hash, []fsckProblem) {
+			root := readme(b)
+			commit := b.Commit(gitwoodtest.Commit{Tree: root, Parents: []gitwood.Hash{null}, Message: "orphan\n"})
+			b.Ref("refs/heads/orphan", commit)
+			return root, []fsckProblem{{id: "brokenLink", msg: "to commit " + null.String()}}
+		}},
+	}
+	for _, tt := range tests {
+		for name, opts := range map[string]gitwoodtest.Options{"loose": {}, "pack": {Pack: true}} {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				b := gitwoodtest.New()
+				tree, want := tt.build(b)
+				b.Ref("refs/heads/main", b.Commit(gitwoodtest.Commit{Tree: tree, Message: "head\n"}))
+				problems, err := b.Repo(t, opts).Fsck(tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkProblems(t, problems, want)
+			})
+		}
+	}
+}
+
+// TestFsckCorruptPack checks that an object in a pack that can't be read is reported as bad, and not as dangling.
+func TestFsckCorruptPack(t *testing.T) {
+	b := gitwoodtest.New()
+	text := strings.Repeat("a line of text\n", 20)
+	b.Ref("refs/heads/main", b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(map[string]string{"text": text}), Message: "head\n"}))
+	base := b.Blob(text)
+	// The unreachable blob is a ref-delta against the reachable one.
+	lost := b.Blob(text + "lost\n")
+	dir := t.TempDir()
+	if err := b.Write(dir, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.RefDeltas}); err != nil {
+		t.Fatal(err)
+	}
+	s := gitwood.NewPackStore(filepath.Join(dir, "objects/pack"))
+	p, off, err := s.Find(lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := p.PackEntryAt(off); err != nil || e.Type != gitwood.OBJ_REF_DELTA {
+		t.Fatalf("PackEntryAt(%d) = %+v, %v, want a ref-delta", off, e, err)
+	}
+	name := filepath.Join(dir, "objects/pack", p.Name+".pack")
+	s.Close()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Point the delta at a base that doesn't exist.
+	i := bytes.Index(data[off:], base.Bytes())
+	if i < 0 {
+		t.Fatal("no delta base in the pack entry")
+	}
+	data[int(off)+i] ^= 0xff
+	if err = os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := gitwood.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	problems, err := repo.Fsck(gitwood.FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, []fsckProblem{{id: "badObject", sum: lost}})
+}
@@ -0,0 +1,237 @@
+// Package gitwoodtest builds git repositories programmatically, for testing code that reads them.
+//
+// A Builder collects blobs, trees, commits, tags and refs in memory,
+// and writes them out as loose objects or as a pack, with or without deltas:
+//
+//	b := gitwoodtest.New()
+//	tree := b.TreeFromFiles(map[string]string{"README": "hello\n", "src/main.go": "package main\n"})
+//	commit := b.Commit(gitwoodtest.Commit{Tree: tree, Message: "Initial commit\n"})
+//	b.Ref("refs/heads/main", commit)
+//	repo := b.Repo(t, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas})
+//
+// The git binary is not needed, so the repos can be built anywhere the tests run.
+package gitwoodtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/haflan/gitwood"
+)
+
+// Entry is an entry in a tree.
+type Entry struct {
+	Mode   gitwood.FileMode
+	Name   string
+	ShaSum gitwood.Hash
+}
+
+// Signature is the author or committer of a commit, or the tagger of a tag.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// String returns the signature as it's written in commit and tag objects.
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+// Commit describes a commit object.
+// Signatures that are left empty get a default name and email, and a time one minute after the previous default.
+type Commit struct {
+	Tree      gitwood.Hash
+	Parents   []gitwood.Hash
+	Author    Signature
+	Committer Signature
+	Message   string
+}
+
+// Tag describes an annotated tag object.
+// The type of the tagged object is looked up in the builder, so it must have been added first.
+type Tag struct {
+	Object  gitwood.Hash
+	Name    string
+	Tagger  Signature
+	Message string
+}
+
+type object struct {
+	otype gitwood.ObjectType
+	data  []byte
+}
+
+// Builder builds a repository in memory.
+// Adding the same object twice is harmless, it's only stored once.
+type Builder struct {
+	objects map[gitwood.Hash]object
+	// order is the order the objects were added in, which is also their order in packs.
+	order  []gitwood.Hash
+	refs   map[string]gitwood.Hash
+	head   string
+	clock  time.Time
+	format gitwood.ObjectFormat
+}
+
+// New returns an empty Builder for a SHA-1 repository, with HEAD pointing to refs/heads/main.
+func New() *Builder {
+	return NewFormat(gitwood.SHA1)
+}
+
+// NewFormat is like New, but for a repository with the given object format.
+func NewFormat(format gitwood.ObjectFormat) *Builder {
+	return &Builder{
+		objects: map[gitwood.Hash]object{},
+		refs:    map[string]gitwood.Hash{},
+		head:    "ref: refs/heads/main",
+		clock:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		format:  format,
+	}
+}
+
+// Object adds an object with the given type and content, and returns its shasum.
+func (b *Builder) Object(otype gitwood.ObjectType, data []byte) gitwood.Hash {
+	h := b.format.New()
+	fmt.Fprintf(h, "%s %d\x00", otype, len(data))
+	h.Write(data)
+	shasum, _ := gitwood.HashFromBytes(h.Sum(nil))
+	if _, ok := b.objects[shasum]; !ok {
+		b.objects[shasum] = object{otype, append([]byte(nil), data...)}
+		b.order = append(b.order, shasum)
+	}
+	return shasum
+}
+
+// Blob adds a blob and returns its shasum.
+func (b *Builder) Blob(data string) gitwood.Hash {
+	return b.Object(gitwood.OBJ_BLOB, []byte(data))
+}
+
+// Tree adds a tree with the given entries and returns its shasum.
+// The entries are sorted the way git sorts them, so they can be given in any order.
+func (b *Builder) Tree(entries ...Entry) gitwood.Hash {
+	entries = append([]Entry(nil), entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return treeSortName(entries[i]) < treeSortName(entries[j])
+	})
+	var data []byte
+	for _, e := range entries {
+		if e.ShaSum.Size() != b.format.Size() {
+			panic(fmt.Sprintf("gitwoodtest: invalid shasum %q for tree entry %q", e.ShaSum, e.Name))
+		}
+		data = append(data, e.Mode.String()+" "+e.Name+"\x00"...)
+		data = append(data, e.ShaSum.Bytes()...)
+	}
+	return b.Object(gitwood.OBJ_TREE, data)
+}
+
+// treeSortName returns the name git sorts a tree entry by, which has a slash appended for trees.
+func treeSortName(e Entry) string {
+	if e.Mode.IsDir() {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// TreeFromFiles adds blobs for the given files, which map slash separated paths to content,
+// along with the trees that contain them, and returns the shasum of the root tree.
+// All files get mode 100644.
+func (b *Builder) TreeFromFiles(files map[string]string) gitwood.Hash {
+	type dir struct {
+		files map[string]string
+		dirs  map[string]*dir
+	}
+	newDir := func() *dir {
+		return &dir{files: map[string]string{}, dirs: map[string]*dir{}}
+	}
+	root := newDir()
+	for name, content := range files {
+		d := root
+		parts := strings.Split(name, "/")
+		for _, p := range parts[:len(parts)-1] {
+			if d.dirs[p] == nil {
+				d.dirs[p] = newDir()
+			}
+			d = d.dirs[p]
+		}
+		d.files[parts[len(parts)-1]] = content
+	}
+	var write func(d *dir) gitwood.Hash
+	write = func(d *dir) gitwood.Hash {
+		var entries []Entry
+		for name, content := range d.files {
+			entries = append(entries, Entry{gitwood.ModeFile, name, b.Blob(content)})
+		}
+		for name, sub := range d.dirs {
+			entries = append(entries, Entry{gitwood.ModeDir, name, write(sub)})
+		}
+		return b.Tree(entries...)
+	}
+	return write(root)
+}
+
+// Commit adds a commit and returns its shasum.
+func (b *Builder) Commit(c Commit) gitwood.Hash {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "tree %s\n", c.Tree)
+	for _, p := range c.Parents {
+		fmt.Fprintf(&sb, "parent %s\n", p)
+	}
+	author := b.signature(c.Author, "A U Thor", "author@example.com")
+	committer := c.Committer
+	if committer == (Signature{}) {
+		committer = Signature{"C O Mitter", "committer@example.com", author.When}
+	}
+	fmt.Fprintf(&sb, "author %s\ncommitter %s\n\n%s", author, committer, c.Message)
+	return b.Object(gitwood.OBJ_COMMIT, []byte(sb.String()))
+}
+
+// Tag adds an annotated tag object and returns its shasum.
+// Use Ref to also add a refs/tags ref for it.
+func (b *Builder) Tag(t Tag) gitwood.Hash {
+	target, ok := b.objects[t.Object]
+	if !ok {
+		panic(fmt.Sprintf("gitwoodtest: tagged object %v has not been added", t.Object))
+	}
+	tagger := b.signature(t.Tagger, "T A Gger", "tagger@example.com")
+	data := fmt.Sprintf("object %s\ntype %s\ntag %s\ntagger %s\n\n%s", t.Object, target.otype, t.Name, tagger, t.Message)
+	return b.Object(gitwood.OBJ_TAG, []byte(data))
+}
+
+// signature fills in an empty signature with the given name and email and the next time on the builder's clock.
+func (b *Builder) signature(s Signature, name, email string) Signature {
+	if s != (Signature{}) {
+		return s
+	}
+	b.clock = b.clock.Add(time.Minute)
+	return Signature{name, email, b.clock}
+}
+
+// Ref sets the ref with the given full name, e.g. refs/heads/main, to the given shasum.
+func (b *Builder) Ref(name string, shasum gitwood.Hash) {
+	b.refs[name] = shasum
+}
+
+// Head sets HEAD to the given ref, e.g. refs/heads/main.
+func (b *Builder) Head(ref string) {
+	b.head = "ref: " + ref
+}
+
+// DetachHead points HEAD directly at the given commit.
+func (b *Builder) DetachHead(shasum gitwood.Hash) {
+	b.head = shasum.String()
+}
+
+// ObjectIDs returns the shasums of all objects, in the order they were added.
+func (b *Builder) ObjectIDs() []gitwood.Hash {
+	return append([]gitwood.Hash(nil), b.order...)
+}
+
+// Content returns the type and content of the object with the given shasum, if it has been added.
+func (b *Builder) Content(shasum gitwood.Hash) (gitwood.ObjectType, []byte, bool) {
+	o, ok := b.objects[shasum]
+	return o.otype, o.data, ok
+}
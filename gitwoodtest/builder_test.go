@@ -0,0 +1,129 @@
+package gitwoodtest_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// history adds a few commits with files that change a little in each, so that packs get delta chains,
+// and a tag. It returns the last commit.
+func history(b *gitwoodtest.Builder) gitwood.Hash {
+	var parent []gitwood.Hash
+	var head gitwood.Hash
+	for i := 0; i < 10; i++ {
+		files := map[string]string{
+			"README":           strings.Repeat("read me\n", 20) + fmt.Sprintf("version %d\n", i),
+			"src/main.go":      "package main\n\n" + strings.Repeat(fmt.Sprintf("// line %d\n", i), i+1),
+			"src/util/util.go": "package util\n",
+		}
+		head = b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(files), Parents: parent, Message: fmt.Sprintf("commit %d\n", i)})
+		parent = []gitwood.Hash{head}
+	}
+	tag := b.Tag(gitwoodtest.Tag{Object: head, Name: "v1", Message: "v1\n"})
+	b.Ref("refs/heads/main", head)
+	b.Ref("refs/tags/v1", tag)
+	return head
+}
+
+var writeOptions = map[string]gitwoodtest.Options{
+	"loose":         {},
+	"pack":          {Pack: true},
+	"ofs-deltas":    {Pack: true, Deltas: gitwoodtest.OfsDeltas},
+	"ref-deltas":    {Pack: true, Deltas: gitwoodtest.RefDeltas},
+	"depth-2":       {Pack: true, Deltas: gitwoodtest.OfsDeltas, MaxDeltaDepth: 2},
+	"idx-v3":        {Pack: true, Deltas: gitwoodtest.OfsDeltas, IndexVersion: 3},
+	"large-offsets": {Pack: true, Deltas: gitwoodtest.RefDeltas, LargeOffsets: true},
+	"idx-v3-large":  {Pack: true, IndexVersion: 3, LargeOffsets: true},
+}
+
+// checkObjects reads every object of the builder from the repo and compares it with what was added.
+func checkObjects(t *testing.T, b *gitwoodtest.Builder, repo *gitwood.Repo) {
+	t.Helper()
+	for _, sum := range b.ObjectIDs() {
+		wantType, want, _ := b.Content(sum)
+		otype, o, err := repo.Object(sum)
+		if err != nil {
+			t.Fatalf("Object(%v): %v", sum, err)
+		}
+		if otype != wantType || !bytes.Equal(o, want) {
+			t.Fatalf("Object(%v) = %v %q, want %v %q", sum, otype, o, wantType, want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []gitwood.ObjectFormat{gitwood.SHA1, gitwood.SHA256} {
+		for name, opts := range writeOptions {
+			t.Run(fmt.Sprintf("%v/%v", format, name), func(t *testing.T) {
+				b := gitwoodtest.NewFormat(format)
+				head := history(b)
+				repo := b.Repo(t, opts)
+				repo.Verify = true
+				if got := repo.ObjectFormat(); got != format {
+					t.Fatalf("ObjectFormat() = %v, want %v", got, format)
+				}
+				checkObjects(t, b, repo)
+				if got := repo.HeadCommit(); got != head {
+					t.Fatalf("HeadCommit() = %v, want %v", got, head)
+				}
+			})
+		}
+	}
+}
+
+func TestRoundTripFS(t *testing.T) {
+	for name, opts := range writeOptions {
+		t.Run(name, func(t *testing.T) {
+			b := gitwoodtest.New()
+			history(b)
+			fsys, err := b.FS(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := gitwood.OpenFS(fsys, ".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.Close()
+			repo.Verify = true
+			checkObjects(t, b, repo)
+		})
+	}
+}
+
+func TestTreeModes(t *testing.T) {
+	b := gitwoodtest.New()
+	blob := b.Blob("x")
+	sub := b.Tree(gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "f", ShaSum: blob})
+	commit := b.Commit(gitwoodtest.Commit{Tree: sub})
+	// Entries are given out of order, and "a" sorts after "a.txt" because trees sort as if they end with a slash.
+	tree := b.Tree(
+		gitwoodtest.Entry{Mode: gitwood.ModeSubmodule, Name: "module", ShaSum: commit},
+		gitwoodtest.Entry{Mode: gitwood.ModeDir, Name: "a", ShaSum: sub},
+		gitwoodtest.Entry{Mode: gitwood.ModeExecutable, Name: "run", ShaSum: blob},
+		gitwoodtest.Entry{Mode: gitwood.ModeSymlink, Name: "link", ShaSum: blob},
+		gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "a.txt", ShaSum: blob},
+	)
+	repo := b.Repo(t, gitwoodtest.Options{})
+	_, o, err := repo.Object(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := repo.ParseTree(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Mode.String()+" "+e.Name())
+	}
+	want := "100644 a.txt,40000 a,120000 link,160000 module,100755 run"
+	if strings.Join(got, ",") != want {
+		t.Errorf("entries = %v, want %v", strings.Join(got, ","), want)
+	}
+}
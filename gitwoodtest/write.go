@@ -0,0 +1,426 @@
+package gitwoodtest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/haflan/gitwood"
+)
+
+// Deltas is how objects are deltified in packs.
+type Deltas int
+
+const (
+	// NoDeltas stores every object whole.
+	NoDeltas Deltas = iota
+	// OfsDeltas stores objects as deltas against an earlier object of the same type, referenced by pack offset.
+	OfsDeltas
+	// RefDeltas stores objects as deltas against an earlier object of the same type, referenced by shasum.
+	RefDeltas
+)
+
+// packHeaderSize is the size of the pack header, which is also the offset of the first object.
+const packHeaderSize = 12
+
+// minDeltaSize is the size of the smallest delta git accepts.
+const minDeltaSize = 4
+
+// defaultMaxDeltaDepth is the maximum length of delta chains if none is given, the same as in git.
+const defaultMaxDeltaDepth = 50
+
+// Options control how a repository is written.
+type Options struct {
+	// Pack writes the objects to a single pack and its idx file, instead of as loose objects.
+	Pack bool
+	// IndexVersion is the version of the idx file, 2 or 3. Zero means 2, which is what git writes.
+	IndexVersion int
+	// Deltas is how objects are deltified in the pack.
+	Deltas Deltas
+	// MaxDeltaDepth is the maximum length of delta chains. Zero means 50.
+	MaxDeltaDepth int
+	// LargeOffsets stores the offsets in the idx file's large offset table, which is otherwise only used for packs over 2 GiB.
+	// The first object in the pack is left out, as git rejects idx files with a large offset for every object.
+	LargeOffsets bool
+}
+
+// Files returns the files of the repository, keyed by slash separated paths relative to the git dir.
+// The repository is bare, with HEAD, config, objects and refs at the top level.
+func (b *Builder) Files(opts Options) (map[string][]byte, error) {
+	config := "[core]\n\trepositoryformatversion = 0\n\tbare = true\n"
+	if b.format != gitwood.SHA1 {
+		// Extensions are only recognized by repository format version 1.
+		config = "[core]\n\trepositoryformatversion = 1\n\tbare = true\n[extensions]\n\tobjectFormat = " + string(b.format) + "\n"
+	}
+	files := map[string][]byte{
+		"HEAD":   []byte(b.head + "\n"),
+		"config": []byte(config),
+	}
+	for name, shasum := range b.refs {
+		files[name] = []byte(shasum.String() + "\n")
+	}
+	if !opts.Pack {
+		for _, shasum := range b.order {
+			data, err := b.looseObject(shasum)
+			if err != nil {
+				return nil, err
+			}
+			hexsum := shasum.String()
+			files["objects/"+hexsum[:2]+"/"+hexsum[2:]] = data
+		}
+		return files, nil
+	}
+	pack, idx, err := b.pack(opts)
+	if err != nil {
+		return nil, err
+	}
+	name := "objects/pack/pack-" + hex.EncodeToString(pack[len(pack)-b.format.Size():])
+	files[name+".pack"] = pack
+	files[name+".idx"] = idx
+	return files, nil
+}
+
+// Write writes the repository to the given directory, which is created if it doesn't exist.
+func (b *Builder) Write(dir string, opts Options) error {
+	files, err := b.Files(opts)
+	if err != nil {
+		return err
+	}
+	// git only recognizes the directory as a repo if objects and refs exist, even when they're empty.
+	for _, d := range []string{"objects", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			return err
+		}
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FS returns the repository as an in-memory file system, which can be opened with gitwood.OpenFS(fsys, ".").
+func (b *Builder) FS(opts Options) (fstest.MapFS, error) {
+	files, err := b.Files(opts)
+	if err != nil {
+		return nil, err
+	}
+	fsys := fstest.MapFS{}
+	for name, data := range files {
+		fsys[name] = &fstest.MapFile{Data: data, Mode: 0o644, ModTime: b.clock}
+	}
+	for _, d := range []string{"objects", "refs/heads", "refs/tags"} {
+		if _, ok := fsys[d]; !ok {
+			fsys[d] = &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: b.clock}
+		}
+	}
+	return fsys, nil
+}
+
+// Repo writes the repository to a temporary directory that is removed when the test ends, and opens it.
+func (b *Builder) Repo(t testing.TB, opts Options) *gitwood.Repo {
+	t.Helper()
+	dir := t.TempDir()
+	if err := b.Write(dir, opts); err != nil {
+		t.Fatalf("failed to write repo: %v", err)
+	}
+	repo, err := gitwood.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open repo: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// looseObject returns the content of the loose object file for the given object.
+func (b *Builder) looseObject(shasum gitwood.Hash) ([]byte, error) {
+	o := b.objects[shasum]
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	fmt.Fprintf(w, "%s %d\x00", o.otype, len(o.data))
+	w.Write(o.data)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// packEntry is an object written to a pack.
+type packEntry struct {
+	sha    []byte
+	offset uint64
+	crc    uint32
+	depth  int
+}
+
+// pack returns a pack containing all objects, in the order they were added, and its idx file.
+func (b *Builder) pack(opts Options) ([]byte, []byte, error) {
+	maxDepth := opts.MaxDeltaDepth
+	if maxDepth == 0 {
+		maxDepth = defaultMaxDeltaDepth
+	}
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(len(b.order)))
+	entries := make(map[gitwood.Hash]*packEntry, len(b.order))
+	// The last object of each type, which the next object of the type is deltified against.
+	last := map[gitwood.ObjectType]gitwood.Hash{}
+	for _, shasum := range b.order {
+		o := b.objects[shasum]
+		e := &packEntry{sha: shasum.Bytes(), offset: uint64(pack.Len())}
+		var hdr []byte
+		data := o.data
+		base, ok := last[o.otype]
+		var delta []byte
+		if ok && opts.Deltas != NoDeltas && entries[base].depth < maxDepth {
+			delta = makeDelta(b.objects[base].data, o.data)
+		}
+		// Like git, don't store deltas shorter than the smallest valid delta, which git refuses to apply.
+		if len(delta) >= minDeltaSize {
+			data = delta
+			e.depth = entries[base].depth + 1
+			if opts.Deltas == OfsDeltas {
+				hdr = packObjectHeader(gitwood.OBJ_OFS_DELTA, len(data))
+				hdr = append(hdr, ofsDeltaOffset(e.offset-entries[base].offset)...)
+			} else {
+				hdr = packObjectHeader(gitwood.OBJ_REF_DELTA, len(data))
+				hdr = append(hdr, entries[base].sha...)
+			}
+		} else {
+			hdr = packObjectHeader(o.otype, len(data))
+		}
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, nil, err
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(hdr)
+		crc.Write(z.Bytes())
+		e.crc = crc.Sum32()
+		pack.Write(hdr)
+		pack.Write(z.Bytes())
+		entries[shasum] = e
+		last[o.otype] = shasum
+	}
+	h := b.format.New()
+	h.Write(pack.Bytes())
+	sum := h.Sum(nil)
+	pack.Write(sum)
+	switch opts.IndexVersion {
+	case 0, 2:
+		return pack.Bytes(), b.packIndex(entries, sum, opts.LargeOffsets), nil
+	case 3:
+		return pack.Bytes(), b.packIndexV3(entries, sum, opts.LargeOffsets), nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported idx version %d", opts.IndexVersion)
+	}
+}
+
+// packObjectHeader returns the type and size header of a pack entry.
+// The type is in bits 4-6 of the first byte, and the size is a little endian varint
+// with 4 bits in the first byte and 7 in each of the following.
+func packObjectHeader(otype gitwood.ObjectType, size int) []byte {
+	c := byte(otype)<<4 | byte(size&0x0f)
+	size >>= 4
+	var hdr []byte
+	for size > 0 {
+		hdr = append(hdr, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(hdr, c)
+}
+
+// ofsDeltaOffset encodes the distance back to the base of an ofs-delta.
+// It's a big endian varint where each continuation adds one to the value, so that every number has a single encoding.
+func ofsDeltaOffset(off uint64) []byte {
+	buf := []byte{byte(off & 0x7f)}
+	for off >>= 7; off > 0; off >>= 7 {
+		off--
+		buf = append([]byte{byte(off&0x7f) | 0x80}, buf...)
+	}
+	return buf
+}
+
+// sortedEntries returns the pack entries sorted by shasum.
+func sortedEntries(entries map[gitwood.Hash]*packEntry) []*packEntry {
+	sorted := make([]*packEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].sha, sorted[j].sha) < 0
+	})
+	return sorted
+}
+
+// writeOffsets writes the 4 byte offsets of the entries, followed by the 8 byte offsets that don't fit in 31 bits.
+func writeOffsets(idx *bytes.Buffer, sorted []*packEntry, largeOffsets bool) {
+	var large []uint64
+	for _, e := range sorted {
+		if (largeOffsets && e.offset > packHeaderSize) || e.offset >= 1<<31 {
+			binary.Write(idx, binary.BigEndian, uint32(len(large))|1<<31)
+			large = append(large, e.offset)
+		} else {
+			binary.Write(idx, binary.BigEndian, uint32(e.offset))
+		}
+	}
+	binary.Write(idx, binary.BigEndian, large)
+}
+
+// packIndex returns a version 2 idx file for the given pack entries.
+func (b *Builder) packIndex(entries map[gitwood.Hash]*packEntry, packChecksum []byte, largeOffsets bool) []byte {
+	sorted := sortedEntries(entries)
+	var idx bytes.Buffer
+	idx.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(&idx, binary.BigEndian, uint32(2))
+	var fanout [256]uint32
+	for _, e := range sorted {
+		for i := int(e.sha[0]); i < 256; i++ {
+			fanout[i]++
+		}
+	}
+	binary.Write(&idx, binary.BigEndian, fanout)
+	for _, e := range sorted {
+		idx.Write(e.sha)
+	}
+	for _, e := range sorted {
+		binary.Write(&idx, binary.BigEndian, e.crc)
+	}
+	writeOffsets(&idx, sorted, largeOffsets)
+	return b.appendChecksum(&idx, packChecksum)
+}
+
+// packIndexV3 returns a version 3 idx file for the given pack entries, with tables for the builder's object format only.
+// git doesn't write version 3 files yet, but they're specified in its hash function transition plan.
+func (b *Builder) packIndexV3(entries map[gitwood.Hash]*packEntry, packChecksum []byte, largeOffsets bool) []byte {
+	sorted := sortedEntries(entries)
+	byOffset := append([]*packEntry(nil), sorted...)
+	sort.Slice(byOffset, func(i, j int) bool {
+		return byOffset[i].offset < byOffset[j].offset
+	})
+	packPos := make(map[*packEntry]uint32, len(byOffset))
+	for i, e := range byOffset {
+		packPos[e] = uint32(i)
+	}
+	// The shortened names are the shortest prefixes that tell all objects apart.
+	shortSize := 1
+	for i := 1; i < len(sorted); i++ {
+		var n int
+		for n < len(sorted[i].sha) && sorted[i].sha[n] == sorted[i-1].sha[n] {
+			n++
+		}
+		if n+1 > shortSize {
+			shortSize = n + 1
+		}
+	}
+	formatID := uint32(0x73686131) // sha1
+	if b.format == gitwood.SHA256 {
+		formatID = 0x73323536 // s256
+	}
+	const headerSize = 36
+	var tables bytes.Buffer
+	for _, e := range sorted {
+		tables.Write(e.sha[:shortSize])
+	}
+	for _, e := range byOffset {
+		tables.Write(e.sha)
+	}
+	for _, e := range sorted {
+		binary.Write(&tables, binary.BigEndian, packPos[e])
+	}
+	for _, e := range byOffset {
+		binary.Write(&tables, binary.BigEndian, e.crc)
+	}
+	writeOffsets(&tables, sorted, largeOffsets)
+	var idx bytes.Buffer
+	idx.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(&idx, binary.BigEndian, []uint32{
+		3, headerSize, uint32(len(sorted)), 1,
+		formatID, uint32(shortSize), headerSize,
+		uint32(headerSize + tables.Len()),
+	})
+	idx.Write(tables.Bytes())
+	return b.appendChecksum(&idx, packChecksum)
+}
+
+// appendChecksum appends the pack checksum to an idx file, followed by the checksum of the idx file itself.
+func (b *Builder) appendChecksum(idx *bytes.Buffer, packChecksum []byte) []byte {
+	idx.Write(packChecksum)
+	h := b.format.New()
+	h.Write(idx.Bytes())
+	return h.Sum(idx.Bytes())
+}
+
+// makeDelta returns a delta that turns base into target.
+// It copies the prefix and suffix the two have in common from base, and inserts everything in between,
+// which is enough to exercise both kinds of delta instructions.
+func makeDelta(base, target []byte) []byte {
+	var prefix, suffix int
+	for prefix < len(base) && prefix < len(target) && base[prefix] == target[prefix] {
+		prefix++
+	}
+	for suffix < len(base)-prefix && suffix < len(target)-prefix &&
+		base[len(base)-1-suffix] == target[len(target)-1-suffix] {
+		suffix++
+	}
+	delta := binary.AppendUvarint(nil, uint64(len(base)))
+	delta = binary.AppendUvarint(delta, uint64(len(target)))
+	delta = appendDeltaCopy(delta, 0, prefix)
+	for insert := target[prefix : len(target)-suffix]; len(insert) > 0; {
+		n := len(insert)
+		if n > 0x7f {
+			n = 0x7f
+		}
+		delta = append(delta, byte(n))
+		delta = append(delta, insert[:n]...)
+		insert = insert[n:]
+	}
+	return appendDeltaCopy(delta, len(base)-suffix, suffix)
+}
+
+// appendDeltaCopy appends instructions that copy size bytes from the given offset in the base.
+// Each instruction copies at most 0x10000 bytes, which is encoded as a size of zero.
+// Only the non-zero bytes of the offset and size are written, with a bit for each in the instruction byte.
+func appendDeltaCopy(delta []byte, offset, size int) []byte {
+	for size > 0 {
+		n := size
+		if n > 0x10000 {
+			n = 0x10000
+		}
+		inst := len(delta)
+		delta = append(delta, 0x80)
+		for i := 0; i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				delta[inst] |= 1 << i
+				delta = append(delta, b)
+			}
+		}
+		for i := 0; i < 3 && n != 0x10000; i++ {
+			if b := byte(n >> (8 * i)); b != 0 {
+				delta[inst] |= 1 << (4 + i)
+				delta = append(delta, b)
+			}
+		}
+		offset += n
+		size -= n
+	}
+	return delta
+}
@@ -2,16 +2,24 @@ package gitwood
 
 import "errors"
 
-const (
-	CHAR_SPACE = 0x20
-	NULL_HASH  = "0000000000000000000000000000000000000000"
-)
+const CHAR_SPACE = 0x20
 
 var (
-	ErrObjectNotFound  = errors.New("object not found")
-	ErrMalformedShasum = errors.New("malformed shasum")
-	ErrMalformedObject = errors.New("malformed object")
-	ErrMalformedCommit = errors.New("malformed commit")
-	ErrNotATree        = errors.New("object is not a tree")
-	ErrNotACommit      = errors.New("not a commit")
+	ErrObjectNotFound          = errors.New("object not found")
+	ErrMalformedShasum         = errors.New("malformed shasum")
+	ErrMalformedObject         = errors.New("malformed object")
+	ErrMalformedCommit         = errors.New("malformed commit")
+	ErrNotATree                = errors.New("object is not a tree")
+	ErrMalformedTree           = errors.New("malformed tree")
+	ErrTruncatedTreeEntry      = errors.New("truncated tree entry")
+	ErrBadTreeMode             = errors.New("bad mode in tree entry")
+	ErrEmptyTreeName           = errors.New("empty name in tree entry")
+	ErrNotACommit              = errors.New("not a commit")
+	ErrMalformedPackIndex      = errors.New("malformed pack index")
+	ErrMalformedChunkFile      = errors.New("malformed chunk file")
+	ErrMalformedBitmap         = errors.New("malformed bitmap")
+	ErrMalformedDelta          = errors.New("malformed delta")
+	ErrDeltaChainTooDeep       = errors.New("delta chain too deep")
+	ErrDeltaCycle              = errors.New("delta chain cycle")
+	ErrUnsupportedObjectFormat = errors.New("unsupported object format")
 )
@@ -0,0 +1,148 @@
+package gitwood
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// Sizes of object IDs, in bytes.
+const (
+	SHA1Size   = 20
+	SHA256Size = 32
+)
+
+// Hash is an object ID. It's a comparable value, so it can be used with == and as a map key.
+// The zero Hash refers to no object.
+type Hash struct {
+	sum  [SHA256Size]byte
+	size uint8
+}
+
+// ParseHash parses a hex object ID. Returns ErrMalformedShasum if it isn't a valid SHA-1 or SHA-256 hash.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 2*SHA1Size && len(s) != 2*SHA256Size {
+		return Hash{}, ErrMalformedShasum
+	}
+	if _, err := hex.Decode(h.sum[:], []byte(s)); err != nil {
+		return Hash{}, ErrMalformedShasum
+	}
+	h.size = uint8(len(s) / 2)
+	return h, nil
+}
+
+// MustParseHash is like ParseHash, but panics if the ID is malformed.
+// It's meant for IDs that are known to be valid, like constants in tests.
+func MustParseHash(s string) Hash {
+	h, err := ParseHash(s)
+	if err != nil {
+		panic("gitwood: malformed object ID " + s)
+	}
+	return h
+}
+
+// HashFromBytes returns the Hash with the given binary form.
+// Returns ErrMalformedShasum if it isn't the size of a SHA-1 or SHA-256 hash.
+func HashFromBytes(b []byte) (Hash, error) {
+	if len(b) != SHA1Size && len(b) != SHA256Size {
+		return Hash{}, ErrMalformedShasum
+	}
+	var h Hash
+	copy(h.sum[:], b)
+	h.size = uint8(len(b))
+	return h, nil
+}
+
+// hashFromBytes is HashFromBytes for data that has already been checked to be the right size,
+// like the fixed size ID fields of index files.
+func hashFromBytes(b []byte) Hash {
+	var h Hash
+	copy(h.sum[:], b)
+	h.size = uint8(len(b))
+	return h
+}
+
+// Bytes returns the binary form of the hash.
+func (h Hash) Bytes() []byte {
+	return h.sum[:h.size:h.size]
+}
+
+// Size returns the size of the hash in bytes, or 0 for the zero Hash.
+func (h Hash) Size() int {
+	return int(h.size)
+}
+
+// String returns the hash as hex, or an empty string for the zero Hash.
+func (h Hash) String() string {
+	return hex.EncodeToString(h.sum[:h.size])
+}
+
+// IsZero reports whether h is the zero Hash, i.e. it's unset.
+// The ID of only zeros that git uses for "no object" isn't the zero Hash, as it has a size.
+func (h Hash) IsZero() bool {
+	return h.size == 0
+}
+
+// isNull reports whether h is unset or the ID of only zeros, which git uses for "no object".
+func (h Hash) isNull() bool {
+	return h.sum == [SHA256Size]byte{}
+}
+
+// Compare returns -1, 0 or 1 if h sorts before, the same as or after o, in the order git sorts IDs.
+func (h Hash) Compare(o Hash) int {
+	return bytes.Compare(h.sum[:h.size], o.sum[:o.size])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (h *Hash) UnmarshalText(text []byte) error {
+	parsed, err := ParseHash(string(text))
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// ObjectFormat is the hash function a repo uses for object IDs, as set by extensions.objectFormat in its config.
+type ObjectFormat string
+
+const (
+	SHA1   ObjectFormat = "sha1"
+	SHA256 ObjectFormat = "sha256"
+)
+
+// Size returns the size of the object IDs of the format, in bytes.
+func (f ObjectFormat) Size() int {
+	if f == SHA256 {
+		return SHA256Size
+	}
+	return SHA1Size
+}
+
+// New returns a hash.Hash that computes object IDs of the format.
+func (f ObjectFormat) New() hash.Hash {
+	if f == SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// hashSizeForVersion returns the hash size for the hash version number in the headers of
+// multi-pack-index, commit-graph and .rev files, where 1 is SHA-1 and 2 is SHA-256.
+func hashSizeForVersion(v uint32) (int, bool) {
+	switch v {
+	case 1:
+		return SHA1Size, true
+	case 2:
+		return SHA256Size, true
+	}
+	return 0, false
+}
@@ -0,0 +1,179 @@
+package gitwood
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// HashObject returns the ID the object with the given type and content has in a SHA-1 repo,
+// like `git hash-object`. Use ObjectFormat.HashObject for SHA-256 repos.
+// The content is read to the end, since its size is part of the hashed data.
+func HashObject(otype ObjectType, r io.Reader) (Hash, error) {
+	return SHA1.HashObject(otype, r)
+}
+
+// HashObject returns the ID the object with the given type and content has in repos of the format.
+func (f ObjectFormat) HashObject(otype ObjectType, r io.Reader) (Hash, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Hash{}, err
+	}
+	return f.hashObject(otype, int64(len(data)), bytes.NewReader(data))
+}
+
+// hashObject hashes an object whose content size is known up front, so that it can be streamed from r.
+func (f ObjectFormat) hashObject(otype ObjectType, size int64, r io.Reader) (Hash, error) {
+	switch otype {
+	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+	default:
+		return Hash{}, fmt.Errorf("can't hash object of type %v", otype)
+	}
+	h := f.New()
+	fmt.Fprintf(h, "%s %d\x00", otype, size)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return Hash{}, err
+	}
+	if n != size {
+		return Hash{}, fmt.Errorf("expected %d bytes of content, read %d", size, n)
+	}
+	return hashFromBytes(h.Sum(nil)), nil
+}
+
+// HashDirectoryOptions control how HashDirectory hashes a directory.
+type HashDirectoryOptions struct {
+	// Format is the object format of the repo the tree would be in. Zero means SHA1.
+	Format ObjectFormat
+	// Exclude is called with the slash separated path relative to the root of each file and directory,
+	// and leaves out those it returns true for, like a .gitignore would. .git is always left out.
+	Exclude func(path string, info fs.FileInfo) bool
+}
+
+// HashDirectory returns the ID of the tree that `git add` would create for the directory, without writing any objects.
+// Like git, regular files are stored with mode 100644, or 100755 if they're executable by the owner,
+// symlinks are stored as blobs of their target, and empty directories are left out.
+// Subdirectories with a .git file or directory are stored as submodules pointing to their HEAD commit.
+// Other file types, such as sockets and devices, are errors.
+func HashDirectory(dir string, opts HashDirectoryOptions) (Hash, error) {
+	if opts.Format == "" {
+		opts.Format = SHA1
+	}
+	sum, ok, err := opts.hashTree(dir, "")
+	if err != nil || ok {
+		return sum, err
+	}
+	// Only the root can be an empty tree.
+	return opts.Format.hashObject(OBJ_TREE, 0, bytes.NewReader(nil))
+}
+
+// hashTree returns the tree ID of the directory at the given OS path and slash separated path relative to the root,
+// or false if the tree would be empty.
+func (o HashDirectoryOptions) hashTree(dir, rel string) (Hash, bool, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return Hash{}, false, err
+	}
+	var entries []TreeEntry
+	for _, de := range dirEntries {
+		name := de.Name()
+		if name == ".git" {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		// ReadDir doesn't follow symlinks, so this is the info of the link itself.
+		info, err := de.Info()
+		if err != nil {
+			return Hash{}, false, err
+		}
+		if o.Exclude != nil && o.Exclude(path.Join(rel, name), info) {
+			continue
+		}
+		e := TreeEntry{name: name}
+		switch mode := info.Mode(); {
+		case mode.IsRegular():
+			e.Mode = ModeFile
+			// git only looks at the owner's executable bit.
+			if mode&0o100 != 0 {
+				e.Mode = ModeExecutable
+			}
+			e.ShaSum, err = o.hashFile(p, info.Size())
+		case mode&fs.ModeSymlink != 0:
+			e.Mode = ModeSymlink
+			var target string
+			if target, err = os.Readlink(p); err == nil {
+				e.ShaSum, err = o.Format.hashObject(OBJ_BLOB, int64(len(target)), bytes.NewReader([]byte(target)))
+			}
+		case mode.IsDir():
+			if _, serr := os.Lstat(filepath.Join(p, ".git")); serr == nil {
+				e.Mode = ModeSubmodule
+				e.ShaSum, err = submoduleHead(p)
+				break
+			}
+			e.Mode = ModeDir
+			var ok bool
+			if e.ShaSum, ok, err = o.hashTree(p, path.Join(rel, name)); err == nil && !ok {
+				continue
+			}
+		default:
+			return Hash{}, false, fmt.Errorf("%v: unsupported file type %v", p, mode.Type())
+		}
+		if err != nil {
+			return Hash{}, false, err
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return Hash{}, false, nil
+	}
+	// git sorts trees as if their names end with a slash.
+	sortName := func(e TreeEntry) string {
+		if e.IsDir() {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortName(entries[i]) < sortName(entries[j])
+	})
+	var tree bytes.Buffer
+	for _, e := range entries {
+		tree.WriteString(e.Mode.String() + " " + e.name + "\x00")
+		tree.Write(e.ShaSum.Bytes())
+	}
+	sum, err := o.Format.hashObject(OBJ_TREE, int64(tree.Len()), &tree)
+	return sum, err == nil, err
+}
+
+// hashFile returns the blob ID of the file at the given path, which is streamed rather than read into memory.
+func (o HashDirectoryOptions) hashFile(name string, size int64) (Hash, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer file.Close()
+	sum, err := o.Format.hashObject(OBJ_BLOB, size, file)
+	if err != nil {
+		return Hash{}, fmt.Errorf("%v: %w", name, err)
+	}
+	return sum, nil
+}
+
+// submoduleHead returns the commit HEAD points to in the submodule checked out in dir.
+func submoduleHead(dir string) (Hash, error) {
+	repo, err := Open(dir)
+	if err != nil {
+		return Hash{}, fmt.Errorf("failed to open submodule %v: %w", dir, err)
+	}
+	defer repo.Close()
+	head := repo.HeadCommit()
+	if head.IsZero() {
+		return Hash{}, fmt.Errorf("submodule %v has no HEAD commit", dir)
+	}
+	return head, nil
+}
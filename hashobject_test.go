@@ -0,0 +1,104 @@
+package gitwood_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+)
+
+func TestHashObject(t *testing.T) {
+	// IDs from `git hash-object`.
+	tests := []struct {
+		format gitwood.ObjectFormat
+		want   string
+	}{
+		{gitwood.SHA1, "ce013625030ba8dba906f756967f9e9ca394464a"},
+		{gitwood.SHA256, "2cf8d83d9ee29543b34a87727421fdecb7e3f3a183d337639025de576db9ebb4"},
+	}
+	for _, tt := range tests {
+		sum, err := tt.format.HashObject(gitwood.OBJ_BLOB, strings.NewReader("hello\n"))
+		if err != nil || sum.String() != tt.want {
+			t.Errorf("%v.HashObject() = %v, %v, want %v", tt.format, sum, err, tt.want)
+		}
+	}
+	if sum, err := gitwood.HashObject(gitwood.OBJ_BLOB, strings.NewReader("hello\n")); err != nil || sum.String() != tests[0].want {
+		t.Errorf("HashObject() = %v, %v, want %v", sum, err, tests[0].want)
+	}
+	if _, err := gitwood.HashObject(gitwood.OBJ_OFS_DELTA, strings.NewReader("")); err == nil {
+		t.Error("HashObject() of a delta succeeded")
+	}
+}
+
+// writeDir writes files to a temporary directory, which is returned.
+// Files map slash separated paths to content, with a trailing slash for directories and "-> " for symlink targets.
+func writeDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case strings.HasSuffix(name, "/"):
+			err = os.MkdirAll(p, 0o755)
+		case strings.HasPrefix(content, "-> "):
+			err = os.Symlink(strings.TrimPrefix(content, "-> "), p)
+		default:
+			err = os.WriteFile(p, []byte(content), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestHashDirectory(t *testing.T) {
+	files := map[string]string{
+		"README": "hello\n",
+		"run.sh": "#!/bin/sh\necho hi\n",
+		"link":   "-> README",
+		// Empty directories are left out.
+		"empty/nested/": "",
+		// git sorts trees as if their names end with a slash, so a/ sorts between a.b and a0.
+		"a-":  "dash\n",
+		"a.b": "dot\n",
+		"a/x": "x\n",
+		"a0":  "zero\n",
+	}
+	// IDs from `git write-tree` after `git add -A`.
+	tests := []struct {
+		name   string
+		format gitwood.ObjectFormat
+		mode   os.FileMode
+		want   string
+	}{
+		{"executable", gitwood.SHA1, 0o755, "2cfafcf1a8b7e61a81c7445b510e36bccc65441d"},
+		{"not executable", gitwood.SHA1, 0o644, "cf0f53089be78b2e8dacd6600bab59a7c1f4ad76"},
+		// Only the owner's executable bit counts.
+		{"executable by others", gitwood.SHA1, 0o655, "cf0f53089be78b2e8dacd6600bab59a7c1f4ad76"},
+		{"sha256", gitwood.SHA256, 0o755, "fd2ba15968f54e8d3c8af0fef964926e1420d1416dd8a785051af51d27d64c00"},
+	}
+	dir := writeDir(t, files)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.Chmod(filepath.Join(dir, "run.sh"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			sum, err := gitwood.HashDirectory(dir, gitwood.HashDirectoryOptions{Format: tt.format})
+			if err != nil || sum.String() != tt.want {
+				t.Errorf("HashDirectory() = %v, %v, want %v", sum, err, tt.want)
+			}
+		})
+	}
+	// A directory with only empty directories is the empty tree.
+	empty := writeDir(t, map[string]string{"empty/nested/": ""})
+	if sum, err := gitwood.HashDirectory(empty, gitwood.HashDirectoryOptions{}); err != nil || sum.String() != "4b825dc642cb6eb9a060e54bf8d69288fbee4904" {
+		t.Errorf("HashDirectory() of empty directories = %v, %v, want the empty tree", sum, err)
+	}
+}
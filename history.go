@@ -0,0 +1,275 @@
+package gitwood
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// LogInfo is like Log, but returns the history as CommitInfo,
+// so that the commit objects don't have to be read if the repo has a commit-graph.
+func (r Repo) LogInfo(shasum Hash) ([]CommitInfo, error) {
+	if shasum.IsZero() {
+		shasum = r.HeadCommit()
+	}
+	lookup := r.newCommitLookup()
+	ci, err := lookup.info(shasum)
+	if err != nil {
+		return nil, err
+	}
+	commits := []CommitInfo{*ci}
+	for len(ci.Parents) > 0 {
+		ci, err = lookup.info(ci.Parents[0])
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, *ci)
+	}
+	return commits, nil
+}
+
+// LogPath returns the commits in the first parent history of the given commit that changed the given path,
+// i.e. where the object at the path differs from the first parent, newest first.
+// If the commit-graph has changed-path Bloom filters, they are used to skip commits that didn't change the path,
+// so that the trees only have to be compared when the filter can't rule the path out.
+func (r Repo) LogPath(shasum Hash, path string) ([]Commit, error) {
+	if shasum.IsZero() {
+		shasum = r.HeadCommit()
+	}
+	lookup := r.newCommitLookup()
+	var commits []Commit
+	for !shasum.IsZero() {
+		ci, err := lookup.info(shasum)
+		if err != nil {
+			return commits, err
+		}
+		var parent Hash
+		if len(ci.Parents) > 0 {
+			parent = ci.Parents[0]
+		}
+		shasum = parent
+		if lookup.graph != nil {
+			filter, ok, err := lookup.graph.ChangedPaths(ci.ShaSum)
+			if err != nil {
+				return commits, err
+			}
+			if ok && !filter.MaybeChanged(path) {
+				continue
+			}
+		}
+		changed, err := r.pathChanged(lookup, ci.Tree, parent, path)
+		if err != nil {
+			return commits, err
+		}
+		if !changed {
+			continue
+		}
+		commit, err := r.Commit(ci.ShaSum)
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, *commit)
+	}
+	return commits, nil
+}
+
+// pathChanged reports whether the entry at path in the given tree differs from the one in the parent commit's tree,
+// either by content or by mode. A root commit (no parent) changes every path it has.
+func (r Repo) pathChanged(lookup *commitLookup, treeSum, parent Hash, path string) (bool, error) {
+	e, err := r.pathEntry(treeSum, path)
+	if err != nil {
+		return false, err
+	}
+	if parent.IsZero() {
+		return e != TreeEntry{}, nil
+	}
+	pci, err := lookup.info(parent)
+	if err != nil {
+		return false, err
+	}
+	pe, err := r.pathEntry(pci.Tree, path)
+	if err != nil {
+		return false, err
+	}
+	return e != pe, nil
+}
+
+// pathEntry returns the entry at the given path in the tree, or an empty entry if it doesn't exist.
+func (r Repo) pathEntry(treeSum Hash, path string) (TreeEntry, error) {
+	tree, err := r.Tree(treeSum)
+	if err != nil {
+		return TreeEntry{}, err
+	}
+	e, err := tree.entry(path)
+	if errors.Is(err, ErrObjectNotFound) {
+		return TreeEntry{}, nil
+	}
+	return e, err
+}
+
+// IsAncestor reports whether ancestor is reachable from descendant.
+// A commit is considered to be its own ancestor.
+// With a commit-graph, generation numbers are used to avoid walking past the ancestor.
+func (r Repo) IsAncestor(ancestor, descendant Hash) (bool, error) {
+	return r.isAncestor(r.newCommitLookup(), ancestor, descendant)
+}
+
+func (r Repo) isAncestor(lookup *commitLookup, ancestor, descendant Hash) (bool, error) {
+	if ancestor == descendant {
+		return true, nil
+	}
+	anc, err := lookup.info(ancestor)
+	if err != nil {
+		return false, err
+	}
+	seen := map[Hash]bool{descendant: true}
+	stack := []Hash{descendant}
+	for len(stack) > 0 {
+		ci, err := lookup.info(stack[len(stack)-1])
+		if err != nil {
+			return false, err
+		}
+		stack = stack[:len(stack)-1]
+		// Ancestors of ci have lower generations than ci, so if ci's generation is
+		// already lower than the ancestor's, the ancestor can't be found behind it.
+		if anc.Generation != generationInfinity && ci.Generation < anc.Generation {
+			continue
+		}
+		for _, p := range ci.Parents {
+			if p == ancestor {
+				return true, nil
+			}
+			if !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+	return false, nil
+}
+
+// Flags used while painting commits in MergeBase.
+const (
+	paintParent1 = 1 << iota
+	paintParent2
+	paintStale
+	paintResult
+)
+
+// commitQueue is a priority queue of commits that pops the commit with the highest generation first,
+// or the newest commit if the generations are equal.
+type commitQueue []*CommitInfo
+
+func (q commitQueue) Len() int { return len(q) }
+
+func (q commitQueue) Less(i, j int) bool {
+	if q[i].Generation != q[j].Generation {
+		return q[i].Generation > q[j].Generation
+	}
+	return q[i].CommitTime > q[j].CommitTime
+}
+
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *commitQueue) Push(x any) { *q = append(*q, x.(*CommitInfo)) }
+
+func (q *commitQueue) Pop() any {
+	old := *q
+	ci := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ci
+}
+
+// MergeBase returns the best common ancestors of the two commits, like `git merge-base --all`.
+// Usually there is only one, but criss-cross merges can result in several.
+// Returns an empty list if the commits have no common history.
+func (r Repo) MergeBase(a, b Hash) ([]Hash, error) {
+	if a == b {
+		return []Hash{a}, nil
+	}
+	lookup := r.newCommitLookup()
+	bases, err := r.paintDownToCommon(lookup, a, b)
+	if err != nil {
+		return nil, err
+	}
+	return r.removeRedundant(lookup, bases)
+}
+
+// paintDownToCommon walks the history of both commits, newest first, marking each commit with the side(s) it's reachable from.
+// Commits reachable from both sides are merge base candidates, and everything behind them is marked stale.
+// This is the same algorithm as paint_down_to_common in git.
+func (r Repo) paintDownToCommon(lookup *commitLookup, a, b Hash) ([]Hash, error) {
+	flags := map[Hash]int{a: paintParent1, b: paintParent2}
+	queue := &commitQueue{}
+	for _, sum := range []Hash{a, b} {
+		ci, err := lookup.info(sum)
+		if err != nil {
+			return nil, err
+		}
+		heap.Push(queue, ci)
+	}
+	hasNonStale := func() bool {
+		for _, ci := range *queue {
+			if flags[ci.ShaSum]&paintStale == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	var results []Hash
+	for hasNonStale() {
+		ci := heap.Pop(queue).(*CommitInfo)
+		f := flags[ci.ShaSum] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[ci.ShaSum]&paintResult == 0 {
+				flags[ci.ShaSum] |= paintResult
+				results = append(results, ci.ShaSum)
+			}
+			// Everything reachable from a common ancestor is common, but not a best common ancestor.
+			f |= paintStale
+		}
+		for _, p := range ci.Parents {
+			if flags[p]&f == f {
+				continue
+			}
+			pci, err := lookup.info(p)
+			if err != nil {
+				return nil, err
+			}
+			flags[p] |= f
+			heap.Push(queue, pci)
+		}
+	}
+	// Results may have been marked stale after they were found, if they're reachable from other results.
+	var bases []Hash
+	for _, sum := range results {
+		if flags[sum]&paintStale == 0 {
+			bases = append(bases, sum)
+		}
+	}
+	return bases, nil
+}
+
+// removeRedundant removes the commits that are ancestors of other commits in the list.
+func (r Repo) removeRedundant(lookup *commitLookup, commits []Hash) ([]Hash, error) {
+	if len(commits) < 2 {
+		return commits, nil
+	}
+	var result []Hash
+checkCommits:
+	for i, c := range commits {
+		for j, other := range commits {
+			if i == j {
+				continue
+			}
+			isAncestor, err := r.isAncestor(lookup, c, other)
+			if err != nil {
+				return nil, err
+			}
+			if isAncestor {
+				continue checkCommits
+			}
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
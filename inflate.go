@@ -0,0 +1,141 @@
+package gitwood
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// maxSizeHint caps the buffers allocated up front from sizes in object headers,
+// so that a corrupt header can't make a small object allocate a huge buffer.
+// Larger objects grow their buffer as they're inflated.
+const maxSizeHint = 64 << 20
+
+// zlibReaders pools zlib readers, since each one allocates a window and decoding tables.
+// Readers are reset to read a new stream with zlib.Resetter.
+var zlibReaders sync.Pool
+
+// bufReaders pools the buffered readers that zlib streams are read through.
+// Inflating from an io.ByteReader keeps zlib from reading past the end of the stream, or buffering on its own.
+var bufReaders = sync.Pool{
+	New: func() any {
+		return bufio.NewReader(nil)
+	},
+}
+
+// getZlibReader returns a zlib reader of the stream in r, which should be returned with putZlibReader when done.
+// Like zlib.NewReader, the stream header is read right away.
+func getZlibReader(r io.Reader) (io.ReadCloser, error) {
+	zr, ok := zlibReaders.Get().(io.ReadCloser)
+	if !ok {
+		return zlib.NewReader(r)
+	}
+	if err := zr.(zlib.Resetter).Reset(r, nil); err != nil {
+		zlibReaders.Put(zr)
+		return nil, err
+	}
+	return zr, nil
+}
+
+func putZlibReader(zr io.ReadCloser) {
+	zlibReaders.Put(zr)
+}
+
+func getBufReader(r io.Reader) *bufio.Reader {
+	buf := bufReaders.Get().(*bufio.Reader)
+	buf.Reset(r)
+	return buf
+}
+
+// putBufReader returns a reader from getBufReader to the pool, if it isn't nil. It must not be used afterwards.
+func putBufReader(buf *bufio.Reader) {
+	if buf == nil {
+		return
+	}
+	// Don't keep the underlying reader alive while pooled.
+	buf.Reset(nil)
+	bufReaders.Put(buf)
+}
+
+// inflate reads the zlib stream in r to the end, and returns the inflated data.
+// sizeHint is the expected size of the data, e.g. from a pack entry header, or 0 if unknown.
+// It's only used to size the returned buffer.
+func inflate(r io.Reader, sizeHint uint64) ([]byte, error) {
+	zr, err := getZlibReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the reader: %w", err)
+	}
+	defer putZlibReader(zr)
+	return readAll(zr, makeBuffer(sizeHint))
+}
+
+// inflateAt inflates the zlib stream that starts at the given offset of file, like inflate.
+// The file is read through a SectionReader, so the stream can be read while others read from the same file.
+func inflateAt(file io.ReaderAt, off, sizeHint uint64) ([]byte, error) {
+	if off > math.MaxInt64 {
+		return nil, fmt.Errorf("pack offset %d out of range", off)
+	}
+	buf := getBufReader(io.NewSectionReader(file, int64(off), math.MaxInt64-int64(off)))
+	defer putBufReader(buf)
+	return inflate(buf, sizeHint)
+}
+
+// inflateHeaderAt inflates the start of the zlib stream at the given offset of file into b,
+// and returns the number of bytes read, which is less than len(b) if the stream is shorter.
+func inflateHeaderAt(file io.ReaderAt, off uint64, b []byte) (int, error) {
+	if off > math.MaxInt64 {
+		return 0, fmt.Errorf("pack offset %d out of range", off)
+	}
+	buf := getBufReader(io.NewSectionReader(file, int64(off), math.MaxInt64-int64(off)))
+	defer putBufReader(buf)
+	zr, err := getZlibReader(buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the reader: %w", err)
+	}
+	defer putZlibReader(zr)
+	n, err := io.ReadFull(zr, b)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// makeBuffer returns an empty buffer with room for the given number of bytes, up to maxSizeHint.
+func makeBuffer(sizeHint uint64) []byte {
+	if sizeHint > maxSizeHint {
+		sizeHint = maxSizeHint
+	}
+	return make([]byte, 0, sizeHint)
+}
+
+// readAll appends everything read from r to b, like io.ReadAll.
+// If b has room for all of it, no other allocations are made.
+func readAll(r io.Reader, b []byte) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			// The buffer may have been sized exactly, so check for the end of the stream before growing it.
+			var one [1]byte
+			n, err := r.Read(one[:])
+			b = append(b, one[:n]...)
+			if err == io.EOF {
+				return b, nil
+			}
+			if err != nil {
+				return b, err
+			}
+			continue
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
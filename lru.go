@@ -0,0 +1,66 @@
+package gitwood
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a size-bounded least recently used cache of objects, where the size is the total length of the object data.
+// It is safe for concurrent use.
+type lru[K comparable] struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type lruEntry[K comparable] struct {
+	key   K
+	otype ObjectType
+	data  []byte
+}
+
+func newLRU[K comparable](maxSize int) *lru[K] {
+	return &lru[K]{maxSize: maxSize, order: list.New(), entries: map[K]*list.Element{}}
+}
+
+func (c *lru[K]) get(key K) (ObjectType, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return OBJ_INVALID, nil, false
+	}
+	c.order.MoveToFront(e)
+	v := e.Value.(*lruEntry[K])
+	return v.otype, v.data, true
+}
+
+// add caches the object, replacing any object with the same key, and evicting the least recently used
+// objects to make room. Objects larger than the cache are not cached, and caches of size zero or less cache nothing.
+func (c *lru[K]) add(key K, otype ObjectType, data []byte) {
+	if c.maxSize <= 0 || len(data) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		v := c.order.Remove(e).(*lruEntry[K])
+		delete(c.entries, key)
+		c.size -= len(v.data)
+	}
+	for c.size+len(data) > c.maxSize {
+		v := c.order.Remove(c.order.Back()).(*lruEntry[K])
+		delete(c.entries, v.key)
+		c.size -= len(v.data)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K]{key: key, otype: otype, data: data})
+	c.size += len(data)
+}
+
+func (c *lru[K]) len() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
@@ -0,0 +1,110 @@
+package gitwood
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func checkLRU(t *testing.T, c *lru[string], wantKeys string, wantSize int) {
+	t.Helper()
+	var keys []string
+	size := 0
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*lruEntry[string])
+		keys = append(keys, v.key)
+		size += len(v.data)
+	}
+	if got := strings.Join(keys, ","); got != wantKeys {
+		t.Errorf("keys from most to least recently used = %q, want %q", got, wantKeys)
+	}
+	if n, s := c.len(); n != len(keys) || s != size || s != wantSize {
+		t.Errorf("len() = %d, %d, want %d, %d", n, s, len(keys), wantSize)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := newLRU[string](10)
+	c.add("a", OBJ_BLOB, []byte("aaa"))
+	c.add("b", OBJ_BLOB, []byte("bbb"))
+	c.add("c", OBJ_BLOB, []byte("ccc"))
+	checkLRU(t, c, "c,b,a", 9)
+	// Getting a makes b the least recently used, so it's evicted first.
+	if otype, data, ok := c.get("a"); !ok || otype != OBJ_BLOB || string(data) != "aaa" {
+		t.Fatalf("get(a) = %v, %q, %v", otype, data, ok)
+	}
+	c.add("d", OBJ_TREE, []byte("dd"))
+	checkLRU(t, c, "d,a,c", 8)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("get(b) found an evicted entry")
+	}
+	// Room for an object is made by evicting as many objects as needed.
+	c.add("e", OBJ_BLOB, []byte("eeeeeeee"))
+	checkLRU(t, c, "e,d", 10)
+	// Objects larger than the cache are not cached, and don't evict anything.
+	c.add("f", OBJ_BLOB, []byte("fffffffffff"))
+	checkLRU(t, c, "e,d", 10)
+	// Objects as large as the cache replace everything.
+	c.add("g", OBJ_BLOB, []byte("gggggggggg"))
+	checkLRU(t, c, "g", 10)
+}
+
+func TestLRUReplace(t *testing.T) {
+	c := newLRU[string](10)
+	c.add("a", OBJ_BLOB, []byte("aaa"))
+	c.add("b", OBJ_BLOB, []byte("bbb"))
+	c.add("a", OBJ_BLOB, []byte("aaa"))
+	checkLRU(t, c, "a,b", 6)
+	// Replacing an entry counts the new data only, and evicts others if it grew.
+	c.add("b", OBJ_TREE, []byte("b"))
+	checkLRU(t, c, "b,a", 4)
+	c.add("a", OBJ_BLOB, []byte("aaaaaaaa"))
+	checkLRU(t, c, "a,b", 9)
+	c.add("b", OBJ_BLOB, []byte("bbbbbbbbbb"))
+	checkLRU(t, c, "b", 10)
+	if otype, data, _ := c.get("b"); otype != OBJ_BLOB || string(data) != "bbbbbbbbbb" {
+		t.Errorf("get(b) = %v, %q after replacing it", otype, data)
+	}
+	// Replacements too large for the cache aren't cached, like other objects.
+	c.add("b", OBJ_BLOB, []byte("bbbbbbbbbbb"))
+	checkLRU(t, c, "b", 10)
+}
+
+func TestLRUNoSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			c := newLRU[string](size)
+			c.add("a", OBJ_BLOB, []byte("a"))
+			c.add("empty", OBJ_BLOB, nil)
+			checkLRU(t, c, "", 0)
+			if _, _, ok := c.get("empty"); ok {
+				t.Error("get(empty) found an entry")
+			}
+		})
+	}
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	c := newLRU[int](100)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g*7 + i) % 50
+				if _, data, ok := c.get(key); ok && len(data) != key%10 {
+					t.Errorf("get(%d) returned %d bytes", key, len(data))
+					return
+				}
+				c.add(key, OBJ_BLOB, make([]byte, key%10))
+			}
+		}(g)
+	}
+	wg.Wait()
+	n, size := c.len()
+	if size > 100 || n != c.order.Len() || n != len(c.entries) {
+		t.Errorf("len() = %d, %d with %d entries in the list and %d in the map", n, size, c.order.Len(), len(c.entries))
+	}
+}
@@ -0,0 +1,220 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Multi-pack-index format (objects/pack/multi-pack-index), see https://git-scm.com/docs/gitformat-pack:
+//
+//	header: "MIDX", version, oid version, number of chunks, number of base files, number of packs
+//	chunk lookup table: (chunks+1) * [4 byte chunk id, 8 byte offset]
+//	chunks: PNAM, OIDF, OIDL, OOFF, (LOFF), (RIDX), (BTMP)
+//	trailer: checksum
+
+const (
+	midxHeaderSize     = 12
+	chunkLookupRowSize = 12
+
+	chunkPackNames     = 0x504e414d // PNAM
+	chunkOIDFanout     = 0x4f494446 // OIDF
+	chunkOIDLookup     = 0x4f49444c // OIDL
+	chunkObjectOffsets = 0x4f4f4646 // OOFF
+	chunkLargeOffsets  = 0x4c4f4646 // LOFF
+	chunkRevIndex      = 0x52494458 // RIDX
+	chunkBitmapPacks   = 0x42544d50 // BTMP
+)
+
+var midxSignature = []byte("MIDX")
+
+// MultiPackIndex is a parsed multi-pack-index, which indexes the objects of many packs at once.
+type MultiPackIndex struct {
+	checksum  []byte
+	packNames []string
+	fanout    [256]uint32
+	oids      []byte
+	offsets   []byte
+	large     []byte
+	ridx      []byte
+	btmp      []byte
+	hashSize  int
+}
+
+// readChunkTable reads a chunk lookup table from data, starting at off.
+// The returned map contains the data of each chunk, keyed by chunk ID.
+func readChunkTable(data []byte, off, numChunks int) (map[uint32][]byte, error) {
+	if len(data) < off+(numChunks+1)*chunkLookupRowSize {
+		return nil, fmt.Errorf("%w: truncated chunk table", ErrMalformedChunkFile)
+	}
+	chunks := make(map[uint32][]byte, numChunks)
+	for i := 0; i < numChunks; i++ {
+		row := data[off+i*chunkLookupRowSize:]
+		id := binary.BigEndian.Uint32(row)
+		start := binary.BigEndian.Uint64(row[4:])
+		end := binary.BigEndian.Uint64(row[4+chunkLookupRowSize:])
+		if id == 0 || start > end || end > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: invalid chunk %08x at %d-%d", ErrMalformedChunkFile, id, start, end)
+		}
+		chunks[id] = data[start:end]
+	}
+	return chunks, nil
+}
+
+func parseFanout(chunk []byte, fanout *[256]uint32) error {
+	if len(chunk) != 4*256 {
+		return fmt.Errorf("%w: fanout chunk has the wrong size", ErrMalformedChunkFile)
+	}
+	for i := range fanout {
+		fanout[i] = binary.BigEndian.Uint32(chunk[4*i:])
+		if i > 0 && fanout[i] < fanout[i-1] {
+			return fmt.Errorf("%w: fanout table is not monotonic", ErrMalformedChunkFile)
+		}
+	}
+	return nil
+}
+
+// ParseMultiPackIndex parses the contents of a multi-pack-index file.
+func ParseMultiPackIndex(data []byte) (*MultiPackIndex, error) {
+	if len(data) < midxHeaderSize || !bytes.Equal(data[:4], midxSignature) {
+		return nil, fmt.Errorf("%w: not a multi-pack-index", ErrMalformedChunkFile)
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("%w: unsupported multi-pack-index version %d", ErrMalformedChunkFile, data[4])
+	}
+	hashSize, ok := hashSizeForVersion(uint32(data[5]))
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported object id version %d", ErrMalformedChunkFile, data[5])
+	}
+	if len(data) < midxHeaderSize+hashSize {
+		return nil, fmt.Errorf("%w: not a multi-pack-index", ErrMalformedChunkFile)
+	}
+	numChunks := int(data[6])
+	if data[7] != 0 {
+		return nil, fmt.Errorf("%w: incremental multi-pack-indexes are not supported", ErrMalformedChunkFile)
+	}
+	numPacks := int(binary.BigEndian.Uint32(data[8:12]))
+	chunks, err := readChunkTable(data, midxHeaderSize, numChunks)
+	if err != nil {
+		return nil, err
+	}
+	m := &MultiPackIndex{checksum: data[len(data)-hashSize:], hashSize: hashSize}
+	for _, id := range []uint32{chunkPackNames, chunkOIDFanout, chunkOIDLookup, chunkObjectOffsets} {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("%w: missing required chunk %08x", ErrMalformedChunkFile, id)
+		}
+	}
+	// Pack names are NUL terminated, and the chunk may be padded with NULs.
+	for _, name := range strings.Split(string(chunks[chunkPackNames]), "\x00") {
+		if name != "" {
+			m.packNames = append(m.packNames, name)
+		}
+	}
+	if len(m.packNames) != numPacks {
+		return nil, fmt.Errorf("%w: expected %d pack names, found %d", ErrMalformedChunkFile, numPacks, len(m.packNames))
+	}
+	if err = parseFanout(chunks[chunkOIDFanout], &m.fanout); err != nil {
+		return nil, err
+	}
+	n := int(m.fanout[255])
+	m.oids = chunks[chunkOIDLookup]
+	m.offsets = chunks[chunkObjectOffsets]
+	m.large = chunks[chunkLargeOffsets]
+	if len(m.oids) != hashSize*n || len(m.offsets) != 8*n {
+		return nil, fmt.Errorf("%w: object tables don't match the fanout table", ErrMalformedChunkFile)
+	}
+	if ridx, ok := chunks[chunkRevIndex]; ok {
+		if len(ridx) != 4*n {
+			return nil, fmt.Errorf("%w: reverse index has the wrong size", ErrMalformedChunkFile)
+		}
+		m.ridx = ridx
+	}
+	if btmp, ok := chunks[chunkBitmapPacks]; ok {
+		if len(btmp) != 8*numPacks {
+			return nil, fmt.Errorf("%w: bitmapped packs chunk has the wrong size", ErrMalformedChunkFile)
+		}
+		m.btmp = btmp
+	}
+	return m, nil
+}
+
+// PackNames returns the names of the idx files covered by the multi-pack-index, indexed by pack ID.
+func (m *MultiPackIndex) PackNames() []string {
+	return m.packNames
+}
+
+// NumObjects returns the number of objects in the multi-pack-index.
+func (m *MultiPackIndex) NumObjects() int {
+	return int(m.fanout[255])
+}
+
+func (m *MultiPackIndex) oid(i int) []byte {
+	return m.oids[m.hashSize*i : m.hashSize*i+m.hashSize]
+}
+
+// find returns the position of the given binary shasum in the OID lookup table.
+func (m *MultiPackIndex) find(sha []byte) (int, bool) {
+	var lo int
+	if sha[0] > 0 {
+		lo = int(m.fanout[sha[0]-1])
+	}
+	hi := int(m.fanout[sha[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(m.oid(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(m.oid(i), sha) {
+		return i, true
+	}
+	return -1, false
+}
+
+// object returns the pack ID and pack offset of the i'th object in the lookup table.
+func (m *MultiPackIndex) object(i int) (int, uint64, error) {
+	packID := binary.BigEndian.Uint32(m.offsets[8*i:])
+	if int(packID) >= len(m.packNames) {
+		return 0, 0, fmt.Errorf("%w: pack ID %d out of range", ErrMalformedChunkFile, packID)
+	}
+	off := binary.BigEndian.Uint32(m.offsets[8*i+4:])
+	if off&0x8000_0000 == 0 {
+		return int(packID), uint64(off), nil
+	}
+	li := int(off & 0x7fff_ffff)
+	if 8*li+8 > len(m.large) {
+		return 0, 0, fmt.Errorf("%w: large offset %d out of range", ErrMalformedChunkFile, li)
+	}
+	return int(packID), binary.BigEndian.Uint64(m.large[8*li:]), nil
+}
+
+// Find returns the pack ID and pack offset of the object with the given shasum, if present.
+func (m *MultiPackIndex) Find(sha Hash) (int, uint64, bool, error) {
+	if sha.Size() != m.hashSize {
+		return 0, 0, false, ErrMalformedShasum
+	}
+	i, ok := m.find(sha.Bytes())
+	if !ok {
+		return 0, 0, false, nil
+	}
+	packID, off, err := m.object(i)
+	return packID, off, err == nil, err
+}
+
+// HasRevIndex reports whether the multi-pack-index has the optional RIDX chunk.
+func (m *MultiPackIndex) HasRevIndex() bool {
+	return m.ridx != nil
+}
+
+// HasBitmappedPacks reports whether the multi-pack-index has the optional BTMP chunk.
+func (m *MultiPackIndex) HasBitmappedPacks() bool {
+	return m.btmp != nil
+}
+
+// BitmappedPack returns the first bit position and the number of objects of the given pack
+// in the multi-pack reachability bitmap, as given by the BTMP chunk.
+func (m *MultiPackIndex) BitmappedPack(packID int) (uint32, uint32, bool) {
+	if m.btmp == nil || packID < 0 || packID >= len(m.packNames) {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(m.btmp[8*packID:]), binary.BigEndian.Uint32(m.btmp[8*packID+4:]), true
+}
@@ -0,0 +1,179 @@
+package gitwood_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+)
+
+type packedObject struct {
+	pack string
+	off  uint64
+}
+
+// readPackedObjects reads testdata/midx-objects.txt, which has the objects of the packs of testdata/midx.git.
+func readPackedObjects(t *testing.T) map[gitwood.Hash]packedObject {
+	t.Helper()
+	f, err := os.Open("testdata/midx-objects.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	objects := map[gitwood.Hash]packedObject{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// pack-<checksum>.idx <offset> <object ID> (<crc>)
+		fields := strings.Fields(s.Text())
+		off, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := gitwood.ParseHash(fields[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[sum] = packedObject{strings.TrimSuffix(fields[0], ".idx"), off}
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func readMultiPackIndex(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/midx.git/objects/pack/multi-pack-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMultiPackIndex(t *testing.T) {
+	objects := readPackedObjects(t)
+	m, err := gitwood.ParseMultiPackIndex(readMultiPackIndex(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The multi-pack-index covers two of the three packs.
+	covered := map[string]int{}
+	for i, name := range m.PackNames() {
+		covered[strings.TrimSuffix(name, ".idx")] = i
+	}
+	if len(covered) != 2 {
+		t.Fatalf("PackNames() = %v, want 2 packs", m.PackNames())
+	}
+	var n int
+	for sum, want := range objects {
+		packID, off, ok, err := m.Find(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantID, isCovered := covered[want.pack]
+		if ok != isCovered {
+			t.Errorf("Find(%v) found = %v, want %v", sum, ok, isCovered)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		n++
+		if packID != wantID || off != want.off {
+			t.Errorf("Find(%v) = %d, %d, want %d, %d", sum, packID, off, wantID, want.off)
+		}
+	}
+	if m.NumObjects() != n {
+		t.Errorf("NumObjects() = %d, want %d", m.NumObjects(), n)
+	}
+	if !m.HasRevIndex() {
+		t.Error("HasRevIndex() = false for a multi-pack-index written with a bitmap")
+	}
+	if _, _, _, err = m.Find(gitwood.Hash{}); !errors.Is(err, gitwood.ErrMalformedShasum) {
+		t.Errorf("Find() of the zero Hash error = %v, want %v", err, gitwood.ErrMalformedShasum)
+	}
+}
+
+// TestPackStoreMultiPackIndex finds objects both in the packs covered by the multi-pack-index and in the pack that isn't.
+func TestPackStoreMultiPackIndex(t *testing.T) {
+	s := gitwood.NewPackStore("testdata/midx.git/objects/pack")
+	defer s.Close()
+	objects := readPackedObjects(t)
+	for sum, want := range objects {
+		p, off, err := s.Find(sum)
+		if err != nil {
+			t.Fatalf("Find(%v): %v", sum, err)
+		}
+		if p.Name != want.pack || off != want.off {
+			t.Errorf("Find(%v) = %v, %d, want %v, %d", sum, p.Name, off, want.pack, want.off)
+		}
+	}
+	if s.MultiPackIndex() == nil {
+		t.Error("MultiPackIndex() = nil")
+	}
+	repo, err := gitwood.Open("testdata/midx.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	repo.Verify = true
+	for sum := range objects {
+		if _, _, err = repo.Object(sum); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestParseMultiPackIndexMalformed(t *testing.T) {
+	golden := readMultiPackIndex(t)
+	// chunk returns the offset of the row of the chunk table with the given ID.
+	chunk := func(id string) int {
+		for off := 12; off < 12+12*int(golden[6]); off += 12 {
+			if string(golden[off:off+4]) == id {
+				return off
+			}
+		}
+		t.Fatalf("no %s chunk", id)
+		return 0
+	}
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+	}{
+		{"signature", func(data []byte) []byte { data[0] = 'X'; return data }},
+		{"version", func(data []byte) []byte { data[4] = 2; return data }},
+		{"object id version", func(data []byte) []byte { data[5] = 3; return data }},
+		{"incremental", func(data []byte) []byte { data[7] = 1; return data }},
+		{"header only", func(data []byte) []byte { return data[:12] }},
+		{"truncated chunk table", func(data []byte) []byte { data[6] = 200; return data }},
+		{"number of packs", func(data []byte) []byte { binary.BigEndian.PutUint32(data[8:], 3); return data }},
+		{"missing chunk", func(data []byte) []byte { copy(data[chunk("PNAM"):], "XNAM"); return data }},
+		{"chunk past the end", func(data []byte) []byte {
+			binary.BigEndian.PutUint64(data[chunk("OIDL")+4:], uint64(len(data)+1))
+			return data
+		}},
+		{"fanout", func(data []byte) []byte {
+			fanout := binary.BigEndian.Uint64(data[chunk("OIDF")+4:])
+			binary.BigEndian.PutUint32(data[fanout+4*255:], 0)
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.modify(append([]byte(nil), golden...))
+			if _, err := gitwood.ParseMultiPackIndex(data); !errors.Is(err, gitwood.ErrMalformedChunkFile) {
+				t.Errorf("ParseMultiPackIndex() error = %v, want %v", err, gitwood.ErrMalformedChunkFile)
+			}
+		})
+	}
+	data := append([]byte(nil), golden...)
+	data[7] = 1
+	if _, err := gitwood.ParseMultiPackIndex(data); err == nil || !strings.Contains(err.Error(), "incremental") {
+		t.Errorf("ParseMultiPackIndex() of an incremental multi-pack-index error = %v", err)
+	}
+}
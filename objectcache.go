@@ -0,0 +1,43 @@
+package gitwood
+
+// ObjectCache is a cache of objects, keyed by shasum.
+// If Repo.Cache is set, it is consulted on every object read, including the reads done internally
+// by e.g. WalkToPath and to resolve ref-deltas, and every object read from disk is added to it.
+// The data passed to Add is also returned to the caller that read the object,
+// so both the cache and its users must treat object data as read-only.
+// Implementations must be safe for concurrent use.
+type ObjectCache interface {
+	Get(shasum Hash) (ObjectType, []byte, bool)
+	Add(shasum Hash, otype ObjectType, data []byte)
+}
+
+// LRUObjectCache is an in-memory ObjectCache that holds at most a given number of bytes of object data,
+// evicting the least recently used objects first.
+type LRUObjectCache struct {
+	lru *lru[Hash]
+}
+
+// NewLRUObjectCache returns a cache that holds at most maxSize bytes of object data.
+func NewLRUObjectCache(maxSize int) *LRUObjectCache {
+	return &LRUObjectCache{lru: newLRU[Hash](maxSize)}
+}
+
+func (c *LRUObjectCache) Get(shasum Hash) (ObjectType, []byte, bool) {
+	return c.lru.get(shasum)
+}
+
+func (c *LRUObjectCache) Add(shasum Hash, otype ObjectType, data []byte) {
+	c.lru.add(shasum, otype, data)
+}
+
+// Len returns the number of objects in the cache.
+func (c *LRUObjectCache) Len() int {
+	n, _ := c.lru.len()
+	return n
+}
+
+// Size returns the number of bytes of object data in the cache.
+func (c *LRUObjectCache) Size() int {
+	_, size := c.lru.len()
+	return size
+}
@@ -0,0 +1,110 @@
+package gitwood_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// countingCache counts the hits and misses of an ObjectCache.
+type countingCache struct {
+	gitwood.ObjectCache
+	mu           sync.Mutex
+	hits, misses int
+}
+
+func (c *countingCache) Get(shasum gitwood.Hash) (gitwood.ObjectType, []byte, bool) {
+	otype, data, ok := c.ObjectCache.Get(shasum)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return otype, data, ok
+}
+
+func (c *countingCache) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func TestLRUObjectCache(t *testing.T) {
+	for name, opts := range map[string]gitwoodtest.Options{
+		"loose":      {},
+		"ofs-deltas": {Pack: true, Deltas: gitwoodtest.OfsDeltas},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := gitwoodtest.New()
+			blobs := []gitwood.Hash{b.Blob("one\n"), b.Blob("one\ntwo\n"), b.Blob("one\ntwo\nthree\n")}
+			repo := b.Repo(t, opts)
+			lru := gitwood.NewLRUObjectCache(1 << 20)
+			cache := &countingCache{ObjectCache: lru}
+			repo.Cache = cache
+			for _, sum := range blobs {
+				if _, _, err := repo.Object(sum); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hits, misses := cache.counts()
+			if misses != len(blobs) || lru.Len() != len(blobs) || lru.Size() != 4+8+14 {
+				t.Fatalf("after the first reads: %d hits, %d misses, %d objects of %d bytes cached", hits, misses, lru.Len(), lru.Size())
+			}
+			for _, sum := range blobs {
+				if _, _, err := repo.Object(sum); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if h, m := cache.counts(); h != hits+len(blobs) || m != misses {
+				t.Errorf("after reading again: %d hits, %d misses, want %d, %d", h, m, hits+len(blobs), misses)
+			}
+		})
+	}
+}
+
+func TestLRUObjectCacheEviction(t *testing.T) {
+	b := gitwoodtest.New()
+	one, two := b.Blob("1234"), b.Blob("5678")
+	repo := b.Repo(t, gitwoodtest.Options{})
+	lru := gitwood.NewLRUObjectCache(6)
+	repo.Cache = lru
+	for _, sum := range []gitwood.Hash{one, two} {
+		if _, _, err := repo.Object(sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok := lru.Get(one); ok {
+		t.Error("the least recently read object is still cached")
+	}
+	if _, data, ok := lru.Get(two); !ok || string(data) != "5678" {
+		t.Errorf("Get() = %q, %v for the last object read", data, ok)
+	}
+}
+
+func TestLRUObjectCacheConcurrent(t *testing.T) {
+	b := benchHistory(10)
+	repo := b.Repo(t, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas, MaxDeltaDepth: 10})
+	repo.Cache = gitwood.NewLRUObjectCache(64 << 10)
+	ids := b.ObjectIDs()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := range ids {
+				sum := ids[(i+g*37)%len(ids)]
+				_, o, err := repo.Object(sum)
+				_, want, _ := b.Content(sum)
+				if err != nil || string(o) != string(want) {
+					t.Errorf("Object(%v) = %d bytes, %v", sum, len(o), err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
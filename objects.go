@@ -3,103 +3,242 @@ package gitwood
 import (
 	"bufio"
 	"bytes"
-	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
-	"path/filepath"
-	"strings"
+	"strconv"
 )
 
 // TODO: Stop reading all bytes like this.
 // I think it's a trivial change to use a Reader everywhere instead,
 // and it's more efficient.
 func Decompress(b *bufio.Reader) ([]byte, error) {
-	r, err := zlib.NewReader(b)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create the reader: %w", err)
-	}
-	defer r.Close()
-	var buf bytes.Buffer
-	_, err = io.Copy(bufio.NewWriter(&buf), r)
-	return buf.Bytes(), err
+	return inflate(b, 0)
 }
 
-func (r *Repo) searchAllPacks(shasum string) (ObjectType, []byte, error) {
-	packdir := path.Join(r.GitDir, "objects", "pack")
-	dir, err := os.ReadDir(packdir)
-	if err != nil {
-		return OBJ_INVALID, nil, err
-	}
-	var packfile string
-	var index int64
-	// First find the pack in the index file
-	for _, entry := range dir {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".idx") {
-			index, err = SearchPackIDX(filepath.Join(packdir, entry.Name()), shasum)
-			// Some error occurred, but keep trying other packs, if any
-			if err != nil {
-				continue
+func (r *Repo) searchAllPacks(shasum Hash) (ObjectType, []byte, error) {
+	dirs, done := r.objectDirs()
+	defer done()
+	return r.readPacked(dirs, shasum, true)
+}
+
+// readPacked reads the object with the given binary shasum from the first pack that has it,
+// searching the packs of all the given objects directories.
+// If rescan is set and the object isn't found, the directories are scanned for new packs before giving up.
+func (r *Repo) readPacked(dirs []*objectDir, sha Hash, rescan bool) (ObjectType, []byte, error) {
+	// A pack can be removed by a concurrent rescan between finding the object and reading it.
+	// If that happens, the object should be found in another pack on the second attempt.
+	for attempt := 0; ; attempt++ {
+		pack, off, err := findPacked(dirs, sha, rescan)
+		if err != nil {
+			return OBJ_INVALID, nil, err
+		}
+		otype, o, err := r.readFromPack(pack, off)
+		if errors.Is(err, os.ErrClosed) && attempt == 0 {
+			continue
+		}
+		if err == nil && r.Verify {
+			if herr := r.checkHash(sha, otype, o); herr != nil {
+				err = &CorruptObjectError{Path: packFileName(pack), Offset: int64(off), Err: herr}
 			}
-			if index >= 0 {
-				packfile = strings.Replace(entry.Name(), ".idx", ".pack", 1)
-				break
+		}
+		if err != nil {
+			var corrupt *CorruptObjectError
+			if errors.As(err, &corrupt) && corrupt.ShaSum.IsZero() {
+				corrupt.ShaSum = sha
 			}
+			return OBJ_INVALID, nil, fmt.Errorf("failed to read pack %v: %w", pack.Name, err)
 		}
+		return otype, o, nil
 	}
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("error when searching packs: %w", err)
-	}
-	if packfile == "" {
-		return OBJ_INVALID, nil, ErrObjectNotFound
+}
+
+func findPacked(dirs []*objectDir, sha Hash, rescan bool) (*Pack, uint64, error) {
+	// Search all packs before rescanning any directory,
+	// since objects are often found in an alternate without any rescan.
+	for _, d := range dirs {
+		pack, off, err := d.packs.lookup(sha, false)
+		if pack != nil || err != nil {
+			return pack, off, err
+		}
 	}
-	otype, o, err := r.OpenAndReadFromPack(filepath.Join(packdir, packfile), uint64(index))
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("failed to read pack %v: %w", packfile, err)
+	if rescan {
+		for _, d := range dirs {
+			pack, off, err := d.packs.lookup(sha, true)
+			if pack != nil || err != nil {
+				return pack, off, err
+			}
+		}
 	}
-	return otype, o, nil
+	return nil, 0, ErrObjectNotFound
 }
 
 // Optimization (here and everywhere): Use Readers instead of reading and returning the entire object
 
 // openObject returns the object type and object data referenced by the given shasum,
-// or an error if it doesn't exist.
-func (r *Repo) openObject(shasum string) (ObjectType, []byte, error) {
-	if len(shasum) != 40 {
+// or an error if it doesn't exist. The repo's ObjectCache is used, if it has one.
+func (r *Repo) openObject(shasum Hash) (ObjectType, []byte, error) {
+	if shasum.Size() == 0 {
+		return OBJ_INVALID, nil, ErrObjectNotFound
+	}
+	if shasum.Size() != r.hashSize() {
 		return OBJ_INVALID, nil, ErrMalformedShasum
 	}
-	file, err := os.Open(path.Join(r.GitDir, "objects", shasum[:2], shasum[2:]))
+	if r.Cache == nil {
+		return r.readObject(shasum)
+	}
+	if otype, o, ok := r.Cache.Get(shasum); ok {
+		return otype, o, nil
+	}
+	otype, o, err := r.readObject(shasum)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+		return OBJ_INVALID, nil, err
+	}
+	r.Cache.Add(shasum, otype, o)
+	return otype, o, nil
+}
+
+// readObject reads the object with the given shasum from the packs or loose objects.
+func (r *Repo) readObject(shasum Hash) (ObjectType, []byte, error) {
+	dirs, done := r.objectDirs()
+	defer done()
+	// Like git, look in the packs first, then for loose objects,
+	// and finally in packs that may have been added since the last lookup.
+	otype, o, err := r.readPacked(dirs, shasum, false)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return otype, o, err
+	}
+	hexsum := shasum.String()
+	for _, d := range dirs {
+		name := path.Join(d.path, hexsum[:2], hexsum[2:])
+		otype, o, err = readLooseObject(r.storage(), name, r.Verify)
+		if err == nil && r.Verify {
+			if herr := r.checkHash(shasum, otype, o); herr != nil {
+				err = &CorruptObjectError{Path: name, Offset: -1, Err: herr}
+			}
+		}
+		var corrupt *CorruptObjectError
+		if errors.As(err, &corrupt) {
+			corrupt.ShaSum = shasum
 			return OBJ_INVALID, nil, err
 		}
-		return r.searchAllPacks(shasum)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return otype, o, err
+		}
+	}
+	return r.readPacked(dirs, shasum, true)
+}
+
+// objectSize returns the size of the object with the given shasum, like `git cat-file -s`.
+// Only headers are read: that of the loose object, or the entry header of the packed object,
+// or for deltas the header of the delta. Objects in the repo's ObjectCache aren't read at all.
+func (r *Repo) objectSize(shasum Hash) (uint64, error) {
+	if shasum.Size() != r.hashSize() {
+		return 0, ErrMalformedShasum
+	}
+	if r.Cache != nil {
+		if _, o, ok := r.Cache.Get(shasum); ok {
+			return uint64(len(o)), nil
+		}
+	}
+	dirs, done := r.objectDirs()
+	defer done()
+	// The objects are looked up in the same order as in readObject.
+	size, err := r.packedSize(dirs, shasum, false)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return size, err
+	}
+	hexsum := shasum.String()
+	for _, d := range dirs {
+		_, size, err = readLooseHeader(r.storage(), path.Join(d.path, hexsum[:2], hexsum[2:]))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return size, err
+		}
+	}
+	return r.packedSize(dirs, shasum, true)
+}
+
+// packedSize returns the size of the object with the given shasum from the first pack that has it, like readPacked.
+func (r *Repo) packedSize(dirs []*objectDir, sha Hash, rescan bool) (uint64, error) {
+	for attempt := 0; ; attempt++ {
+		pack, off, err := findPacked(dirs, sha, rescan)
+		if err != nil {
+			return 0, err
+		}
+		size, err := r.packEntrySize(pack, off)
+		if errors.Is(err, os.ErrClosed) && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read pack %v: %w", pack.Name, err)
+		}
+		return size, nil
+	}
+}
+
+// readLooseObject reads the loose object file with the given name.
+// If verify is set, the size in the object header is checked, and errors in the file's content
+// are returned as a CorruptObjectError without the object ID.
+func readLooseObject(fsys fs.FS, name string, verify bool) (ObjectType, []byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return OBJ_INVALID, nil, err
 	}
 	defer file.Close()
-	c, err := Decompress(bufio.NewReader(file))
+	buf := getBufReader(file)
+	defer putBufReader(buf)
+	otype, o, err := parseLooseObject(buf, verify)
+	if err != nil && verify {
+		return OBJ_INVALID, nil, &CorruptObjectError{Path: name, Offset: -1, Err: err}
+	}
+	return otype, o, err
+}
+
+// parseLooseObject inflates a loose object and parses its "<type> <size>\0" header.
+// The header is inflated first, so that the buffer for the content can be allocated with the right size.
+func parseLooseObject(r io.Reader, verify bool) (ObjectType, []byte, error) {
+	zr, err := getZlibReader(r)
 	if err != nil {
+		return OBJ_INVALID, nil, fmt.Errorf("failed to create the reader: %w", err)
+	}
+	defer putZlibReader(zr)
+	// The longest header is "commit " and a 20 digit size.
+	var header [32]byte
+	var n int
+	for n < len(header) && err == nil {
+		var m int
+		m, err = zr.Read(header[n:])
+		n += m
+	}
+	// Small objects fit in the header buffer.
+	ended := err == io.EOF
+	if err != nil && !ended {
 		return OBJ_INVALID, nil, err
 	}
-	var otype string
-	var i int
-	for i = range c {
-		if c[i] == CHAR_SPACE {
-			i++
-			break
-		}
-		otype += string(c[i])
-		if i >= len(c)-1 {
-			return OBJ_INVALID, nil, ErrMalformedObject
-		}
+	nul := bytes.IndexByte(header[:n], 0)
+	if nul < 0 {
+		return OBJ_INVALID, nil, ErrMalformedObject
 	}
-	// Skip size
-	for c[i] != 0 {
-		if i >= len(c)-1 {
-			return OBJ_INVALID, nil, ErrMalformedObject
+	sp := bytes.IndexByte(header[:nul], CHAR_SPACE)
+	if sp < 0 {
+		return OBJ_INVALID, nil, ErrMalformedObject
+	}
+	size, serr := strconv.ParseUint(string(header[sp+1:nul]), 10, 64)
+	// The size is only needed to check the object, and otherwise just a hint.
+	if serr != nil && verify {
+		return OBJ_INVALID, nil, fmt.Errorf("%w: bad size in header", ErrMalformedObject)
+	}
+	o := append(makeBuffer(size), header[nul+1:n]...)
+	if !ended {
+		if o, err = readAll(zr, o); err != nil {
+			return OBJ_INVALID, nil, err
 		}
-		i++
 	}
-	return ObjectTypeFromString(otype), c[i+1:], nil
+	if verify && size != uint64(len(o)) {
+		return OBJ_INVALID, nil, fmt.Errorf("header declares %d bytes, inflated to %d", size, len(o))
+	}
+	return ObjectTypeFromString(string(header[:sp])), o, nil
 }
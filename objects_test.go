@@ -0,0 +1,118 @@
+package gitwood_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// benchHistory returns a builder with a history of the given number of commits, that each change a few of many files.
+func benchHistory(commits int) *gitwoodtest.Builder {
+	b := gitwoodtest.New()
+	files := map[string]string{}
+	var parents []gitwood.Hash
+	for i := 0; i < commits; i++ {
+		for j := 0; j < 5; j++ {
+			name := fmt.Sprintf("dir%d/file%d.txt", (i+j)%7, (i*5+j)%40)
+			files[name] = strings.Repeat(fmt.Sprintf("line of %s\n", name), 50) + fmt.Sprintf("changed in commit %d\n", i)
+		}
+		commit := b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(files), Parents: parents, Message: fmt.Sprintf("commit %d\n", i)})
+		parents = []gitwood.Hash{commit}
+	}
+	b.Ref("refs/heads/main", parents[0])
+	return b
+}
+
+// benchmarkRead reads every object of the builder with Repo.Object and no cache.
+func benchmarkRead(b *testing.B, opts gitwoodtest.Options) {
+	builder := benchHistory(50)
+	repo := builder.Repo(b, opts)
+	ids := builder.ObjectIDs()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sum := range ids {
+			if _, _, err := repo.Object(sum); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(len(ids)), "objects/op")
+}
+
+func BenchmarkReadLoose(b *testing.B) {
+	benchmarkRead(b, gitwoodtest.Options{})
+}
+
+func BenchmarkReadPacked(b *testing.B) {
+	b.Run("no-deltas", func(b *testing.B) {
+		benchmarkRead(b, gitwoodtest.Options{Pack: true})
+	})
+	b.Run("ofs-deltas", func(b *testing.B) {
+		benchmarkRead(b, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas})
+	})
+	b.Run("ref-deltas", func(b *testing.B) {
+		benchmarkRead(b, gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.RefDeltas})
+	})
+}
+
+// TestReadLargeObject reads objects larger than the buffers that are allocated up front from object headers,
+// which must grow as the objects are inflated.
+func TestReadLargeObject(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large objects in short mode")
+	}
+	b := gitwoodtest.New()
+	big := bytes.Repeat([]byte("0123456789abcdef"), (64<<20)/16+4097)
+	sum := b.Object(gitwood.OBJ_BLOB, big)
+	// The second blob is a delta against the first in packs with deltas, with a target larger than the cap too.
+	bigger := append(append([]byte(nil), big...), "the end\n"...)
+	sum2 := b.Object(gitwood.OBJ_BLOB, bigger)
+	for name, opts := range map[string]gitwoodtest.Options{
+		"loose":      {},
+		"pack":       {Pack: true},
+		"ofs-deltas": {Pack: true, Deltas: gitwoodtest.OfsDeltas},
+	} {
+		t.Run(name, func(t *testing.T) {
+			repo := b.Repo(t, opts)
+			for _, want := range []struct {
+				sum  gitwood.Hash
+				data []byte
+			}{{sum, big}, {sum2, bigger}} {
+				_, o, err := repo.Object(want.sum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(o, want.data) {
+					t.Errorf("Object(%v) returned %d bytes, want %d", want.sum, len(o), len(want.data))
+				}
+			}
+		})
+	}
+}
+
+// TestNullID checks that only the zero Hash reads HEAD, and that git's ID of only zeros is just a missing object.
+func TestNullID(t *testing.T) {
+	b := gitwoodtest.New()
+	head := b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(map[string]string{"README": "hello\n"}), Message: "initial\n"})
+	b.Ref("refs/heads/main", head)
+	repo := b.Repo(t, gitwoodtest.Options{})
+	if _, o, err := repo.Object(gitwood.Hash{}); err != nil || !bytes.Contains(o, []byte("initial\n")) {
+		t.Errorf("Object() of the zero Hash = %q, %v, want the HEAD commit", o, err)
+	}
+	null := gitwood.MustParseHash(strings.Repeat("0", 2*gitwood.SHA1Size))
+	if _, _, err := repo.Object(null); !errors.Is(err, gitwood.ErrObjectNotFound) {
+		t.Errorf("Object(%v) error = %v, want %v", null, err, gitwood.ErrObjectNotFound)
+	}
+	if _, err := repo.Log(null); !errors.Is(err, gitwood.ErrObjectNotFound) {
+		t.Errorf("Log(%v) error = %v, want %v", null, err, gitwood.ErrObjectNotFound)
+	}
+	if _, _, err := repo.WalkToPath(null, "README", nil); !errors.Is(err, gitwood.ErrObjectNotFound) {
+		t.Errorf("WalkToPath(%v) error = %v, want %v", null, err, gitwood.ErrObjectNotFound)
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 )
 
@@ -29,21 +29,21 @@ func Unpack(r io.Reader) error {
 }
 
 type PackIndex struct {
-	ShaSum string
+	ShaSum Hash
 	Offset uint32
 }
 
-func PackIDX(file *os.File) ([]PackIndex, error) {
-	// Assume version 2
-	_, err := file.Seek(8, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
+// PackIDX reads the entries of a pack idx file.
+// The file is read with ReadAt, so reading it doesn't move the file offset of an *os.File.
+func PackIDX(file io.ReaderAt) ([]PackIndex, error) {
+	// Assume version 2 and SHA-1
+	r := io.NewSectionReader(file, 8, math.MaxInt64-8)
+	var err error
 	// Fanout table
 	var fanout [256]uint32
 	buf := make([]byte, 4)
 	for i := 0; i < 256; i++ {
-		_, err = file.Read(buf)
+		_, err = io.ReadFull(r, buf)
 		if err != nil {
 			return nil, err
 		}
@@ -53,21 +53,21 @@ func PackIDX(file *os.File) ([]PackIndex, error) {
 	entries := make([]PackIndex, numEntries)
 	buf = make([]byte, 20)
 	for i := range entries {
-		_, err = file.Read(buf)
+		_, err = io.ReadFull(r, buf)
 		if err != nil {
 			return nil, err
 		}
-		entries[i] = PackIndex{ShaSum: hex.EncodeToString(buf)}
+		entries[i] = PackIndex{ShaSum: hashFromBytes(buf)}
 	}
 	// Skip CRC for now ;)
-	_, err = file.Seek(int64(numEntries*4), io.SeekCurrent)
+	_, err = r.Seek(int64(numEntries*4), io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
 	// Get offsets
 	buf = make([]byte, 4)
 	for i := range entries {
-		_, err = file.Read(buf)
+		_, err = io.ReadFull(r, buf)
 		if err != nil {
 			return nil, err
 		}
@@ -78,61 +78,32 @@ func PackIDX(file *os.File) ([]PackIndex, error) {
 
 const (
 	offsetFanout     = 8
-	offsetFanoutSize = 8 + 4*255
 	offsetShaListing = 8 + 4*256
 )
 
-// SearchPackIDX finds the index of the given shasum in the given pack idx file, if present.
+// SearchPackIDX finds the pack offset of the given shasum in the given pack idx file, if present.
 // Returns -1 if no object with the givein shasum could be found.
-func SearchPackIDX(idxfile, shasum string) (int64, error) {
-	file, err := os.Open(idxfile)
-	if err != nil {
-		return -1, err
+func SearchPackIDX(idxfile string, shasum Hash) (int64, error) {
+	if shasum.Size() != SHA1Size {
+		return -1, ErrMalformedShasum
 	}
-	defer file.Close()
-	ss, err := hex.DecodeString(shasum)
-	if err != nil {
-		return -1, err
-	}
-	fanoutIndex := int64(ss[0])
-	// Assume version 2 (skip first 8 bytes), and look up the shasum in the fanout table
-	buf := make([]byte, 4)
-	_, err = file.ReadAt(buf, offsetFanout+4*fanoutIndex)
+	data, err := os.ReadFile(idxfile)
 	if err != nil {
 		return -1, err
 	}
-	shaOffset := binary.BigEndian.Uint32(buf)
-	var numEntries int64
-	_, err = file.ReadAt(buf, offsetFanoutSize)
+	idx, err := parsePackIndex(data, shasum.Size())
 	if err != nil {
 		return -1, err
 	}
-	numEntries = int64(binary.BigEndian.Uint32(buf))
-
-	buf = make([]byte, 20)
-	var i int64
-	// Simple O(n)-search, can optimize with binary search later
-	for i = int64(shaOffset - 1); i >= 0; i-- {
-		// Skip to the sha listing and offset according to entry currently being checked
-		_, err = file.ReadAt(buf, offsetShaListing+20*i)
-		if err != nil {
-			return -1, err
-		}
-		if buf[0] != ss[0] {
-			// All entries with matching first byte are checked - no match
-			return -1, nil
-		}
-		if hex.EncodeToString(buf) == shasum {
-			break
-		}
+	i, ok := idx.find(shasum.Bytes())
+	if !ok {
+		return -1, nil
 	}
-	buf = make([]byte, 4)
-	offsetPackfileOffsets := int64(offsetShaListing + 20*numEntries /* (sha listing) */ + 4*numEntries /* (crc) */)
-	_, err = file.ReadAt(buf, offsetPackfileOffsets+4*i)
+	off, err := idx.offset(i)
 	if err != nil {
 		return -1, err
 	}
-	return int64(binary.BigEndian.Uint32(buf)), nil
+	return int64(off), nil
 }
 
 type ObjectType uint8
@@ -236,41 +207,87 @@ func gitOffsetVarint(r io.ByteReader) (uint64, uint64, error) {
 	return (x >> ((binary.MaxVarintLen64 - n - 1) * 7)) + a, n, nil
 }
 
-// uvarint is a copy of binary.Uvarint, but it returns the number of bytes read.
-func uvarint(r io.ByteReader) (uint64, uint64, error) {
-	var (
-		x uint64
-		s uint
-		n uint64
-	)
-	for n < binary.MaxVarintLen64 {
-		b, err := r.ReadByte()
-		if err != nil {
-			if n > 0 && err == io.EOF {
-				err = io.ErrUnexpectedEOF
-			}
-			return x, 0, err
+// readObjectHeader reads the type and size of a pack entry, and returns the number of bytes read.
+func readObjectHeader(buf io.ByteReader) (ObjectType, uint64, uint64, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return OBJ_INVALID, 0, 0, err
+	}
+	n := uint64(1)
+	otype := typeByte(b)
+	osize := uint64(b & 0b1111)
+	// Can't use standard uvarint (directly) here,
+	// because the LSBs are given by the four LSBs of the first byte (the byte is "shared" with the type bits).
+	sizeOff := uint64(4)
+	for hasMore(b) {
+		if sizeOff > 64-7 {
+			return OBJ_INVALID, 0, n, errOverflow
 		}
+		b, err = buf.ReadByte()
 		n++
-		if b < 0x80 {
-			if n == binary.MaxVarintLen64-1 && b > 1 {
-				return x, n, errOverflow
-			}
-			return x | uint64(b)<<s, n, nil
+		if err != nil {
+			return OBJ_INVALID, 0, n, err
 		}
-		x |= uint64(b&0x7f) << s
-		s += 7
+		osize |= uint64(b&0b0111_1111) << sizeOff
+		sizeOff += 7
 	}
-	return x, n, errOverflow
+	return otype, osize, n, nil
+}
+
+// maxEntryHeaderSize is the most bytes the header of a pack entry can take up:
+// a type and size of up to 10 bytes, followed by a delta base offset of up to 10 bytes or a delta base ID.
+const maxEntryHeaderSize = 10 + SHA256Size
+
+// entryHeader is the header of a pack entry, including the reference to the base of a delta.
+type entryHeader struct {
+	otype ObjectType
+	// size is the size of the inflated data, which for deltas is the size of the delta.
+	size uint64
+	// baseOff is the offset of the base of an ofs-delta, and baseSum the ID of the base of a ref-delta.
+	baseOff uint64
+	baseSum Hash
+	// dataOff is the offset of the compressed data.
+	dataOff uint64
 }
 
-// There may be other ways, but it seems safer to create a new buffer every time the offset changes.
-func newBufReader(file *os.File, off uint64) (*bufio.Reader, error) {
-	_, err := file.Seek(int64(off), io.SeekStart)
+// readEntry reads the header of the pack entry at the given offset.
+// Only ReadAt is used, so entries can be read from the same file concurrently.
+func readEntry(file io.ReaderAt, off uint64, hashSize int) (entryHeader, error) {
+	if off > math.MaxInt64 {
+		return entryHeader{}, fmt.Errorf("pack offset %d out of range", off)
+	}
+	var b [maxEntryHeaderSize]byte
+	n, err := file.ReadAt(b[:], int64(off))
+	// Entries at the end of the pack can be shorter than the buffer.
+	if err != nil && !errors.Is(err, io.EOF) {
+		return entryHeader{}, err
+	}
+	buf := bytes.NewReader(b[:n])
+	var h entryHeader
+	h.otype, h.size, _, err = readObjectHeader(buf)
 	if err != nil {
-		return nil, err
+		return h, fmt.Errorf("failed to read object header: %w", err)
+	}
+	switch h.otype {
+	case OBJ_OFS_DELTA:
+		dist, _, err := gitOffsetVarint(buf)
+		if err != nil {
+			return h, fmt.Errorf("failed to read ofs-delta offset: %w", err)
+		}
+		// The base must come before the delta.
+		if dist == 0 || dist > off {
+			return h, fmt.Errorf("ofs-delta at offset %d has invalid base offset %d", off, dist)
+		}
+		h.baseOff = off - dist
+	case OBJ_REF_DELTA:
+		sum := make([]byte, hashSize)
+		if _, err = io.ReadFull(buf, sum); err != nil {
+			return h, fmt.Errorf("failed to read ref-delta shasum: %w", err)
+		}
+		h.baseSum = hashFromBytes(sum)
 	}
-	return bufio.NewReader(file), nil
+	h.dataOff = off + uint64(n-buf.Len())
+	return h, nil
 }
 
 func (r *Repo) OpenAndReadFromPack(packfile string, off uint64) (ObjectType, []byte, error) {
@@ -286,175 +303,140 @@ func (r *Repo) OpenAndReadFromPack(packfile string, off uint64) (ObjectType, []b
 	return otype, o, err
 }
 
-// o is the current read offset in the file.
-// This must be maintained manually, because buffers are used to read from the file.
-func (r *Repo) readFromPack(file *os.File, off uint64) (ObjectType, []byte, error) {
-	// Original offset
-	oOff := off
-	buf, err := newBufReader(file, off)
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("failed to create buf reader: %w", err)
-	}
-	b, err := buf.ReadByte()
-	off++
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("failed to read byte: %w", err)
-	}
-	otype := typeByte(b)
-	osize := uint64(b & 0b1111)
-	// Can't use standard uvarint (directly) here,
-	// because the LSBs are given by the four LSBs of the first byte (the byte is "shared" with the type bits).
-	sizeOff := uint64(4)
-	for hasMore(b) {
-		b, err = buf.ReadByte()
-		off++
-		if err != nil {
+// readFromPack reads the object at the given offset, resolving deltas against their base.
+// The file is only read with ReadAt, so a pack can be shared by any number of goroutines.
+func (r *Repo) readFromPack(file io.ReaderAt, off uint64) (ObjectType, []byte, error) {
+	c, l := newDeltaChain(r, file, off)
+	defer c.close()
+	// Follow the chain down to a base that isn't a delta, or that is cached.
+	var otype ObjectType
+	var o []byte
+	for {
+		if len(c.links) > 0 {
+			var ok bool
+			if otype, o, ok = r.cachedBase(l); ok {
+				break
+			}
+		}
+		var err error
+		if l, err = c.read(l); err != nil {
+			return OBJ_INVALID, nil, err
+		}
+		if l.h.otype != OBJ_OFS_DELTA && l.h.otype != OBJ_REF_DELTA {
+			otype = l.h.otype
+			o, err = inflateAt(l.file, l.h.dataOff, l.h.size)
+			if err == nil {
+				err = r.checkSize(l.h.size, o)
+			}
+			if err != nil {
+				return otype, nil, r.corrupt(l.file, l.off, err)
+			}
+			if len(c.links) > 0 {
+				if err = r.addBase(l, otype, o); err != nil {
+					return OBJ_INVALID, nil, err
+				}
+			}
+			break
+		}
+		if l, err = c.next(l); err != nil {
 			return OBJ_INVALID, nil, err
 		}
-		osize |= uint64(b&0b0111_1111) << sizeOff
-		sizeOff += 7
 	}
-	if otype == OBJ_OFS_DELTA || otype == OBJ_REF_DELTA {
-		var botype ObjectType
-		var bo []byte
-		if otype == OBJ_OFS_DELTA {
-			buf, botype, bo, err = r.getOfsDeltaBase(file, buf, oOff, off)
-		} else if otype == OBJ_REF_DELTA {
-			botype, bo, err = r.getRefDeltaBase(file, buf, off)
+	// Apply the deltas from the base up.
+	for i := len(c.links) - 1; i >= 0; i-- {
+		l := c.links[i]
+		delta, err := inflateAt(l.file, l.h.dataOff, l.h.size)
+		if err == nil {
+			err = r.checkSize(l.h.size, delta)
 		}
 		if err != nil {
-			return OBJ_INVALID, nil, fmt.Errorf("delta extraction failed: %w", err)
+			return l.h.otype, nil, r.corrupt(l.file, l.off, fmt.Errorf("failed to decompress delta data: %w", err))
 		}
-		deltaData, err := Decompress(buf)
-		if err != nil {
-			return otype, nil, fmt.Errorf("failed to decompress delta data: %w", err)
+		if o, err = ApplyDelta(o, delta); err != nil {
+			return OBJ_INVALID, nil, r.corrupt(l.file, l.off, fmt.Errorf("failed to apply delta: %w", err))
 		}
-		// Now apply the delta
-		o, err := r.applyDelta(bo, deltaData)
-		if err != nil {
-			return OBJ_INVALID, nil, fmt.Errorf("failed to apply delta: %w", err)
+		if i > 0 {
+			if err = r.addBase(l, otype, o); err != nil {
+				return OBJ_INVALID, nil, err
+			}
 		}
-		return botype, o, err
-	}
-	o, err := Decompress(buf)
-	if err != nil {
-		return otype, nil, err
 	}
 	return otype, o, nil
 }
 
-func (r *Repo) getOfsDeltaBase(file *os.File, buf *bufio.Reader, oOff, off uint64) (*bufio.Reader, ObjectType, []byte, error) {
-	bOff, num, err := gitOffsetVarint(buf)
-	off += num
+// packEntrySize returns the size of the object in the pack entry at the given offset.
+// For deltas, that's the target size in the delta header, so only the start of the delta is inflated.
+func (r *Repo) packEntrySize(file io.ReaderAt, off uint64) (uint64, error) {
+	h, err := readEntry(file, off, r.hashSize())
 	if err != nil {
-		return nil, OBJ_INVALID, nil, fmt.Errorf("failed to read ofs-delta offset: %w", err)
+		return 0, err
 	}
-	if err != nil {
-		return nil, OBJ_INVALID, nil, fmt.Errorf("failed to read ofs-delta moff: %w", err)
+	if h.otype != OBJ_OFS_DELTA && h.otype != OBJ_REF_DELTA {
+		return h.size, nil
 	}
-	otype, o, err := r.readFromPack(file, oOff-bOff)
+	// The delta header is the base size and the target size.
+	var header [2 * binary.MaxVarintLen64]byte
+	n, err := inflateHeaderAt(file, h.dataOff, header[:])
 	if err != nil {
-		return nil, OBJ_INVALID, nil, fmt.Errorf("failed to read delta base object: %w", err)
+		return 0, r.corrupt(file, off, fmt.Errorf("failed to decompress delta data: %w", err))
 	}
-	if otype == OBJ_OFS_DELTA || otype == OBJ_REF_DELTA {
-		return nil, OBJ_INVALID, nil, fmt.Errorf("delta extraction returned a delta object")
+	_, m := binary.Uvarint(header[:n])
+	if m <= 0 {
+		return 0, r.corrupt(file, off, deltaError(0, "bad base size"))
 	}
-	// Create new buffer to "reset the offset".
-	// This is necessary because the delta base object is read from the same file,
-	// i.e. readFromPack will affect the offset of the current file.
-	buf, err = newBufReader(file, off)
-	if err != nil {
-		return nil, OBJ_INVALID, nil, fmt.Errorf("failed to create new buffer for delta: %w", err)
+	size, k := binary.Uvarint(header[m:n])
+	if k <= 0 {
+		return 0, r.corrupt(file, off, deltaError(m, "bad target size"))
 	}
-	return buf, otype, o, nil
+	return size, nil
 }
 
-func (r *Repo) getRefDeltaBase(file *os.File, buf *bufio.Reader, off uint64) (ObjectType, []byte, error) {
-	var shasum [20]byte
-	num, err := buf.Read(shasum[:])
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("failed to read ref-delta shasum: %w", err)
-	}
-	off += uint64(num)
-	// Optimization: All deltas refer to objects in the same pack,
-	// so there's no need to search all packs.
-	// From git docs:
-	// > When stored on disk (however), the pack should be self contained to avoid cyclic dependency.
-	otype, o, err := r.searchAllPacks(hex.EncodeToString(shasum[:]))
-	if err != nil {
-		return OBJ_INVALID, nil, fmt.Errorf("failed to read delta shasum: %w", err)
+// checkSize returns an error if the repo verifies objects and the inflated data doesn't have the size from the entry header.
+func (r *Repo) checkSize(size uint64, data []byte) error {
+	if r.Verify && uint64(len(data)) != size {
+		return fmt.Errorf("entry header declares %d bytes, inflated to %d", size, len(data))
 	}
-	if otype == OBJ_OFS_DELTA || otype == OBJ_REF_DELTA {
-		return OBJ_INVALID, nil, fmt.Errorf("delta extraction returned a delta object")
-	}
-	return otype, o, nil
+	return nil
 }
 
-func deltaCopy(target *[]byte, base []byte, deltaData []byte, inst byte) (uint64, error) {
-	const offsetBits = 4
-	const sizeBits = 3
-	var num uint64
-	var offset uint32
-	testbit := byte(0b_000_0001)
-	for i := 0; i < offsetBits; i++ {
-		if inst&(testbit<<i) == 0 {
-			continue
-		}
-		offset |= uint32(deltaData[num]) << (i * 8)
-		num++
-	}
-	var size uint32
-	testbit = byte(0b_001_0000)
-	for i := 0; i < sizeBits; i++ {
-		if inst&(testbit<<i) == 0 {
-			continue
-		}
-		size |= uint32(deltaData[num]) << (i * 8)
-		num++
+// corrupt wraps an error reading the pack entry at the given offset in a CorruptObjectError, if the repo verifies objects.
+// The ID of the object is filled in by the caller that knows it.
+func (r *Repo) corrupt(file io.ReaderAt, off uint64, err error) error {
+	if !r.Verify {
+		return err
 	}
-	*target = append(*target, base[offset:offset+size]...)
-	return num, nil
+	return &CorruptObjectError{Path: packFileName(file), Offset: int64(off), Err: err}
 }
 
-func deltaInsert(target *[]byte, deltaData []byte, inst byte) (uint64, error) {
-	num := uint8(inst)
-	if uint8(len(deltaData)) < num {
-		return 0, fmt.Errorf("delta insert: not enough insert data")
+// cachedBase returns a delta base from the repo's caches: the ObjectCache for ref-delta bases, which are known by ID,
+// or the DeltaBaseCache.
+func (r *Repo) cachedBase(l deltaLink) (ObjectType, []byte, bool) {
+	if !l.sum.IsZero() && r.Cache != nil {
+		if otype, o, ok := r.Cache.Get(l.sum); ok {
+			return otype, o, true
+		}
 	}
-	*target = append(*target, deltaData[:num]...)
-	return uint64(num), nil
+	if r.DeltaBaseCache != nil {
+		return r.DeltaBaseCache.get(l.file, l.off)
+	}
+	return OBJ_INVALID, nil, false
 }
 
-func (r *Repo) applyDelta(base, deltaData []byte) ([]byte, error) {
-	var target []byte
-	var n, off uint64
-	var err error
-	buf := bytes.NewBuffer(deltaData)
-	// base size
-	_, n, err = uvarint(buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read base size: %w", err)
-	}
-	off += n
-	// target size
-	_, n, err = uvarint(buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read target size: %w", err)
-	}
-	off += n
-	for off < uint64(len(deltaData)) {
-		// Get the instruction byte
-		b := deltaData[off]
-		off++
-		if b&0b1000_0000 > 0 {
-			n, err = deltaCopy(&target, base, deltaData[off:], b)
-		} else {
-			n, err = deltaInsert(&target, deltaData[off:], b)
+// addBase adds a resolved delta base to the repo's caches.
+// Ref-delta bases are known by their ID, so they're checked first if the repo verifies objects.
+func (r *Repo) addBase(l deltaLink, otype ObjectType, o []byte) error {
+	if !l.sum.IsZero() {
+		if r.Verify {
+			if err := r.checkHash(l.sum, otype, o); err != nil {
+				return &CorruptObjectError{ShaSum: l.sum, Path: packFileName(l.file), Offset: int64(l.off), Err: err}
+			}
 		}
-		if err != nil {
-			return nil, fmt.Errorf("delta instruction failed: %w", err)
+		if r.Cache != nil {
+			r.Cache.Add(l.sum, otype, o)
 		}
-		off += n
 	}
-	return target, nil
+	if r.DeltaBaseCache != nil {
+		r.DeltaBaseCache.add(l.file, l.off, otype, o)
+	}
+	return nil
 }
@@ -0,0 +1,545 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var idxSignature = []byte{0xff, 't', 'O', 'c'}
+
+// Object format IDs of idx v3 files.
+const (
+	idxFormatSHA1   = 0x73686131 // sha1
+	idxFormatSHA256 = 0x73323536 // s256
+)
+
+// packIndex is a parsed version 2 or 3 pack idx file.
+// The tables of version 2 files are slices into the raw file data, which is kept in memory.
+type packIndex struct {
+	fanout  [256]uint32
+	shas    []byte
+	offsets []byte
+	large   []byte
+	// packChecksum is the checksum of the pack file the index belongs to.
+	packChecksum []byte
+	hashSize     int
+}
+
+// parsePackIndex parses an idx file of a pack with object IDs of the given size.
+func parsePackIndex(data []byte, hashSize int) (*packIndex, error) {
+	if len(data) < 8 || !bytes.Equal(data[:4], idxSignature) {
+		return nil, fmt.Errorf("%w: not a version 2 or 3 idx file", ErrMalformedPackIndex)
+	}
+	switch v := binary.BigEndian.Uint32(data[4:8]); v {
+	case 2:
+		return parsePackIndexV2(data, hashSize)
+	case 3:
+		return parsePackIndexV3(data, hashSize)
+	default:
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedPackIndex, v)
+	}
+}
+
+// parsePackIndexV2 parses a version 2 idx file, see https://git-scm.com/docs/gitformat-pack:
+//
+//	header: signature, version
+//	fanout table: 256 * 4 byte object counts
+//	tables: sorted object IDs, CRC32s, 4 byte offsets, 8 byte offsets
+//	trailer: pack checksum, checksum
+func parsePackIndexV2(data []byte, hashSize int) (*packIndex, error) {
+	if len(data) < offsetShaListing {
+		return nil, fmt.Errorf("%w: file is truncated", ErrMalformedPackIndex)
+	}
+	idx := &packIndex{hashSize: hashSize}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(data[offsetFanout+4*i:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, fmt.Errorf("%w: fanout table is not monotonic", ErrMalformedPackIndex)
+		}
+	}
+	n := int(idx.fanout[255])
+	shaEnd := offsetShaListing + hashSize*n
+	offsetsStart := shaEnd + 4*n // (skip CRC)
+	offsetsEnd := offsetsStart + 4*n
+	// The idx file ends with two checksums.
+	if len(data) < offsetsEnd+2*hashSize {
+		return nil, fmt.Errorf("%w: file is truncated", ErrMalformedPackIndex)
+	}
+	idx.shas = data[offsetShaListing:shaEnd]
+	idx.offsets = data[offsetsStart:offsetsEnd]
+	idx.large = data[offsetsEnd : len(data)-2*hashSize]
+	idx.packChecksum = data[len(data)-2*hashSize : len(data)-hashSize]
+	return idx, nil
+}
+
+// parsePackIndexV3 parses a version 3 idx file, which indexes the pack by more than one object format.
+// See https://git-scm.com/docs/hash-function-transition:
+//
+//	header: signature, version, header size, number of objects, number of formats,
+//		formats: (4 byte format ID, shortened ID size, tables offset), trailer offset
+//	tables for the first format: sorted shortened IDs, IDs in pack order,
+//		sorted to pack order map, CRC32s in pack order, 4 byte offsets, 8 byte offsets
+//	tables for the other formats: sorted shortened IDs, IDs in pack order, sorted to pack order map
+//	trailer: pack checksum, checksum
+//
+// Only full IDs of the format with the given size are kept, which are copied into a sorted table
+// so that the index can be searched like a version 2 index.
+func parsePackIndexV3(data []byte, hashSize int) (*packIndex, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("%w: file is truncated", ErrMalformedPackIndex)
+	}
+	headerSize := int(binary.BigEndian.Uint32(data[8:]))
+	n := int(binary.BigEndian.Uint32(data[12:]))
+	numFormats := int(binary.BigEndian.Uint32(data[16:]))
+	if numFormats < 1 || headerSize > len(data) || headerSize < 20+12*numFormats+4 {
+		return nil, fmt.Errorf("%w: bad header", ErrMalformedPackIndex)
+	}
+	// tables returns the ID size of a format, its IDs in pack order and its sorted to pack order map,
+	// and the offset of the table that follows them, which is the CRC32 table for the first format.
+	tables := func(i int) (int, []byte, []byte, int, error) {
+		format := data[20+12*i:]
+		var size int
+		switch id := binary.BigEndian.Uint32(format); id {
+		case idxFormatSHA1:
+			size = SHA1Size
+		case idxFormatSHA256:
+			size = SHA256Size
+		default:
+			return 0, nil, nil, 0, fmt.Errorf("%w: unknown object format %08x", ErrMalformedPackIndex, id)
+		}
+		shortSize := int(binary.BigEndian.Uint32(format[4:]))
+		start := int(binary.BigEndian.Uint32(format[8:]))
+		namesStart := start + shortSize*n
+		mapStart := namesStart + size*n
+		end := mapStart + 4*n
+		if shortSize > size || start < headerSize || end > len(data) {
+			return 0, nil, nil, 0, fmt.Errorf("%w: bad tables for object format %d", ErrMalformedPackIndex, i)
+		}
+		return size, data[namesStart:mapStart], data[mapStart:end], end, nil
+	}
+	firstSize, _, firstMap, crcStart, err := tables(0)
+	if err != nil {
+		return nil, err
+	}
+	offsetsStart := crcStart + 4*n
+	offsetsEnd := offsetsStart + 4*n
+	trailer := int(binary.BigEndian.Uint32(data[20+12*numFormats:]))
+	if offsetsEnd > trailer || trailer+2*firstSize > len(data) {
+		return nil, fmt.Errorf("%w: file is truncated", ErrMalformedPackIndex)
+	}
+	// The offsets are in the sorted order of the first format, so index them by pack order.
+	byPackOrder := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		pos := binary.BigEndian.Uint32(firstMap[4*i:])
+		if int(pos) >= n {
+			return nil, fmt.Errorf("%w: pack order position %d out of range", ErrMalformedPackIndex, pos)
+		}
+		byPackOrder[pos] = data[offsetsStart+4*i : offsetsStart+4*i+4]
+	}
+	for f := 0; f < numFormats; f++ {
+		size, names, order, _, err := tables(f)
+		if err != nil {
+			return nil, err
+		}
+		if size != hashSize {
+			continue
+		}
+		idx := &packIndex{
+			shas:         make([]byte, 0, hashSize*n),
+			offsets:      make([]byte, 0, 4*n),
+			large:        data[offsetsEnd:trailer],
+			packChecksum: data[trailer : trailer+firstSize],
+			hashSize:     hashSize,
+		}
+		for i := 0; i < n; i++ {
+			pos := int(binary.BigEndian.Uint32(order[4*i:]))
+			if pos >= n || byPackOrder[pos] == nil {
+				return nil, fmt.Errorf("%w: pack order position %d out of range", ErrMalformedPackIndex, pos)
+			}
+			sha := names[hashSize*pos : hashSize*pos+hashSize]
+			if i > 0 && bytes.Compare(idx.sha(i-1), sha) >= 0 {
+				return nil, fmt.Errorf("%w: object IDs are not sorted", ErrMalformedPackIndex)
+			}
+			idx.shas = append(idx.shas, sha...)
+			idx.offsets = append(idx.offsets, byPackOrder[pos]...)
+			idx.fanout[sha[0]]++
+		}
+		for i := 1; i < len(idx.fanout); i++ {
+			idx.fanout[i] += idx.fanout[i-1]
+		}
+		return idx, nil
+	}
+	return nil, fmt.Errorf("%w: no table of %d byte object IDs", ErrMalformedPackIndex, hashSize)
+}
+
+func (idx *packIndex) numObjects() int {
+	return int(idx.fanout[255])
+}
+
+func (idx *packIndex) sha(i int) []byte {
+	return idx.shas[idx.hashSize*i : idx.hashSize*i+idx.hashSize]
+}
+
+// find uses the fanout table to narrow down the range of candidates,
+// then binary searches that range for the given (binary) shasum.
+func (idx *packIndex) find(sha []byte) (int, bool) {
+	var lo int
+	if sha[0] > 0 {
+		lo = int(idx.fanout[sha[0]-1])
+	}
+	hi := int(idx.fanout[sha[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.sha(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(idx.sha(i), sha) {
+		return i, true
+	}
+	return -1, false
+}
+
+// offset returns the pack file offset of the i'th object in the index.
+// Offsets with the MSB set are indexes into the table of 8 byte offsets.
+func (idx *packIndex) offset(i int) (uint64, error) {
+	off := binary.BigEndian.Uint32(idx.offsets[4*i:])
+	if off&0x8000_0000 == 0 {
+		return uint64(off), nil
+	}
+	li := int(off & 0x7fff_ffff)
+	if 8*li+8 > len(idx.large) {
+		return 0, fmt.Errorf("%w: large offset %d out of range", ErrMalformedPackIndex, li)
+	}
+	return binary.BigEndian.Uint64(idx.large[8*li:]), nil
+}
+
+// Pack is an open pack file along with its index.
+// The idx file is only read when needed, as lookups in packs covered by a multi-pack-index don't need it.
+// A Pack is safe for concurrent use. Entries are only read with ReadAt, so there's no shared file offset.
+type Pack struct {
+	// Name is the name of the pack without extension, i.e. pack-<checksum>.
+	Name    string
+	fsys    fs.FS
+	dir     string
+	file    packFile
+	mod     int64
+	size    int64
+	idxOnce sync.Once
+	idx     *packIndex
+	idxErr  error
+	// idxFailed is set if the idx file couldn't be read, so that the next rescan opens the pack again.
+	idxFailed atomic.Bool
+	revOnce   sync.Once
+	rev       []uint32
+	revErr    error
+	// hashSize is the size of the object IDs of the repo the pack belongs to.
+	hashSize int
+}
+
+// ReadAt reads from the pack file. It is safe for concurrent use.
+func (p *Pack) ReadAt(b []byte, off int64) (int, error) {
+	return p.file.ReadAt(b, off)
+}
+
+func (p *Pack) index() (*packIndex, error) {
+	p.idxOnce.Do(func() {
+		data, err := fs.ReadFile(p.fsys, path.Join(p.dir, p.Name+".idx"))
+		if err != nil {
+			p.idxErr = err
+			return
+		}
+		p.idx, p.idxErr = parsePackIndex(data, p.hashSize)
+		if p.idxErr != nil {
+			p.idxErr = fmt.Errorf("failed to parse %v.idx: %w", p.Name, p.idxErr)
+		}
+	})
+	if p.idxErr != nil {
+		p.idxFailed.Store(true)
+	}
+	return p.idx, p.idxErr
+}
+
+// Find returns the pack offset of the object with the given shasum, if present.
+func (p *Pack) Find(sha Hash) (uint64, bool, error) {
+	if sha.Size() != p.hashSize {
+		return 0, false, ErrMalformedShasum
+	}
+	idx, err := p.index()
+	if err != nil {
+		return 0, false, err
+	}
+	i, ok := idx.find(sha.Bytes())
+	if !ok {
+		return 0, false, nil
+	}
+	off, err := idx.offset(i)
+	return off, err == nil, err
+}
+
+func openPack(fsys fs.FS, packdir, name string, hashSize int) (*Pack, error) {
+	file, fi, err := openPackFile(fsys, path.Join(packdir, name+".pack"))
+	if err != nil {
+		return nil, err
+	}
+	return &Pack{
+		Name:     name,
+		fsys:     fsys,
+		dir:      packdir,
+		file:     file,
+		mod:      fi.ModTime().UnixNano(),
+		size:     fi.Size(),
+		hashSize: hashSize,
+	}, nil
+}
+
+// PackStore keeps the indexes and file handles of all packs in a pack directory open,
+// so that objects can be looked up without reading the directory and idx files every time.
+// If the directory has a multi-pack-index, it is searched first,
+// and only the packs it doesn't cover are searched by their own idx files.
+// The directory is scanned again when an object can't be found,
+// which picks up packs that were added or removed by e.g. `git gc`.
+// A PackStore is safe for concurrent use.
+type PackStore struct {
+	fsys fs.FS
+	dir  string
+	// hashSize is the size of the object IDs of the repo the packs belong to.
+	hashSize int
+	mu       sync.RWMutex
+	packs    []*Pack
+	// midxPacks are the packs covered by midx, indexed by pack ID.
+	// Packs that are listed in the multi-pack-index but don't exist are nil.
+	midx      *MultiPackIndex
+	midxPacks []*Pack
+	midxMod   int64
+	// uncovered are the packs that are not covered by midx.
+	uncovered []*Pack
+	// gen is incremented on every scan, so that data derived from the packs can be reloaded.
+	gen       uint64
+	bitmapMu  sync.Mutex
+	bitmap    *BitmapIndex
+	bitmapGen uint64
+}
+
+// NewPackStore returns a PackStore for the given objects/pack directory of a SHA-1 repo.
+// No files are read until the first lookup.
+func NewPackStore(packdir string) *PackStore {
+	return newPackStore(osFS{}, packdir, SHA1Size)
+}
+
+func newPackStore(fsys fs.FS, packdir string, hashSize int) *PackStore {
+	return &PackStore{fsys: fsys, dir: packdir, hashSize: hashSize}
+}
+
+// Find returns the pack containing the object with the given shasum, and the offset of the object in it.
+// Returns ErrObjectNotFound if the object isn't in any pack, even after rescanning the directory.
+func (s *PackStore) Find(shasum Hash) (*Pack, uint64, error) {
+	if shasum.Size() != s.hashSize {
+		return nil, 0, ErrMalformedShasum
+	}
+	pack, off, err := s.lookup(shasum, true)
+	if pack == nil && err == nil {
+		err = ErrObjectNotFound
+	}
+	return pack, off, err
+}
+
+// lookup returns the pack containing the object with the given shasum, or nil if it isn't found.
+// If rescan is set, the directory is scanned for new packs before giving up.
+func (s *PackStore) lookup(sha Hash, rescan bool) (*Pack, uint64, error) {
+	s.mu.RLock()
+	pack, off, err := s.find(sha)
+	s.mu.RUnlock()
+	if pack != nil || err != nil || !rescan {
+		return pack, off, err
+	}
+	if err = s.Rescan(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.find(sha)
+}
+
+// find must be called with at least a read lock held.
+func (s *PackStore) find(sha Hash) (*Pack, uint64, error) {
+	if s.midx != nil {
+		packID, off, ok, err := s.midx.Find(sha)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to search multi-pack-index: %w", err)
+		}
+		if ok && s.midxPacks[packID] != nil {
+			return s.midxPacks[packID], off, nil
+		}
+	}
+	for _, p := range s.uncovered {
+		// Like git, skip packs whose idx file can't be read, as the object may be elsewhere.
+		// The pack is opened again by the next rescan.
+		if _, err := p.index(); err != nil {
+			continue
+		}
+		off, ok, err := p.Find(sha)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to search %v: %w", p.Name, err)
+		}
+		if ok {
+			return p, off, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// Rescan reads the pack directory, opens packs that have been added and closes packs that have been removed.
+// The multi-pack-index is reloaded if it has changed.
+func (s *PackStore) Rescan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rescan()
+}
+
+func (s *PackStore) rescan() error {
+	dir, err := fs.ReadDir(s.fsys, s.dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err = s.loadMultiPackIndex(); err != nil {
+		return err
+	}
+	open := make(map[string]*Pack, len(s.packs))
+	for _, p := range s.packs {
+		open[p.Name] = p
+	}
+	var packs []*Pack
+	for _, entry := range dir {
+		name, ok := strings.CutSuffix(entry.Name(), ".idx")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		if p, ok := open[name]; ok && !p.idxFailed.Load() {
+			packs = append(packs, p)
+			delete(open, name)
+			continue
+		}
+		p, err := openPack(s.fsys, s.dir, name, s.hashSize)
+		// The pack may be in the middle of being written or removed.
+		// Skip it for now, it's picked up on the next scan if it becomes valid.
+		if err != nil {
+			continue
+		}
+		packs = append(packs, p)
+	}
+	// Close packs that no longer exist or have been opened again. Concurrent reads from them fail with os.ErrClosed.
+	for _, p := range open {
+		p.file.Close()
+	}
+	// Like git, search the most recently modified packs first.
+	sort.SliceStable(packs, func(i, j int) bool {
+		return packs[i].mod > packs[j].mod
+	})
+	s.gen++
+	s.packs = packs
+	s.uncovered = packs
+	if s.midx == nil {
+		return nil
+	}
+	byName := make(map[string]*Pack, len(packs))
+	for _, p := range packs {
+		byName[p.Name] = p
+	}
+	s.midxPacks = make([]*Pack, len(s.midx.PackNames()))
+	for i, name := range s.midx.PackNames() {
+		if p, ok := byName[strings.TrimSuffix(name, ".idx")]; ok {
+			s.midxPacks[i] = p
+			delete(byName, p.Name)
+		}
+	}
+	s.uncovered = nil
+	for _, p := range packs {
+		if _, ok := byName[p.Name]; ok {
+			s.uncovered = append(s.uncovered, p)
+		}
+	}
+	return nil
+}
+
+// loadMultiPackIndex (re)reads the multi-pack-index, if it has changed since it was last read.
+// A multi-pack-index that can't be parsed is ignored, like git does, since all objects can
+// still be found through the idx files.
+func (s *PackStore) loadMultiPackIndex() error {
+	fi, err := fs.Stat(s.fsys, path.Join(s.dir, "multi-pack-index"))
+	if errors.Is(err, fs.ErrNotExist) {
+		s.midx, s.midxPacks, s.midxMod = nil, nil, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.midx != nil && fi.ModTime().UnixNano() == s.midxMod {
+		return nil
+	}
+	s.midx, s.midxPacks, s.midxMod = nil, nil, 0
+	data, err := fs.ReadFile(s.fsys, path.Join(s.dir, "multi-pack-index"))
+	if err != nil {
+		return err
+	}
+	midx, err := ParseMultiPackIndex(data)
+	if err != nil || midx.hashSize != s.hashSize {
+		return nil
+	}
+	s.midx, s.midxMod = midx, fi.ModTime().UnixNano()
+	return nil
+}
+
+// forEachPacked calls fn with the pack, ID and pack offset of every object in the packs of the directory,
+// which is scanned first. Objects that are in more than one pack are passed once for each pack.
+func (s *PackStore) forEachPacked(fn func(p *Pack, sum Hash, off uint64) error) error {
+	if err := s.Rescan(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	packs := s.packs
+	s.mu.RUnlock()
+	for _, p := range packs {
+		idx, err := p.index()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < idx.numObjects(); i++ {
+			off, err := idx.offset(i)
+			if err != nil {
+				return err
+			}
+			if err = fn(p, hashFromBytes(idx.sha(i)), off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MultiPackIndex returns the multi-pack-index of the directory, or nil if there is none.
+func (s *PackStore) MultiPackIndex() *MultiPackIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.midx
+}
+
+// Close closes all open packs.
+func (s *PackStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, p := range s.packs {
+		if cerr := p.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.packs, s.uncovered, s.midxPacks = nil, nil, nil
+	s.midx, s.midxMod = nil, 0
+	return err
+}
@@ -0,0 +1,247 @@
+package gitwood_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+var missing, _ = gitwood.HashFromBytes(bytes.Repeat([]byte{0xff}, gitwood.SHA1Size))
+
+// replacePack replaces the packs in the repo at dir with the pack in files, like git gc does:
+// the new pack is written before its idx, and only then are the old packs removed.
+func replacePack(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	old, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".pack", ".idx"} {
+		for name, data := range files {
+			if strings.HasPrefix(name, "objects/pack/") && strings.HasSuffix(name, ext) {
+				if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	for _, name := range old {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rescan makes the repo rescan its packs, by looking up an object that doesn't exist.
+func rescan(t *testing.T, repo *gitwood.Repo) {
+	t.Helper()
+	if _, _, err := repo.Object(missing); err == nil {
+		t.Fatalf("Object(%v) found a missing object", missing)
+	}
+}
+
+// gatedFS is a directory whose pack files block reads while the gate is closed,
+// so that tests can change the packs while reads are in progress.
+type gatedFS struct {
+	fs.FS
+	closed  atomic.Bool
+	blocked chan struct{}
+	open    chan struct{}
+}
+
+type gatedFile struct {
+	*os.File
+	fsys *gatedFS
+}
+
+func (g *gatedFS) Open(name string) (fs.File, error) {
+	f, err := g.FS.Open(name)
+	if err != nil || !strings.HasSuffix(name, ".pack") {
+		return f, err
+	}
+	return &gatedFile{File: f.(*os.File), fsys: g}, nil
+}
+
+func (f *gatedFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.fsys.closed.Load() {
+		f.fsys.blocked <- struct{}{}
+		<-f.fsys.open
+	}
+	return f.File.ReadAt(b, off)
+}
+
+// TestReadDuringRescan reads the same packed object from many goroutines, which are all stopped
+// in the middle of reading from a pack when a rescan replaces it. The reads fail with os.ErrClosed,
+// and must be retried in the new pack.
+func TestReadDuringRescan(t *testing.T) {
+	b := benchHistory(3)
+	opts := gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas}
+	dir := t.TempDir()
+	if err := b.Write(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &gatedFS{FS: os.DirFS(dir), blocked: make(chan struct{}), open: make(chan struct{})}
+	repo, err := gitwood.OpenFS(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	head := repo.HeadCommit()
+	_, want, _ := b.Content(head)
+	b.Blob("another object, for another pack name\n")
+	files, err := b.Files(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const readers = 8
+	fsys.closed.Store(true)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, o, err := repo.Object(head)
+			if err != nil {
+				t.Errorf("Object(%v): %v", head, err)
+			} else if !bytes.Equal(o, want) {
+				t.Errorf("Object(%v) returned the wrong content", head)
+			}
+		}()
+	}
+	for i := 0; i < readers; i++ {
+		<-fsys.blocked
+	}
+	fsys.closed.Store(false)
+	replacePack(t, dir, files)
+	rescan(t, repo)
+	close(fsys.open)
+	wg.Wait()
+}
+
+// TestConcurrentReadsDuringRescan reads packed objects from many goroutines, while the pack they're in
+// is repeatedly replaced by another pack with the same objects and the packs are rescanned.
+func TestConcurrentReadsDuringRescan(t *testing.T) {
+	b := benchHistory(10)
+	ids := b.ObjectIDs()
+	opts := gitwoodtest.Options{Pack: true, Deltas: gitwoodtest.OfsDeltas, MaxDeltaDepth: 10}
+	dir := t.TempDir()
+	if err := b.Write(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := gitwood.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	// Each new pack has another object, so that it gets a new name.
+	var packs []map[string][]byte
+	for i := 0; i < 10; i++ {
+		b.Blob(fmt.Sprintf("pack %d\n", i))
+		files, err := b.Files(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packs = append(packs, files)
+	}
+
+	var stop atomic.Bool
+	var reads atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; !stop.Load(); i++ {
+				sum := ids[(i*31)%len(ids)]
+				_, o, err := repo.Object(sum)
+				if err != nil {
+					t.Errorf("Object(%v): %v", sum, err)
+					return
+				}
+				if _, want, _ := b.Content(sum); !bytes.Equal(o, want) {
+					t.Errorf("Object(%v) returned the wrong content", sum)
+					return
+				}
+				reads.Add(1)
+			}
+		}(g)
+	}
+	for _, files := range packs {
+		if t.Failed() {
+			break
+		}
+		replacePack(t, dir, files)
+		rescan(t, repo)
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop.Store(true)
+	wg.Wait()
+	if reads.Load() == 0 {
+		t.Error("no objects were read")
+	}
+}
+
+// TestPackStoreBadIndex checks that a pack with a truncated idx file doesn't hide objects that are elsewhere,
+// and that its objects are found once the idx file has been fixed.
+func TestPackStoreBadIndex(t *testing.T) {
+	b := gitwoodtest.New()
+	loose := b.Blob("loose\n")
+	b.Ref("refs/heads/main", b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(map[string]string{"loose": "loose\n"}), Message: "loose\n"}))
+	dir := t.TempDir()
+	if err := b.Write(dir, gitwoodtest.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	packed := gitwoodtest.New()
+	sum := packed.Blob("packed\n")
+	files, err := packed.Files(gitwoodtest.Options{Pack: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "objects", "pack"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var idxName string
+	var idx []byte
+	for name, data := range files {
+		if !strings.HasPrefix(name, "objects/pack/") {
+			continue
+		}
+		if strings.HasSuffix(name, ".idx") {
+			idxName, idx = filepath.Join(dir, filepath.FromSlash(name)), data
+			data = data[:len(data)/2]
+		}
+		if err = os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo, err := gitwood.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if _, _, err = repo.Object(sum); !errors.Is(err, gitwood.ErrObjectNotFound) {
+		t.Errorf("Object(%v) in the pack with a truncated idx error = %v, want %v", sum, err, gitwood.ErrObjectNotFound)
+	}
+	// The packs have been scanned, and are searched before loose objects.
+	if _, _, err = repo.Object(loose); err != nil {
+		t.Errorf("Object(%v) of a loose object: %v", loose, err)
+	}
+	if err = os.WriteFile(idxName, idx, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = repo.Object(sum); err != nil {
+		t.Errorf("Object(%v) after fixing the idx: %v", sum, err)
+	}
+}
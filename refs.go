@@ -0,0 +1,86 @@
+package gitwood
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// readRefs returns the object IDs of all refs under refs/, from both loose ref files and packed-refs.
+// Loose refs take precedence over packed ones, like in git. Symbolic refs are left out,
+// and refs whose content can't be parsed are mapped to the zero Hash.
+func (r Repo) readRefs() (map[string]Hash, error) {
+	refs := map[string]Hash{}
+	packed, err := fs.ReadFile(r.storage(), path.Join(r.GitDir, "packed-refs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		// Skip the header, and the peeled targets of tags, which follow their ref on lines starting with ^.
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		sum, name, _ := strings.Cut(line, " ")
+		refs[name], _ = ParseHash(sum)
+	}
+	err = fs.WalkDir(r.storage(), path.Join(r.GitDir, "refs"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := fs.ReadFile(r.storage(), p)
+		if err != nil {
+			return err
+		}
+		content := strings.TrimSpace(string(data))
+		if strings.HasPrefix(content, "ref:") {
+			return nil
+		}
+		name := strings.TrimPrefix(p, path.Clean(r.GitDir)+"/")
+		refs[name], _ = ParseHash(content)
+		return nil
+	})
+	return refs, err
+}
+
+// readReflogs returns the object IDs in the reflogs of HEAD and all refs, keyed by ID with the name of a ref that logged it.
+func (r Repo) readReflogs() (map[Hash]string, error) {
+	ids := map[Hash]string{}
+	logs := path.Join(r.GitDir, "logs")
+	err := fs.WalkDir(r.storage(), logs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := fs.ReadFile(r.storage(), p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(p, logs), "/")
+		// Each line is "<old ID> <new ID> <committer>\t<message>".
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 2 {
+				fields = fields[:2]
+			}
+			for _, field := range fields {
+				if sum, err := ParseHash(field); err == nil && !sum.isNull() {
+					ids[sum] = name
+				}
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
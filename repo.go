@@ -2,7 +2,7 @@ package gitwood
 
 import (
 	"fmt"
-	"os"
+	"io/fs"
 	"path"
 	"path/filepath"
 	"strings"
@@ -11,27 +11,77 @@ import (
 type Repo struct {
 	Head   string
 	GitDir string
+	// DeltaBaseCache caches the base objects of deltified objects in packs, if set.
+	// Caching is off by default, as the right size depends on how the repo is used.
+	DeltaBaseCache *DeltaBaseCache
+	// Cache caches objects by shasum, if set. See ObjectCache.
+	Cache ObjectCache
+	// Verify makes every object read check the size declared in the object's header,
+	// and that the object hashes to its ID. Objects that fail are reported with a CorruptObjectError.
+	// Objects returned from Cache aren't checked again.
+	Verify bool
+	// MaxDeltaDepth is the longest chain of deltas that is followed to read a packed object,
+	// or DefaultMaxDeltaDepth if it's 0. Deeper chains fail with a DeltaChainError.
+	MaxDeltaDepth int
+	// objects are the objects directory and its alternates,
+	// with pack stores that keep pack indexes and files open between lookups.
+	// Repos that aren't created by Open have none, and open the packs on every lookup instead.
+	objects []*objectDir
+	// graphs holds the commit-graph, which is loaded on first use.
+	graphs *commitGraphs
+	// fsys is the file system GitDir is in. Repos that aren't created by Open or OpenFS use the OS file system.
+	fsys fs.FS
+	// format is the object format read from the config by Open. Repos that aren't created by Open read it on demand.
+	format ObjectFormat
+}
+
+// storage returns the file system the repo is read from.
+func (r Repo) storage() fs.FS {
+	if r.fsys == nil {
+		return osFS{}
+	}
+	return r.fsys
+}
+
+// ObjectFormat returns the hash function the repo uses for object IDs.
+// Repos that don't set extensions.objectFormat, or whose config can't be read, use SHA1.
+func (r Repo) ObjectFormat() ObjectFormat {
+	if r.format != "" {
+		return r.format
+	}
+	format, err := readObjectFormat(r.storage(), r.GitDir)
+	if err != nil {
+		return SHA1
+	}
+	return format
+}
+
+// hashSize returns the size of the repo's object IDs.
+func (r Repo) hashSize() int {
+	return r.ObjectFormat().Size()
 }
 
 func (r Repo) String() string {
 	return fmt.Sprintf("%v @%v", r.GitDir, r.Head)
 }
 
-func (r Repo) HeadCommit() string {
+// HeadCommit returns the commit HEAD points to, or the zero Hash if it can't be resolved.
+func (r Repo) HeadCommit() Hash {
 	fields := strings.Fields(r.Head)
 	if len(fields) == 0 || fields[0] == "" {
-		return NULL_HASH
+		return Hash{}
 	}
-	if len(fields[0]) == 40 {
-		return fields[0]
+	if h, err := ParseHash(fields[0]); err == nil {
+		return h
 	}
 	// Resolve ref
 	if strings.HasPrefix(r.Head, "ref: ") {
 		ref := fields[1]
 		// First try the refs directory...
-		hash, err := os.ReadFile(path.Join(r.GitDir, ref))
+		hash, err := fs.ReadFile(r.storage(), path.Join(r.GitDir, ref))
 		if err == nil {
-			return strings.TrimSpace(string(hash))
+			h, _ := ParseHash(strings.TrimSpace(string(hash)))
+			return h
 		}
 		// ...then try info/refs if that fails,
 		// because sometimes it's stored there apparently (haven't found details about this yet).
@@ -39,22 +89,23 @@ func (r Repo) HeadCommit() string {
 		// kind of as a branch *index* for dumb HTTP servers, so they don't have to traverse the refs directory.
 		// AFAIU `refs/head/` should always exist, though, so I'm not sure what I was struggling with previously.
 		// Maybe I just saw the info/refs file and thought it was the only place where refs are stored.
-		infoRefs, err := os.ReadFile(path.Join(r.GitDir, "info/refs"))
+		infoRefs, err := fs.ReadFile(r.storage(), path.Join(r.GitDir, "info/refs"))
 		if err == nil {
 			for _, line := range strings.Split(string(infoRefs), "\n") {
 				fields = strings.Fields(line)
 				if len(fields) >= 2 && fields[1] == ref {
-					return fields[0]
+					h, _ := ParseHash(fields[0])
+					return h
 				}
 			}
 		}
 	}
-	return NULL_HASH
+	return Hash{}
 }
 
-func (r Repo) Object(shasum string) (ObjectType, []byte, error) {
+func (r Repo) Object(shasum Hash) (ObjectType, []byte, error) {
 	// Wrong place to do this! Don't even know if the caller wants a commit object.
-	if shasum == "" {
+	if shasum.IsZero() {
 		shasum = r.HeadCommit()
 	}
 	otype, o, err := r.openObject(shasum)
@@ -64,8 +115,8 @@ func (r Repo) Object(shasum string) (ObjectType, []byte, error) {
 	return otype, o, nil
 }
 
-func (r Repo) Log(shasum string) ([]Commit, error) {
-	if shasum == "" {
+func (r Repo) Log(shasum Hash) ([]Commit, error) {
+	if shasum.IsZero() {
 		shasum = r.HeadCommit()
 	}
 	commit, err := r.Commit(shasum)
@@ -83,8 +134,8 @@ func (r Repo) Log(shasum string) ([]Commit, error) {
 	return commits, nil
 }
 
-func (r Repo) WalkToPath(commitSum, path string, tw TreeWalker) (ObjectType, []byte, error) {
-	if commitSum == "" {
+func (r Repo) WalkToPath(commitSum Hash, path string, tw TreeWalker) (ObjectType, []byte, error) {
+	if commitSum.IsZero() {
 		commitSum = r.HeadCommit()
 	}
 	commit, err := r.Commit(commitSum)
@@ -94,48 +145,86 @@ func (r Repo) WalkToPath(commitSum, path string, tw TreeWalker) (ObjectType, []b
 	return commit.WalkToPath(path, tw)
 }
 
-func newRepo(gitdir string, head []byte) *Repo {
-	return &Repo{GitDir: gitdir, Head: strings.TrimSpace(string(head))}
+func newRepo(fsys fs.FS, gitdir string, head []byte) (*Repo, error) {
+	format, err := readObjectFormat(fsys, gitdir)
+	if err != nil {
+		return nil, err
+	}
+	return &Repo{
+		GitDir:  gitdir,
+		Head:    strings.TrimSpace(string(head)),
+		objects: openObjectDirs(fsys, gitdir, format.Size()),
+		graphs:  &commitGraphs{},
+		fsys:    fsys,
+		format:  format,
+	}, nil
+}
+
+// Close releases the pack files held open by the repo.
+// The repo can still be used after Close, but packs are then reopened on demand.
+func (r *Repo) Close() error {
+	var err error
+	for _, d := range r.objects {
+		if cerr := d.packs.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func Open(gitdir string) (*Repo, error) {
+	return openRepo(osFS{}, gitdir)
+}
+
+// OpenFS opens the repo at the given path in fsys, which can be e.g. an embed.FS,
+// a zip.Reader or an fstest.MapFS, so that repos can be read without being on disk.
+// Use "." for a bare repo at the root of fsys.
+// Pack files are read with io.ReaderAt if the files of fsys implement it, and are read into memory otherwise.
+func OpenFS(fsys fs.FS, gitdir string) (*Repo, error) {
+	return openRepo(fsys, gitdir)
+}
+
+func openRepo(fsys fs.FS, gitdir string) (*Repo, error) {
 	// First check if the given path is a git dir
-	head, err := os.ReadFile(path.Join(gitdir, "HEAD"))
+	head, err := fs.ReadFile(fsys, path.Join(gitdir, "HEAD"))
 	if err == nil {
-		return newRepo(gitdir, head), nil
+		return newRepo(fsys, gitdir, head)
 	}
 	// Then search for a .git dir or file
-	fi, err := os.Stat(path.Join(gitdir, ".git"))
+	fi, err := fs.Stat(fsys, path.Join(gitdir, ".git"))
 	if err != nil {
 		return nil, err
 	}
 	// If .git is a directory, check if it contains the HEAD file
 	if fi.IsDir() {
 		gitdir = path.Join(gitdir, ".git")
-		head, err = os.ReadFile(path.Join(gitdir, "HEAD"))
+		head, err = fs.ReadFile(fsys, path.Join(gitdir, "HEAD"))
 		if err != nil {
 			return nil, err
 		}
-		return newRepo(gitdir, head), nil
+		return newRepo(fsys, gitdir, head)
 	}
 	// If '.git' is a file, the given dir is probably a submodule
-	gitContents, err := os.ReadFile(path.Join(gitdir, ".git"))
+	gitContents, err := fs.ReadFile(fsys, path.Join(gitdir, ".git"))
 	if err != nil {
 		return nil, err
 	}
 	for _, line := range strings.Split(string(gitContents), "\n") {
 		f := strings.Fields(line)
 		if f[0] == "gitdir:" {
-			gitdir, err = filepath.Abs(path.Join(gitdir, f[1]))
-			if err != nil {
-				return nil, err
+			gitdir = path.Join(gitdir, f[1])
+			if isOSFS(fsys) {
+				gitdir, err = filepath.Abs(gitdir)
+				if err != nil {
+					return nil, err
+				}
 			}
 			break
 		}
 	}
-	head, err = os.ReadFile(path.Join(gitdir, "HEAD"))
+	head, err = fs.ReadFile(fsys, path.Join(gitdir, "HEAD"))
 	if err != nil {
 		return nil, err
 	}
-	return newRepo(gitdir, head), nil
+	return newRepo(fsys, gitdir, head)
 }
@@ -0,0 +1,215 @@
+package gitwood
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// Reverse index format (pack-*.rev), see https://git-scm.com/docs/gitformat-pack:
+//
+//	header: "RIDX", 4 byte version, 4 byte hash function ID
+//	table: 4 byte index position of each object, in pack order
+//	trailer: pack checksum, checksum
+//
+// The reverse index maps positions in the pack (objects sorted by offset) to positions in the idx file.
+// If a pack has no .rev file, the same mapping is built in memory by sorting the idx offsets.
+
+const revIndexHeaderSize = 12
+
+var revIndexSignature = []byte("RIDX")
+
+// parseRevIndex parses a reverse index of numObjects objects, and checks that it belongs to the pack with the given checksum,
+// which is the size of the object IDs.
+func parseRevIndex(data []byte, numObjects int, packChecksum []byte) ([]uint32, error) {
+	hashSize := len(packChecksum)
+	if len(data) != revIndexHeaderSize+4*numObjects+2*hashSize || !bytes.Equal(data[:4], revIndexSignature) {
+		return nil, fmt.Errorf("%w: not a reverse index for %d objects", ErrMalformedPackIndex, numObjects)
+	}
+	if v := binary.BigEndian.Uint32(data[4:]); v != 1 {
+		return nil, fmt.Errorf("%w: unsupported reverse index version %d", ErrMalformedPackIndex, v)
+	}
+	h := binary.BigEndian.Uint32(data[8:])
+	if size, ok := hashSizeForVersion(h); !ok || size != hashSize {
+		return nil, fmt.Errorf("%w: unsupported hash function %d", ErrMalformedPackIndex, h)
+	}
+	if !bytes.Equal(data[len(data)-2*hashSize:len(data)-hashSize], packChecksum) {
+		return nil, fmt.Errorf("%w: reverse index checksum doesn't match the pack", ErrMalformedPackIndex)
+	}
+	order := make([]uint32, numObjects)
+	for i := range order {
+		order[i] = binary.BigEndian.Uint32(data[revIndexHeaderSize+4*i:])
+		if int(order[i]) >= numObjects {
+			return nil, fmt.Errorf("%w: reverse index position %d out of range", ErrMalformedPackIndex, order[i])
+		}
+	}
+	return order, nil
+}
+
+// packOrder returns the index positions of the objects sorted by their offset in the pack.
+func (idx *packIndex) packOrder() ([]uint32, error) {
+	n := idx.numObjects()
+	order := make([]uint32, n)
+	offsets := make([]uint64, n)
+	var err error
+	for i := range order {
+		order[i] = uint32(i)
+		if offsets[i], err = idx.offset(i); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return offsets[order[i]] < offsets[order[j]]
+	})
+	return order, nil
+}
+
+// revIndex returns the index positions of the objects in pack order.
+// The pack's .rev file is used if it exists, otherwise the order is computed from the idx file.
+func (p *Pack) revIndex() ([]uint32, error) {
+	p.revOnce.Do(func() {
+		var idx *packIndex
+		idx, p.revErr = p.index()
+		if p.revErr != nil {
+			return
+		}
+		data, err := fs.ReadFile(p.fsys, path.Join(p.dir, p.Name+".rev"))
+		if err == nil {
+			p.rev, p.revErr = parseRevIndex(data, idx.numObjects(), idx.packChecksum)
+			if p.revErr != nil {
+				p.revErr = fmt.Errorf("failed to parse %v.rev: %w", p.Name, p.revErr)
+			}
+			return
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.revErr = err
+			return
+		}
+		p.rev, p.revErr = idx.packOrder()
+	})
+	return p.rev, p.revErr
+}
+
+// PackEntry describes how an object is stored in a pack.
+type PackEntry struct {
+	ShaSum Hash
+	Offset uint64
+	// CompressedSize is the number of bytes the entry occupies in the pack, including the entry header.
+	CompressedSize uint64
+	// Type is the type of the entry, which is one of the delta types for deltified objects.
+	Type ObjectType
+	// Size is the size of the inflated entry data, i.e. the size of the delta for deltified objects.
+	Size uint64
+}
+
+// NumObjects returns the number of objects in the pack.
+func (p *Pack) NumObjects() (int, error) {
+	idx, err := p.index()
+	if err != nil {
+		return 0, err
+	}
+	return idx.numObjects(), nil
+}
+
+// PackEntryAt returns the entry that starts at the given pack offset.
+// Returns ErrObjectNotFound if no entry starts at the offset.
+func (p *Pack) PackEntryAt(offset uint64) (PackEntry, error) {
+	idx, err := p.index()
+	if err != nil {
+		return PackEntry{}, err
+	}
+	rev, err := p.revIndex()
+	if err != nil {
+		return PackEntry{}, err
+	}
+	// Offsets are increasing in pack order, so the entry can be binary searched.
+	var serr error
+	pos := sort.Search(len(rev), func(i int) bool {
+		off, err := idx.offset(int(rev[i]))
+		if err != nil {
+			serr = err
+		}
+		return off >= offset
+	})
+	if serr != nil {
+		return PackEntry{}, serr
+	}
+	if pos == len(rev) {
+		return PackEntry{}, fmt.Errorf("%w: no object at offset %d", ErrObjectNotFound, offset)
+	}
+	if off, _ := idx.offset(int(rev[pos])); off != offset {
+		return PackEntry{}, fmt.Errorf("%w: no object at offset %d", ErrObjectNotFound, offset)
+	}
+	return p.entryAt(idx, rev, pos)
+}
+
+// entryAt returns the entry at the given position in pack order.
+func (p *Pack) entryAt(idx *packIndex, rev []uint32, pos int) (PackEntry, error) {
+	i := int(rev[pos])
+	off, err := idx.offset(i)
+	if err != nil {
+		return PackEntry{}, err
+	}
+	// The entry ends where the next one starts, or at the trailing pack checksum.
+	end := uint64(p.size - int64(p.hashSize))
+	if pos+1 < len(rev) {
+		if end, err = idx.offset(int(rev[pos+1])); err != nil {
+			return PackEntry{}, err
+		}
+	}
+	if end < off {
+		return PackEntry{}, fmt.Errorf("%w: entry at offset %d overruns the pack", ErrMalformedPackIndex, off)
+	}
+	h, err := readEntry(p, off, p.hashSize)
+	if err != nil {
+		return PackEntry{}, fmt.Errorf("failed to read entry header at offset %d: %w", off, err)
+	}
+	return PackEntry{
+		ShaSum:         hashFromBytes(idx.sha(i)),
+		Offset:         off,
+		CompressedSize: end - off,
+		Type:           h.otype,
+		Size:           h.size,
+	}, nil
+}
+
+// PackEntry returns the entry of the object with the given shasum.
+// Returns ErrObjectNotFound if the object isn't in the pack.
+func (p *Pack) PackEntry(shasum Hash) (PackEntry, error) {
+	off, ok, err := p.Find(shasum)
+	if err != nil {
+		return PackEntry{}, err
+	}
+	if !ok {
+		return PackEntry{}, ErrObjectNotFound
+	}
+	return p.PackEntryAt(off)
+}
+
+// CompressedSize returns the number of bytes the object with the given shasum occupies in the pack.
+func (p *Pack) CompressedSize(shasum Hash) (uint64, error) {
+	e, err := p.PackEntry(shasum)
+	if err != nil {
+		return 0, err
+	}
+	return e.CompressedSize, nil
+}
+
+// CompressedSize returns the number of bytes the packed object with the given shasum occupies in its pack.
+// Returns ErrObjectNotFound if the object isn't packed.
+func (r Repo) CompressedSize(shasum Hash) (uint64, error) {
+	if shasum.Size() != r.hashSize() {
+		return 0, ErrMalformedShasum
+	}
+	dirs, done := r.objectDirs()
+	defer done()
+	pack, _, err := findPacked(dirs, shasum, true)
+	if err != nil {
+		return 0, err
+	}
+	return pack.CompressedSize(shasum)
+}
@@ -0,0 +1,166 @@
+package gitwood_test
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+)
+
+// revPack returns the path of the pack of testdata/rev.git, without extension.
+func revPack(t *testing.T) string {
+	t.Helper()
+	idx, err := filepath.Glob("testdata/rev.git/objects/pack/pack-*.idx")
+	if err != nil || len(idx) != 1 {
+		t.Fatalf("found packs %v, %v, want one", idx, err)
+	}
+	return strings.TrimSuffix(idx[0], ".idx")
+}
+
+// readPackEntries reads testdata/rev-objects.txt, which has the entries of the pack of testdata/rev.git.
+func readPackEntries(t *testing.T) []gitwood.PackEntry {
+	t.Helper()
+	f, err := os.Open("testdata/rev-objects.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []gitwood.PackEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// <object ID> <type> <size> <size in pack> <offset> [<depth> <base ID>]
+		fields := strings.Fields(s.Text())
+		sum, err := gitwood.ParseHash(fields[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := gitwood.PackEntry{ShaSum: sum, Type: gitwood.ObjectTypeFromString(fields[1])}
+		for i, n := range []*uint64{&e.Size, &e.CompressedSize, &e.Offset} {
+			if *n, err = strconv.ParseUint(fields[2+i], 10, 64); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// git repacks with ofs-deltas.
+		if len(fields) > 5 {
+			e.Type = gitwood.OBJ_OFS_DELTA
+		}
+		entries = append(entries, e)
+	}
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// copyPack copies the pack of testdata/rev.git and its idx to a temporary directory, which is returned.
+func copyPack(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	pack := revPack(t)
+	for _, ext := range []string{".pack", ".idx"} {
+		data, err := os.ReadFile(pack + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, filepath.Base(pack)+ext), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func openPack(t *testing.T, packdir string) *gitwood.Pack {
+	t.Helper()
+	s := gitwood.NewPackStore(packdir)
+	t.Cleanup(func() { s.Close() })
+	entries := readPackEntries(t)
+	p, _, err := s.Find(entries[0].ShaSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestPackEntries reads the entries of a pack, both with its .rev file and with the reverse index computed from the idx.
+func TestPackEntries(t *testing.T) {
+	entries := readPackEntries(t)
+	for name, packdir := range map[string]string{
+		"rev":    "testdata/rev.git/objects/pack",
+		"no-rev": copyPack(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := openPack(t, packdir)
+			if n, err := p.NumObjects(); err != nil || n != len(entries) {
+				t.Errorf("NumObjects() = %d, %v, want %d", n, err, len(entries))
+			}
+			for _, want := range entries {
+				e, err := p.PackEntryAt(want.Offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e != want {
+					t.Errorf("PackEntryAt(%d) = %+v, want %+v", want.Offset, e, want)
+				}
+				if e, err = p.PackEntry(want.ShaSum); err != nil || e != want {
+					t.Errorf("PackEntry(%v) = %+v, %v, want %+v", want.ShaSum, e, err, want)
+				}
+				// Entries don't start in the middle of other entries.
+				if _, err = p.PackEntryAt(want.Offset + 1); !errors.Is(err, gitwood.ErrObjectNotFound) {
+					t.Errorf("PackEntryAt(%d) error = %v, want %v", want.Offset+1, err, gitwood.ErrObjectNotFound)
+				}
+			}
+		})
+	}
+}
+
+func TestRepoCompressedSize(t *testing.T) {
+	repo, err := gitwood.Open("testdata/rev.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for _, want := range readPackEntries(t) {
+		size, err := repo.CompressedSize(want.ShaSum)
+		if err != nil || size != want.CompressedSize {
+			t.Errorf("CompressedSize(%v) = %d, %v, want %d", want.ShaSum, size, err, want.CompressedSize)
+		}
+	}
+}
+
+func TestMalformedRevIndex(t *testing.T) {
+	pack := revPack(t)
+	rev, err := os.ReadFile(pack + ".rev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := readPackEntries(t)
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+	}{
+		{"signature", func(data []byte) []byte { data[0] = 'X'; return data }},
+		{"version", func(data []byte) []byte { data[7] = 2; return data }},
+		{"hash function", func(data []byte) []byte { data[11] = 2; return data }},
+		{"truncated", func(data []byte) []byte { return data[:len(data)-1] }},
+		{"pack checksum", func(data []byte) []byte { data[len(data)-2*gitwood.SHA1Size] ^= 1; return data }},
+		{"position out of range", func(data []byte) []byte { data[12] = 0xff; return data }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := copyPack(t)
+			data := tt.modify(append([]byte(nil), rev...))
+			if err := os.WriteFile(filepath.Join(dir, filepath.Base(pack)+".rev"), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			p := openPack(t, dir)
+			if _, err := p.PackEntryAt(entries[0].Offset); !errors.Is(err, gitwood.ErrMalformedPackIndex) {
+				t.Errorf("PackEntryAt() error = %v, want %v", err, gitwood.ErrMalformedPackIndex)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package gitwood
+
+import (
+	"container/heap"
+	"fmt"
+	"path"
+)
+
+// ListedObject is an object listed by ListObjects.
+type ListedObject struct {
+	ShaSum Hash
+	Type   ObjectType
+	// Path is where a tree or blob was first seen, relative to the root tree of a commit.
+	// It is empty for commits, tags and root trees.
+	Path string
+}
+
+// ListObjects returns the commits, tags, trees and blobs that are reachable from include but not from exclude,
+// like `git rev-list --objects include --not exclude`. For example, the objects that B adds to A are
+// ListObjects([]Hash{B}, []Hash{A}). Commits are listed first, newest first,
+// followed by the tags in include and the trees and blobs in the order they're first seen in the commits.
+// Like git, the commit walk stops at excluded commits, and the trees and blobs that are excluded are those in the
+// excluded commits it stops at. Subtrees that have been listed or excluded aren't walked again.
+// Submodule commits are not listed, as they aren't part of the repo.
+func (r Repo) ListObjects(include, exclude []Hash) ([]ListedObject, error) {
+	w := &objectWalk{repo: r, commits: r.newCommitLookup(), excluded: map[Hash]bool{}, seen: map[Hash]bool{}}
+	var excludeCommits, includeCommits []Hash
+	for _, sum := range exclude {
+		target, otype, err := w.peel(sum, func(tag Hash) { w.excluded[tag] = true })
+		if err != nil {
+			return nil, err
+		}
+		switch otype {
+		case OBJ_COMMIT:
+			excludeCommits = append(excludeCommits, target)
+		case OBJ_TREE:
+			err = w.exclude(target)
+		default:
+			w.excluded[target] = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Tips that aren't commits are listed after the commits, like the pending objects in git.
+	var tips []ListedObject
+	for _, sum := range include {
+		target, otype, err := w.peel(sum, func(tag Hash) {
+			tips = append(tips, ListedObject{ShaSum: tag, Type: OBJ_TAG})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if otype == OBJ_COMMIT {
+			includeCommits = append(includeCommits, target)
+		} else {
+			tips = append(tips, ListedObject{ShaSum: target, Type: otype})
+		}
+	}
+	commits, boundary, err := w.walkCommits(includeCommits, excludeCommits)
+	if err != nil {
+		return nil, err
+	}
+	for _, tree := range boundary {
+		if err = w.exclude(tree); err != nil {
+			return nil, err
+		}
+	}
+	for _, ci := range commits {
+		w.add(ci.ShaSum, OBJ_COMMIT, "")
+	}
+	for _, tip := range tips {
+		if tip.Type == OBJ_TREE {
+			err = w.addTree(tip.ShaSum, "")
+		} else {
+			w.add(tip.ShaSum, tip.Type, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ci := range commits {
+		if err = w.addTree(ci.Tree, ""); err != nil {
+			return nil, err
+		}
+	}
+	return w.objects, nil
+}
+
+// objectWalk lists the objects for ListObjects.
+type objectWalk struct {
+	repo    Repo
+	commits *commitLookup
+	// excluded are the objects reachable from the excluded objects, except for commits, which are handled by walkCommits.
+	excluded map[Hash]bool
+	seen     map[Hash]bool
+	objects  []ListedObject
+}
+
+// peel follows tags to the object they point to, and returns its ID and type.
+// fn is called with each tag on the way.
+func (w *objectWalk) peel(sum Hash, fn func(tag Hash)) (Hash, ObjectType, error) {
+	for {
+		otype, o, err := w.repo.Object(sum)
+		if err != nil {
+			return Hash{}, OBJ_INVALID, err
+		}
+		if otype != OBJ_TAG {
+			return sum, otype, nil
+		}
+		fn(sum)
+		target, err := tagTarget(o)
+		if err != nil {
+			return Hash{}, OBJ_INVALID, fmt.Errorf("failed to parse tag %v: %w", sum, err)
+		}
+		sum = target
+	}
+}
+
+// Flags used while walking commits in walkCommits.
+const (
+	walkQueued = 1 << iota
+	walkUninteresting
+)
+
+// walkCommits returns the commits reachable from include but not from exclude, newest first,
+// and the trees of the excluded commits where the walk stopped.
+// The walk stops when only excluded commits are left in the queue, like limit_list in git,
+// so with a commit-graph the result is exact, and without one it relies on commit times.
+func (w *objectWalk) walkCommits(include, exclude []Hash) ([]*CommitInfo, []Hash, error) {
+	flags := map[Hash]int{}
+	infos := map[Hash]*CommitInfo{}
+	queue := &commitQueue{}
+	// markUninteresting marks a queued commit uninteresting, along with its ancestors that have already been queued,
+	// like mark_parents_uninteresting in git. If commit times are skewed, a commit can be walked as interesting
+	// before it's reached from an excluded commit, and then its parents have been queued as interesting too.
+	markUninteresting := func(sum Hash) {
+		stack := []Hash{sum}
+		for len(stack) > 0 {
+			sum, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			if flags[sum]&walkUninteresting != 0 {
+				continue
+			}
+			flags[sum] |= walkUninteresting
+			for _, p := range infos[sum].Parents {
+				if flags[p]&walkQueued != 0 {
+					stack = append(stack, p)
+				}
+			}
+		}
+	}
+	push := func(sum Hash, f int) error {
+		if flags[sum]&walkQueued != 0 {
+			if f&walkUninteresting != 0 {
+				markUninteresting(sum)
+			}
+			return nil
+		}
+		ci, err := w.commits.info(sum)
+		if err != nil {
+			return err
+		}
+		flags[sum] = walkQueued | f
+		infos[sum] = ci
+		heap.Push(queue, ci)
+		return nil
+	}
+	for _, sum := range exclude {
+		if err := push(sum, walkUninteresting); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, sum := range include {
+		if err := push(sum, 0); err != nil {
+			return nil, nil, err
+		}
+	}
+	hasInteresting := func() bool {
+		for _, ci := range *queue {
+			if flags[ci.ShaSum]&walkUninteresting == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	var walked []*CommitInfo
+	var boundary []Hash
+	for hasInteresting() {
+		ci := heap.Pop(queue).(*CommitInfo)
+		f := flags[ci.ShaSum] & walkUninteresting
+		if f == 0 {
+			walked = append(walked, ci)
+		}
+		for _, p := range ci.Parents {
+			if err := push(p, f); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, sum := range exclude {
+		ci, err := w.commits.info(sum)
+		if err != nil {
+			return nil, nil, err
+		}
+		boundary = append(boundary, ci.Tree)
+	}
+	// Commits may have been marked uninteresting after they were walked, if commit times are skewed.
+	var commits []*CommitInfo
+	for _, ci := range walked {
+		if flags[ci.ShaSum]&walkUninteresting != 0 {
+			continue
+		}
+		commits = append(commits, ci)
+		for _, p := range ci.Parents {
+			if flags[p]&walkUninteresting != 0 {
+				pci, err := w.commits.info(p)
+				if err != nil {
+					return nil, nil, err
+				}
+				boundary = append(boundary, pci.Tree)
+			}
+		}
+	}
+	return commits, boundary, nil
+}
+
+// treeEntries returns the entries of the tree, or an error wrapping a *TreeError if it's malformed,
+// so that a malformed tree doesn't silently leave objects out.
+func (w *objectWalk) treeEntries(sum Hash) ([]TreeEntry, error) {
+	tree, err := w.repo.Tree(sum)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := tree.ParseEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tree %v: %w", sum, err)
+	}
+	return entries, nil
+}
+
+// exclude marks the tree and all trees and blobs in it as excluded.
+func (w *objectWalk) exclude(sum Hash) error {
+	if w.excluded[sum] {
+		return nil
+	}
+	w.excluded[sum] = true
+	entries, err := w.treeEntries(sum)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			err = w.exclude(e.ShaSum)
+		case e.Mode.IsSubmodule():
+		default:
+			w.excluded[e.ShaSum] = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add lists the object, unless it has been listed or excluded, and reports whether it was.
+func (w *objectWalk) add(sum Hash, otype ObjectType, p string) bool {
+	if w.seen[sum] || w.excluded[sum] {
+		return false
+	}
+	w.seen[sum] = true
+	w.objects = append(w.objects, ListedObject{ShaSum: sum, Type: otype, Path: p})
+	return true
+}
+
+// addTree lists the tree at the given path and the trees and blobs in it, depth first.
+func (w *objectWalk) addTree(sum Hash, dir string) error {
+	if !w.add(sum, OBJ_TREE, dir) {
+		return nil
+	}
+	entries, err := w.treeEntries(sum)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		switch {
+		case e.IsDir():
+			err = w.addTree(e.ShaSum, p)
+		case e.Mode.IsSubmodule():
+		default:
+			w.add(e.ShaSum, OBJ_BLOB, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package gitwood_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// commitAt adds a commit with the given parents and commit time, and a tree with a file named after the message.
+func commitAt(b *gitwoodtest.Builder, msg string, unix int64, parents ...gitwood.Hash) gitwood.Hash {
+	sig := gitwoodtest.Signature{Name: "A U Thor", Email: "author@example.com", When: time.Unix(unix, 0).UTC()}
+	tree := b.TreeFromFiles(map[string]string{msg: msg + "\n"})
+	return b.Commit(gitwoodtest.Commit{Tree: tree, Parents: parents, Author: sig, Committer: sig, Message: msg + "\n"})
+}
+
+// listedCommits returns the messages of the commits ListObjects lists, and the names of the blobs.
+func listedCommits(t *testing.T, repo *gitwood.Repo, names map[gitwood.Hash]string, include, exclude []gitwood.Hash) (string, string) {
+	t.Helper()
+	objects, err := repo.ListObjects(include, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commits, blobs []string
+	for _, o := range objects {
+		switch o.Type {
+		case gitwood.OBJ_COMMIT:
+			commits = append(commits, names[o.ShaSum])
+		case gitwood.OBJ_BLOB:
+			blobs = append(blobs, o.Path)
+		}
+	}
+	return strings.Join(commits, ","), strings.Join(blobs, ",")
+}
+
+// TestListObjectsSkewedTimes excludes a commit whose time is older than the commits it's reached through,
+// so that they're walked as interesting before the walk gets to them from the excluded commit.
+func TestListObjectsSkewedTimes(t *testing.T) {
+	b := gitwoodtest.New()
+	names := map[gitwood.Hash]string{}
+	commit := func(msg string, unix int64, parents ...gitwood.Hash) gitwood.Hash {
+		sum := commitAt(b, msg, unix, parents...)
+		names[sum] = msg
+		return sum
+	}
+	a := commit("a", 80)
+	base := commit("base", 90, a)
+	tip := commit("tip", 100, base)
+	// The excluded commit and its parent have older times than base, which they're based on.
+	excluded := commit("excluded", 10, commit("skewed", 5, base))
+	// other is older than all of them, and keeps the walk going until base is reached from excluded.
+	other := commit("other", 1)
+
+	for name, opts := range map[string]gitwoodtest.Options{"loose": {}, "pack": {Pack: true}} {
+		t.Run(name, func(t *testing.T) {
+			repo := b.Repo(t, opts)
+			commits, blobs := listedCommits(t, repo, names, []gitwood.Hash{tip, other}, []gitwood.Hash{excluded})
+			if commits != "tip,other" {
+				t.Errorf("commits = %v, want tip,other", commits)
+			}
+			if blobs != "tip,other" {
+				t.Errorf("blobs = %v, want tip,other", blobs)
+			}
+		})
+	}
+}
+
+// TestMalformedTreeWalk checks that a malformed tree makes the walks fail, instead of leaving out the objects after it.
+func TestMalformedTreeWalk(t *testing.T) {
+	b := gitwoodtest.New()
+	blob := b.Blob("hello\n")
+	// The second entry is cut off in its ID.
+	data := rawTree(gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "a", ShaSum: blob})
+	data = append(data, "100644 b\x00"+string(blob.Bytes()[:10])...)
+	tree := b.Object(gitwood.OBJ_TREE, data)
+	commit := b.Commit(gitwoodtest.Commit{Tree: tree, Message: "malformed\n"})
+	other := b.Commit(gitwoodtest.Commit{Tree: b.TreeFromFiles(map[string]string{"a": "a\n"}), Message: "other\n"})
+	b.Ref("refs/heads/main", commit)
+	repo := b.Repo(t, gitwoodtest.Options{})
+	check := func(name string, err error) {
+		t.Helper()
+		var treeErr *gitwood.TreeError
+		if !errors.As(err, &treeErr) || !errors.Is(err, gitwood.ErrMalformedTree) {
+			t.Errorf("%v() error = %v, want a TreeError", name, err)
+		}
+	}
+	_, err := repo.ListObjects([]gitwood.Hash{commit}, nil)
+	check("ListObjects", err)
+	_, err = repo.ListObjects([]gitwood.Hash{other}, []gitwood.Hash{commit})
+	check("ListObjects with exclude", err)
+	_, err = repo.ReachableObjects([]gitwood.Hash{commit})
+	check("ReachableObjects", err)
+	_, err = repo.CountReachableObjects([]gitwood.Hash{commit})
+	check("CountReachableObjects", err)
+}
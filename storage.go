@@ -0,0 +1,77 @@
+package gitwood
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// osFS is the file system of the OS, which repos opened with Open read from.
+// Unlike os.DirFS, it takes OS paths, so that GitDir can be any path, including relative and absolute ones.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	// Don't return a nil *os.File as a non-nil fs.File.
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// isOSFS reports whether fsys is the file system of the OS.
+func isOSFS(fsys fs.FS) bool {
+	_, ok := fsys.(osFS)
+	return ok
+}
+
+// packFile is a file that can be read at arbitrary offsets, like a pack file.
+type packFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// memFile is a packFile that has been read into memory.
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// openPackFile opens the named file for reading at arbitrary offsets.
+// Files that don't implement io.ReaderAt, like compressed files in a zip archive, are read into memory.
+func openPackFile(fsys fs.FS, name string) (packFile, fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if pf, ok := f.(packFile); ok {
+		return pf, fi, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return memFile{bytes.NewReader(data)}, fi, nil
+}
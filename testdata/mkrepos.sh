@@ -0,0 +1,104 @@
+#!/bin/sh
+# mkrepos.sh writes the git repositories in testdata, which have files that gitwoodtest can't write.
+# Commit times are fixed, so running it again writes the same objects, but packs and commit-graphs may differ
+# between versions of git. The repos were written with git 2.39.
+set -e
+cd "$(dirname "$0")"
+rm -rf split.git alt.git midx.git midx-objects.txt bitmap.git reachable-objects.txt bloom.git bloom-changes.txt rev.git rev-objects.txt sha256.git sha256-log.txt work
+
+export GIT_CONFIG_GLOBAL=/dev/null GIT_CONFIG_NOSYSTEM=1
+export GIT_AUTHOR_NAME="A U Thor" GIT_AUTHOR_EMAIL=author@example.com
+export GIT_COMMITTER_NAME="C O Mitter" GIT_COMMITTER_EMAIL=committer@example.com
+t=1600000000
+commit() {
+	t=$((t + 3600))
+	GIT_AUTHOR_DATE="$t +0000" GIT_COMMITTER_DATE="$t +0000" git -C work commit -q --allow-empty -m "$1"
+}
+file() {
+	mkdir -p "work/$(dirname "$1")"
+	echo "$2" >>"work/$1"
+	git -C work add "$1"
+}
+
+# split.git has a commit-graph chain of two layers.
+git init -q -b main work
+for i in 1 2 3; do file "f$i.txt" "$i"; commit "commit $i"; done
+git clone -q --bare work split.git
+git -C split.git commit-graph write --reachable --split=no-merge
+for i in 4 5 6; do file "f$i.txt" "$i"; commit "commit $i"; done
+git -C split.git fetch -q ../work main:main
+git -C split.git commit-graph write --reachable --split=no-merge
+
+# alt.git borrows the objects of split.git through a relative alternate, and has a commit-graph chain
+# whose first two layers are those of split.git.
+git clone -q --bare --shared split.git alt.git
+echo ../../split.git/objects >alt.git/objects/info/alternates
+for i in 7 8; do file "f$i.txt" "$i"; commit "commit $i"; done
+git -C alt.git fetch -q ../work main:main
+git -C alt.git commit-graph write --reachable --split=no-merge
+
+# midx.git has three packs, and a multi-pack-index with a bitmap that covers the first two.
+# midx-objects.txt lists the objects of each pack and their offsets, as git show-index does.
+git init -q --bare -b main midx.git
+for n in 2 5 8; do
+	git -C work branch -f stage "main~$((8 - n))"
+	git -C midx.git -c fetch.unpackLimit=1 fetch -q ../work stage:main
+	if [ $n = 5 ]; then
+		git -C midx.git multi-pack-index write --bitmap
+	fi
+done
+for idx in midx.git/objects/pack/*.idx; do
+	git show-index <"$idx" | sed "s|^|$(basename "$idx") |"
+done >midx-objects.txt
+
+# bitmap.git has the commits of midx.git in a pack with a bitmap up to commit 5, and a second pack without one.
+git init -q --bare -b main bitmap.git
+git -C work branch -f stage main~3
+git -C bitmap.git fetch -q ../work stage:main
+git -C bitmap.git repack -q -adb
+git -C bitmap.git -c fetch.unpackLimit=1 fetch -q ../work main:main
+# reachable-objects.txt lists the objects reachable from commit 5 and commit 8 of midx.git and bitmap.git,
+# as git rev-list --objects does, after the commit and with their types.
+for rev in main~3 main; do
+	c=$(git -C midx.git rev-parse "$rev")
+	git -C midx.git rev-list --objects "$c" | cut -d' ' -f1 |
+		git -C midx.git cat-file --batch-check="$c %(objectname) %(objecttype)" | sort
+done >reachable-objects.txt
+
+# bloom.git has a commit-graph with changed-path Bloom filters, of hash version 1 before git 2.46,
+# and paths with non-ASCII characters, which version 1 hashes as signed chars.
+# bloom-changes.txt lists the paths that each commit changes, as git log does.
+rm -rf work
+git init -q -b main work
+for p in README dør/fïle.txt dør/other.txt naïve.txt src/main.go 日本/語.txt dør/fïle.txt src/ünïcode.go README naïve.txt; do
+	file "$p" "$p"
+	commit "change $p"
+done
+git init -q --bare -b main bloom.git
+git -C bloom.git fetch -q ../work main:main
+git -C bloom.git commit-graph write --reachable --changed-paths
+git -C bloom.git -c core.quotepath=false log --format='commit %H' --name-only >bloom-changes.txt
+
+# rev.git has the objects of bloom.git in a single pack with deltas, and a reverse index.
+# rev-objects.txt lists the entries of the pack, as git verify-pack -v does.
+git init -q --bare -b main rev.git
+git -C rev.git fetch -q ../work main:main
+git -C rev.git -c pack.writeReverseIndex=true -c repack.writeBitmaps=false repack -q -adf
+git verify-pack -v rev.git/objects/pack/*.idx | grep -E '^[0-9a-f]{40} ' >rev-objects.txt
+
+# sha256.git is a SHA-256 repo with a pack, loose objects and a commit-graph.
+# sha256-log.txt lists its commits and their trees, as git log does.
+rm -rf work
+git init -q -b main --object-format=sha256 work
+for i in 1 2 3 4; do file "dir$i/f.txt" "$i"; commit "commit $i"; done
+git init -q --bare -b main --object-format=sha256 sha256.git
+git -C work branch -f stage main~2
+git -C sha256.git -c fetch.unpackLimit=1 fetch -q ../work stage:main
+git -C sha256.git fetch -q ../work main:main
+git -C sha256.git commit-graph write --reachable
+git -C sha256.git log --format='%H %T' >sha256-log.txt
+
+rm -rf work
+for r in split.git alt.git midx.git bitmap.git bloom.git rev.git sha256.git; do
+	rm -rf $r/hooks $r/logs $r/description $r/info/exclude $r/FETCH_HEAD
+done
@@ -1,67 +1,203 @@
 package gitwood
 
 import (
-	"encoding/hex"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // Tree format:
 // tree [content size]\0[Entries having references to other trees and blobs].
-// [mode] [file/folder name]\0[SHA-1 of referencing blob or tree]
+// [mode] [file/folder name]\0[SHA-1 or SHA-256 of referencing blob or tree]
 
 type Tree struct {
-	shaSum     string
+	shaSum     Hash
 	objectData []byte
 	repo       Repo
+	hashSize   int
 }
 
 type TreeEntry struct {
-	Mode   string
+	Mode   FileMode
 	name   string
-	ShaSum string
+	ShaSum Hash
 }
 
+// String formats the entry with its abbreviated ID, mode and name.
+// Like ls -F, names of trees end with /, executables with *, and symlinks with @.
+// Submodules are followed by (submodule).
 func (te TreeEntry) String() string {
 	name := te.name
-	if te.IsDir() {
+	switch {
+	case te.Mode.IsDir():
 		name += "/"
+	case te.Mode.IsSubmodule():
+		name += " (submodule)"
+	case te.Mode.IsExecutable():
+		name += "*"
+	case te.Mode.IsSymlink():
+		name += "@"
 	}
-	return fmt.Sprintf("(%s) [%6s] %s", te.ShaSum[:9], te.Mode, name)
+	// The zero Hash has no digits, so it's shorter than the abbreviation.
+	sum := te.ShaSum.String()
+	if len(sum) > 9 {
+		sum = sum[:9]
+	}
+	return fmt.Sprintf("(%s) [%6s] %s", sum, te.Mode, name)
 }
 
 func (te TreeEntry) IsDir() bool {
-	return te.Mode == "40000"
+	return te.Mode.IsDir()
 }
 
 func (te TreeEntry) Name() string {
 	return te.name
 }
 
+// ExtractTreeEntries parses the entries of a tree object of a SHA-1 repo.
+// Use Repo.TreeEntries for trees of repos that may use SHA-256.
+// Malformed trees are parsed up to the first entry that can't be parsed; use ParseTree to get the error.
 func ExtractTreeEntries(tree []byte) []TreeEntry {
-	var i int
+	return extractTreeEntries(tree, SHA1Size)
+}
+
+// TreeEntries parses the entries of a tree object of the repo, like ExtractTreeEntries.
+func (r Repo) TreeEntries(tree []byte) []TreeEntry {
+	return extractTreeEntries(tree, r.hashSize())
+}
+
+func extractTreeEntries(tree []byte, hashSize int) []TreeEntry {
+	entries, _ := parseTree(tree, hashSize)
+	return entries
+}
+
+// ParseTree parses the entries of a tree object of a SHA-1 repo.
+// Use Repo.ParseTree for trees of repos that may use SHA-256.
+// Malformed trees return a *TreeError, along with the entries before the one that can't be parsed.
+func ParseTree(tree []byte) ([]TreeEntry, error) {
+	return parseTree(tree, SHA1Size)
+}
+
+// ParseTree parses the entries of a tree object of the repo, like ParseTree.
+func (r Repo) ParseTree(tree []byte) ([]TreeEntry, error) {
+	return parseTree(tree, r.hashSize())
+}
+
+func parseTree(tree []byte, hashSize int) ([]TreeEntry, error) {
 	entries := []TreeEntry{}
-	for i < len(tree) {
-		ne := TreeEntry{}
-		for tree[i] != CHAR_SPACE {
-			ne.Mode += string(tree[i])
-			i++
-		}
-		i++
-		for i < len(tree) && tree[i] != 0 {
-			ne.name += string(tree[i])
-			i++
-		}
-		i++
-		ne.ShaSum = hex.EncodeToString(tree[i : i+20])
-		entries = append(entries, ne)
-		i += 20
+	s := newTreeScanner(tree, hashSize)
+	for s.Scan() {
+		entries = append(entries, s.Entry())
 	}
-	return entries
+	return entries, s.Err()
+}
+
+// TreeError is returned when a tree object can't be parsed.
+// Err is ErrTruncatedTreeEntry, ErrBadTreeMode or ErrEmptyTreeName, and it matches ErrMalformedTree with errors.Is.
+type TreeError struct {
+	// Offset is the position in the tree of the entry that can't be parsed.
+	Offset int
+	Err    error
+}
+
+func (e *TreeError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %v", ErrMalformedTree, e.Offset, e.Err)
+}
+
+func (e *TreeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TreeError) Is(target error) bool {
+	return target == ErrMalformedTree
+}
+
+// TreeScanner reads the entries of a tree object one at a time, like bufio.Scanner:
+//
+//	s := NewTreeScanner(tree, repo.ObjectFormat())
+//	for s.Scan() {
+//		e := s.Entry()
+//		...
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+//
+// The names of the entries share one copy of the tree, so scanning doesn't allocate for each entry.
+type TreeScanner struct {
+	data []byte
+	// tree is data as a string, which names are sliced from.
+	tree     string
+	hashSize int
+	pos      int
+	entry    TreeEntry
+	err      error
+}
+
+// NewTreeScanner returns a scanner of the entries of a tree object whose IDs are in the given format.
+func NewTreeScanner(tree []byte, format ObjectFormat) *TreeScanner {
+	return newTreeScanner(tree, format.Size())
+}
+
+func newTreeScanner(tree []byte, hashSize int) *TreeScanner {
+	return &TreeScanner{data: tree, tree: string(tree), hashSize: hashSize}
+}
+
+// Scanner returns a scanner of the entries of the tree.
+func (t Tree) Scanner() *TreeScanner {
+	return newTreeScanner(t.objectData, t.hashSize)
+}
+
+// Scan advances to the next entry, which is then returned by Entry.
+// It returns false at the end of the tree, or at an entry that can't be parsed, in which case Err returns a *TreeError.
+func (s *TreeScanner) Scan() bool {
+	if s.err != nil || s.pos >= len(s.tree) {
+		return false
+	}
+	rest := s.tree[s.pos:]
+	sp := strings.IndexByte(rest, CHAR_SPACE)
+	if sp < 0 {
+		return s.fail(ErrTruncatedTreeEntry)
+	}
+	mode, err := strconv.ParseUint(rest[:sp], 8, 32)
+	if err != nil {
+		return s.fail(ErrBadTreeMode)
+	}
+	nul := strings.IndexByte(rest[sp+1:], 0)
+	if nul < 0 {
+		return s.fail(ErrTruncatedTreeEntry)
+	}
+	if nul == 0 {
+		return s.fail(ErrEmptyTreeName)
+	}
+	nul += sp + 1
+	end := nul + 1 + s.hashSize
+	if end > len(rest) {
+		return s.fail(ErrTruncatedTreeEntry)
+	}
+	s.entry = TreeEntry{Mode: FileMode(mode), name: rest[sp+1 : nul], ShaSum: hashFromBytes(s.data[s.pos+nul+1 : s.pos+end])}
+	s.pos += end
+	return true
+}
+
+func (s *TreeScanner) fail(err error) bool {
+	s.err = &TreeError{Offset: s.pos, Err: err}
+	s.entry = TreeEntry{}
+	return false
 }
 
-func (r Repo) Tree(shasum string) (*Tree, error) {
+// Entry returns the entry read by the last call to Scan.
+func (s *TreeScanner) Entry() TreeEntry {
+	return s.entry
+}
+
+// Err returns the error that stopped the scanner, or nil if it reached the end of the tree.
+func (s *TreeScanner) Err() error {
+	return s.err
+}
+
+func (r Repo) Tree(shasum Hash) (*Tree, error) {
 	otype, o, err := r.Object(shasum)
 	if err != nil {
 		return nil, err
@@ -69,7 +205,19 @@ func (r Repo) Tree(shasum string) (*Tree, error) {
 	if otype != OBJ_TREE {
 		return nil, ErrNotATree
 	}
-	return &Tree{shaSum: shasum, objectData: o, repo: r}, nil
+	return &Tree{shaSum: shasum, objectData: o, repo: r, hashSize: r.hashSize()}, nil
+}
+
+// Entries returns the entries of the tree.
+// Malformed trees are parsed up to the first entry that can't be parsed; use ParseEntries to get the error.
+func (t Tree) Entries() []TreeEntry {
+	entries, _ := t.ParseEntries()
+	return entries
+}
+
+// ParseEntries returns the entries of the tree, or a *TreeError if the tree is malformed.
+func (t Tree) ParseEntries() ([]TreeEntry, error) {
+	return parseTree(t.objectData, t.hashSize)
 }
 
 // WalkToPath walks the tree until it finds path (if it exists),
@@ -80,17 +228,21 @@ func (t Tree) WalkToPath(path string, w TreeWalker) (otype ObjectType, o []byte,
 	}
 	// If no TreeWalker is given, use a dummy one.
 	if w == nil {
-		w = func(path, sum string) error { return nil }
+		w = func(path string, sum Hash) error { return nil }
 	}
 
-	o = t.objectData
+	sum, o := t.shaSum, t.objectData
 	// Traverse the tree until the leaf node
 	nodes := strings.Split(strings.Trim(path, "/"), "/")
 	dirs, filename := nodes[:len(nodes)-1], nodes[len(nodes)-1]
 
 checkTrees:
 	for i, name := range dirs {
-		for _, e := range ExtractTreeEntries(o) {
+		var entries []TreeEntry
+		if entries, err = parseTree(o, t.hashSize); err != nil {
+			return OBJ_INVALID, nil, fmt.Errorf("failed to parse tree %v: %w", sum, err)
+		}
+		for _, e := range entries {
 			err = w(filepath.Join(append(nodes[:i+1], e.name)...), e.ShaSum)
 			if err != nil {
 				return
@@ -106,11 +258,16 @@ checkTrees:
 				err = ErrNotATree
 				return
 			}
+			sum = e.ShaSum
 			continue checkTrees
 		}
 		return OBJ_INVALID, nil, ErrObjectNotFound
 	}
-	for _, e := range ExtractTreeEntries(o) {
+	entries, err := parseTree(o, t.hashSize)
+	if err != nil {
+		return OBJ_INVALID, nil, fmt.Errorf("failed to parse tree %v: %w", sum, err)
+	}
+	for _, e := range entries {
 		err = w(filepath.Join(append(dirs, e.name)...), e.ShaSum)
 		if err != nil {
 			return
@@ -122,4 +279,44 @@ checkTrees:
 	return OBJ_INVALID, nil, ErrObjectNotFound
 }
 
-type TreeWalker func(path, sum string) error
+// entry returns the entry at the given path in the tree, without reading the object it refers to.
+// Returns ErrObjectNotFound if there is no such entry.
+func (t Tree) entry(path string) (TreeEntry, error) {
+	sum, o := t.shaSum, t.objectData
+	nodes := strings.Split(strings.Trim(path, "/"), "/")
+	for i, name := range nodes {
+		entries, err := parseTree(o, t.hashSize)
+		if err != nil {
+			return TreeEntry{}, fmt.Errorf("failed to parse tree %v: %w", sum, err)
+		}
+		var found bool
+		var e TreeEntry
+		for _, e = range entries {
+			if e.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return TreeEntry{}, ErrObjectNotFound
+		}
+		if i == len(nodes)-1 {
+			return e, nil
+		}
+		if !e.IsDir() {
+			return TreeEntry{}, ErrObjectNotFound
+		}
+		var otype ObjectType
+		otype, o, err = t.repo.Object(e.ShaSum)
+		if err != nil {
+			return TreeEntry{}, err
+		}
+		if otype != OBJ_TREE {
+			return TreeEntry{}, ErrNotATree
+		}
+		sum = e.ShaSum
+	}
+	return TreeEntry{}, ErrObjectNotFound
+}
+
+type TreeWalker func(path string, sum Hash) error
@@ -0,0 +1,129 @@
+package gitwood
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// treeEntry encodes a tree entry with an ID of size bytes, all set to b.
+func treeEntry(mode, name string, size int, b byte) string {
+	return mode + " " + name + "\x00" + string(bytes.Repeat([]byte{b}, size))
+}
+
+func TestParseTree(t *testing.T) {
+	file := treeEntry("100644", "a.txt", SHA1Size, 1)
+	dir := treeEntry("40000", "b", SHA1Size, 2)
+	tests := []struct {
+		name     string
+		tree     string
+		hashSize int
+		want     int
+		offset   int
+		err      error
+	}{
+		{"empty", "", SHA1Size, 0, 0, nil},
+		{"entries", file + dir, SHA1Size, 2, 0, nil},
+		{"sha256", treeEntry("100644", "a.txt", SHA256Size, 1) + treeEntry("40000", "b", SHA256Size, 2), SHA256Size, 2, 0, nil},
+		{"sha1 entry in sha256 tree", file, SHA256Size, 0, 0, ErrTruncatedTreeEntry},
+		{"sha256 entries in sha1 tree", treeEntry("100644", "a.txt", SHA256Size, 1), SHA1Size, 1, 33, ErrTruncatedTreeEntry},
+		{"truncated id", file + dir[:len(dir)-1], SHA1Size, 1, len(file), ErrTruncatedTreeEntry},
+		{"no name terminator", file + "100644 c", SHA1Size, 1, len(file), ErrTruncatedTreeEntry},
+		{"no space", file + "100644", SHA1Size, 1, len(file), ErrTruncatedTreeEntry},
+		{"non-octal mode", treeEntry("100648", "a", SHA1Size, 1), SHA1Size, 0, 0, ErrBadTreeMode},
+		{"empty mode", treeEntry("", "a", SHA1Size, 1), SHA1Size, 0, 0, ErrBadTreeMode},
+		{"mode overflow", treeEntry("77777777777", "a", SHA1Size, 1), SHA1Size, 0, 0, ErrBadTreeMode},
+		{"empty name", file + treeEntry("100644", "", SHA1Size, 1), SHA1Size, 1, len(file), ErrEmptyTreeName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseTree([]byte(tt.tree), tt.hashSize)
+			if len(entries) != tt.want {
+				t.Errorf("parseTree() returned %d entries, want %d", len(entries), tt.want)
+			}
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("parseTree() error = %v", err)
+				}
+				return
+			}
+			var te *TreeError
+			if !errors.As(err, &te) || !errors.Is(err, ErrMalformedTree) || !errors.Is(err, tt.err) {
+				t.Fatalf("parseTree() error = %v, want a *TreeError for %v", err, tt.err)
+			}
+			if te.Offset != tt.offset {
+				t.Errorf("TreeError.Offset = %d, want %d", te.Offset, tt.offset)
+			}
+		})
+	}
+}
+
+func TestParseTreeEntries(t *testing.T) {
+	tree := treeEntry("100755", "run", SHA256Size, 1) + treeEntry("160000", "sub", SHA256Size, 2)
+	entries, err := parseTree([]byte(tree), SHA256Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TreeEntry{
+		{Mode: ModeExecutable, name: "run", ShaSum: hashFromBytes(bytes.Repeat([]byte{1}, SHA256Size))},
+		{Mode: ModeSubmodule, name: "sub", ShaSum: hashFromBytes(bytes.Repeat([]byte{2}, SHA256Size))},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseTree() = %v, want %v", entries, want)
+	}
+}
+
+func FuzzParseTree(f *testing.F) {
+	f.Add([]byte(treeEntry("100644", "a.txt", SHA1Size, 1)+treeEntry("40000", "b", SHA1Size, 2)), false)
+	f.Add([]byte(treeEntry("120000", "link", SHA256Size, 3)), true)
+	f.Add([]byte(treeEntry("100644", "", SHA1Size, 1)), false)
+	f.Add([]byte("100644 a\x00abc"), false)
+	f.Add([]byte("1006448 a\x00"), true)
+	f.Fuzz(func(t *testing.T, tree []byte, sha256 bool) {
+		format := SHA1
+		if sha256 {
+			format = SHA256
+		}
+		entries, err := parseTree(tree, format.Size())
+		if err != nil && !errors.Is(err, ErrMalformedTree) {
+			t.Fatalf("parseTree() error = %v, want %v", err, ErrMalformedTree)
+		}
+		s := NewTreeScanner(tree, format)
+		var scanned []TreeEntry
+		for s.Scan() {
+			e := s.Entry()
+			if e.name == "" || e.ShaSum.Size() != format.Size() {
+				t.Fatalf("Scan() returned entry %q with a %d byte ID", e.name, e.ShaSum.Size())
+			}
+			scanned = append(scanned, e)
+		}
+		if len(scanned) != len(entries) || len(entries) > 0 && !reflect.DeepEqual(scanned, entries) {
+			t.Fatalf("TreeScanner returned %v, parseTree %v", scanned, entries)
+		}
+		if !reflect.DeepEqual(s.Err(), err) {
+			t.Fatalf("TreeScanner.Err() = %v, parseTree error = %v", s.Err(), err)
+		}
+	})
+}
+
+func TestTreeEntryString(t *testing.T) {
+	sum := hashFromBytes(bytes.Repeat([]byte{0xab}, SHA1Size))
+	tests := []struct {
+		e    TreeEntry
+		want string
+	}{
+		{TreeEntry{Mode: ModeFile, name: "a.txt", ShaSum: sum}, "(ababababa) [100644] a.txt"},
+		{TreeEntry{Mode: ModeDir, name: "dir", ShaSum: sum}, "(ababababa) [ 40000] dir/"},
+		{TreeEntry{Mode: ModeExecutable, name: "run", ShaSum: sum}, "(ababababa) [100755] run*"},
+		{TreeEntry{Mode: ModeSymlink, name: "link", ShaSum: sum}, "(ababababa) [120000] link@"},
+		{TreeEntry{Mode: ModeSubmodule, name: "sub", ShaSum: sum}, "(ababababa) [160000] sub (submodule)"},
+		{TreeEntry{Mode: ModeFile, name: "null", ShaSum: hashFromBytes(make([]byte, SHA1Size))}, "(000000000) [100644] null"},
+		{TreeEntry{Mode: ModeFile, name: "zero"}, "() [100644] zero"},
+	}
+	for _, tt := range tests {
+		if got := tt.e.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
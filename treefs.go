@@ -0,0 +1,325 @@
+package gitwood
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+// FS returns a read-only file system of the commit's tree, like Tree.FS.
+// Files and directories have the commit time as their modification time.
+func (c Commit) FS() fs.FS {
+	return &treeFS{repo: c.repo, root: c.Tree, hashSize: c.repo.hashSize(), modTime: time.Unix(c.CommitTime(), 0)}
+}
+
+// FS returns a read-only file system of the tree, whose files are the blobs in it and directories the subtrees,
+// so that e.g. fs.WalkDir, fs.Glob, template.ParseFS and http.FileServer work on any revision without a checkout.
+// Entries have the modes a checkout would have, see FileMode.OSFileMode, the TreeEntry as Sys(),
+// and the zero modification time. Submodules are empty directories. Symlinks aren't followed:
+// opening one reads the link target, which is what its blob holds.
+// The file system implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS, and is safe for concurrent use.
+func (t Tree) FS() fs.FS {
+	return &treeFS{repo: t.repo, root: t.shaSum, rootData: t.objectData, hashSize: t.hashSize}
+}
+
+type treeFS struct {
+	repo Repo
+	root Hash
+	// rootData is the root tree, if it has been read.
+	rootData []byte
+	hashSize int
+	modTime  time.Time
+}
+
+// lookup returns the entry at the given path. The root is a ModeDir entry named ".".
+func (f *treeFS) lookup(op, name string) (TreeEntry, error) {
+	if !fs.ValidPath(name) {
+		return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := TreeEntry{Mode: ModeDir, name: ".", ShaSum: f.root}
+	if name == "." {
+		return e, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !e.Mode.IsDir() {
+			return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, err := f.entries(e)
+		if err != nil {
+			return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		found := false
+		for _, c := range entries {
+			if c.name == elem {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return e, nil
+}
+
+// entries returns the entries of a tree or submodule entry. Submodules have none.
+func (f *treeFS) entries(e TreeEntry) ([]TreeEntry, error) {
+	if e.Mode.IsSubmodule() {
+		return nil, nil
+	}
+	data := f.rootData
+	if e.ShaSum != f.root || data == nil {
+		otype, o, err := f.repo.Object(e.ShaSum)
+		if err != nil {
+			return nil, err
+		}
+		if otype != OBJ_TREE {
+			return nil, fmt.Errorf("%v: %w", e.ShaSum, ErrNotATree)
+		}
+		data = o
+	}
+	entries, err := parseTree(data, f.hashSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tree %v: %w", e.ShaSum, err)
+	}
+	return entries, nil
+}
+
+// blob returns the content of a file entry. The data may be shared with the repo's Cache.
+func (f *treeFS) blob(e TreeEntry) ([]byte, error) {
+	otype, o, err := f.repo.Object(e.ShaSum)
+	if err != nil {
+		return nil, err
+	}
+	if otype != OBJ_BLOB {
+		return nil, fmt.Errorf("%v is a %v, not a blob", e.ShaSum, otype)
+	}
+	return o, nil
+}
+
+// isDir reports whether the entry is a directory in the file system, which submodules are too.
+func isDir(e TreeEntry) bool {
+	return e.Mode.IsDir() || e.Mode.IsSubmodule()
+}
+
+// readDir returns the entries of a directory entry, sorted by name.
+func (f *treeFS) readDir(e TreeEntry) ([]fs.DirEntry, error) {
+	entries, err := f.entries(e)
+	if err != nil {
+		return nil, err
+	}
+	dir := make([]fs.DirEntry, len(entries))
+	for i, c := range entries {
+		dir[i] = &treeDirEntry{fsys: f, e: c}
+	}
+	// Trees are sorted as if the names of subtrees end with a slash.
+	sort.Slice(dir, func(i, j int) bool {
+		return dir[i].Name() < dir[j].Name()
+	})
+	return dir, nil
+}
+
+// stat returns the info of an entry. The size of files is that of their blob, which is taken from data
+// if the blob has been read, and otherwise from the object header.
+func (f *treeFS) stat(e TreeEntry, data []byte) (fs.FileInfo, error) {
+	var size int64
+	switch {
+	case isDir(e):
+	case data != nil:
+		size = int64(len(data))
+	default:
+		n, err := f.repo.objectSize(e.ShaSum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the size of object %v: %w", e.ShaSum, err)
+		}
+		size = int64(n)
+	}
+	return &treeFileInfo{e: e, size: size, modTime: f.modTime}, nil
+}
+
+func (f *treeFS) Open(name string) (fs.File, error) {
+	e, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir(e) {
+		entries, err := f.readDir(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		info, _ := f.stat(e, nil)
+		return &treeDir{name: name, info: info, entries: entries}, nil
+	}
+	data, err := f.blob(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info, _ := f.stat(e, data)
+	return &treeFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+func (f *treeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir(e) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	entries, err := f.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (f *treeFS) ReadFile(name string) ([]byte, error) {
+	e, err := f.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir(e) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	data, err := f.blob(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	// Callers of ReadFile may modify the data, which must not change the cached object.
+	if f.repo.Cache != nil {
+		data = append([]byte(nil), data...)
+	}
+	return data, nil
+}
+
+func (f *treeFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.stat(e, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+type treeFileInfo struct {
+	e       TreeEntry
+	size    int64
+	modTime time.Time
+}
+
+func (i *treeFileInfo) Name() string {
+	return i.e.name
+}
+
+func (i *treeFileInfo) Size() int64 {
+	return i.size
+}
+
+// Mode returns the mode a checkout would have, or fs.ModeIrregular for entries with unknown modes.
+func (i *treeFileInfo) Mode() fs.FileMode {
+	m, err := i.e.Mode.OSFileMode()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+	return m
+}
+
+func (i *treeFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *treeFileInfo) IsDir() bool {
+	return i.Mode().IsDir()
+}
+
+// Sys returns the TreeEntry.
+func (i *treeFileInfo) Sys() any {
+	return i.e
+}
+
+// treeDirEntry is an entry returned by ReadDir. Its info is read on demand, as the size of files is read from the header of their blob.
+type treeDirEntry struct {
+	fsys *treeFS
+	e    TreeEntry
+}
+
+func (d *treeDirEntry) Name() string {
+	return d.e.name
+}
+
+func (d *treeDirEntry) IsDir() bool {
+	return isDir(d.e)
+}
+
+func (d *treeDirEntry) Type() fs.FileMode {
+	return (&treeFileInfo{e: d.e}).Mode().Type()
+}
+
+func (d *treeDirEntry) Info() (fs.FileInfo, error) {
+	return d.fsys.stat(d.e, nil)
+}
+
+// treeFile is an open file of a treeFS.
+type treeFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *treeFile) Close() error {
+	return nil
+}
+
+// treeDir is an open directory of a treeFS.
+type treeDir struct {
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	// off is the number of entries read by ReadDir.
+	off int
+}
+
+func (d *treeDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *treeDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *treeDir) Close() error {
+	return nil
+}
+
+// ReadDir reads the entries of the directory, like fs.ReadDirFile.
+func (d *treeDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
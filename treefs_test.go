@@ -0,0 +1,105 @@
+package gitwood_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// fsHistory returns a builder with two commits, whose trees have a subtree, an executable, a symlink and a submodule.
+// The second commit changes the files of the first a little, so that they're deltas in packs with deltas.
+func fsHistory() (*gitwoodtest.Builder, []gitwood.Hash) {
+	b := gitwoodtest.New()
+	sub := b.Commit(gitwoodtest.Commit{Tree: b.Tree(), Message: "submodule\n"})
+	var commits []gitwood.Hash
+	for i, line := range []string{"first\n", "second\n"} {
+		readme := strings.Repeat("a line of the readme\n", 100) + line
+		src := b.Tree(
+			gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "main.go", ShaSum: b.Blob(strings.Repeat("// code\n", 100) + line)},
+			gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "empty", ShaSum: b.Blob("")},
+		)
+		root := b.Tree(
+			gitwoodtest.Entry{Mode: gitwood.ModeFile, Name: "README", ShaSum: b.Blob(readme)},
+			gitwoodtest.Entry{Mode: gitwood.ModeExecutable, Name: "run.sh", ShaSum: b.Blob("#!/bin/sh\necho " + line)},
+			gitwoodtest.Entry{Mode: gitwood.ModeSymlink, Name: "link", ShaSum: b.Blob("src/main.go")},
+			gitwoodtest.Entry{Mode: gitwood.ModeSubmodule, Name: "lib", ShaSum: sub},
+			gitwoodtest.Entry{Mode: gitwood.ModeDir, Name: "src", ShaSum: src},
+		)
+		committer := gitwoodtest.Signature{Name: "C O Mitter", Email: "committer@example.com", When: time.Unix(1600000000+int64(i)*3600, 0)}
+		commits = append(commits, b.Commit(gitwoodtest.Commit{Tree: root, Parents: commits, Committer: committer, Message: line}))
+	}
+	b.Ref("refs/heads/main", commits[len(commits)-1])
+	return b, commits
+}
+
+var fsFiles = []string{"README", "run.sh", "link", "lib", "src/main.go", "src/empty"}
+
+// checkFS checks fsys with fstest.TestFS, and that its files have the size, mode and modification time they should.
+func checkFS(t *testing.T, fsys fs.FS, modTime time.Time) {
+	t.Helper()
+	if err := fstest.TestFS(fsys, fsFiles...); err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]fs.FileMode{
+		".": fs.ModeDir | 0o755, "README": 0o644, "run.sh": 0o755, "link": fs.ModeSymlink | 0o777,
+		"lib": fs.ModeDir | 0o755, "src": fs.ModeDir | 0o755, "src/main.go": 0o644, "src/empty": 0o644,
+	}
+	for name, mode := range modes {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("Stat(%q).Mode() = %v, want %v", name, info.Mode(), mode)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("Stat(%q).ModTime() = %v, want %v", name, info.ModTime(), modTime)
+		}
+		if info.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(data)) {
+			t.Errorf("Stat(%q).Size() = %d, want %d", name, info.Size(), len(data))
+		}
+	}
+}
+
+func TestTreeFS(t *testing.T) {
+	b, commits := fsHistory()
+	for name, opts := range map[string]gitwoodtest.Options{
+		"loose":      {},
+		"pack":       {Pack: true},
+		"ofs-deltas": {Pack: true, Deltas: gitwoodtest.OfsDeltas},
+		"ref-deltas": {Pack: true, Deltas: gitwoodtest.RefDeltas},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, cache := range []bool{false, true} {
+				repo := b.Repo(t, opts)
+				if cache {
+					repo.Cache = gitwood.NewLRUObjectCache(1 << 20)
+				}
+				for _, sum := range commits {
+					c, err := repo.Commit(sum)
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkFS(t, c.FS(), time.Unix(c.CommitTime(), 0))
+					tree, err := repo.Tree(c.Tree)
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkFS(t, tree.FS(), time.Time{})
+				}
+			}
+		})
+	}
+}
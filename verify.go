@@ -0,0 +1,57 @@
+package gitwood
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// CorruptObjectError is returned when reading an object from a Repo with Verify set,
+// if the object can't be inflated, doesn't have the size its header declares, or doesn't hash to its ID.
+type CorruptObjectError struct {
+	// ShaSum is the ID of the object that was read.
+	ShaSum Hash
+	// Path is the loose object file, or the pack file the corrupt entry is in.
+	Path string
+	// Offset is the pack offset of the corrupt entry, which may be a delta base of the object,
+	// or -1 for loose objects.
+	Offset int64
+	// Err describes what is wrong with the object.
+	Err error
+}
+
+func (e *CorruptObjectError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("corrupt object %v in %v: %v", e.ShaSum, e.Path, e.Err)
+	}
+	return fmt.Sprintf("corrupt object %v in %v at offset %d: %v", e.ShaSum, e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptObjectError) Unwrap() error {
+	return e.Err
+}
+
+// checkHash returns an error if the object doesn't hash to the given ID.
+func (r *Repo) checkHash(shasum Hash, otype ObjectType, o []byte) error {
+	sum, err := r.ObjectFormat().hashObject(otype, int64(len(o)), bytes.NewReader(o))
+	if err != nil {
+		return err
+	}
+	if sum != shasum {
+		return fmt.Errorf("%v data hashes to %v", otype, sum)
+	}
+	return nil
+}
+
+// packFileName returns the name of the pack file read through file, for error messages.
+func packFileName(file io.ReaderAt) string {
+	switch f := file.(type) {
+	case *Pack:
+		return path.Join(f.dir, f.Name+".pack")
+	case *os.File:
+		return f.Name()
+	}
+	return ""
+}
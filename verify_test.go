@@ -0,0 +1,53 @@
+package gitwood_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haflan/gitwood"
+	"github.com/haflan/gitwood/gitwoodtest"
+)
+
+// TestVerifySwappedObject replaces a loose object with another valid object, which only the hash check can find.
+func TestVerifySwappedObject(t *testing.T) {
+	b := gitwoodtest.New()
+	want := b.Blob("hello\n")
+	other := b.Blob("other\n")
+	dir := t.TempDir()
+	if err := b.Write(dir, gitwoodtest.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	loose := func(sum gitwood.Hash) string {
+		return filepath.Join(dir, "objects", sum.String()[:2], sum.String()[2:])
+	}
+	data, err := os.ReadFile(loose(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(loose(want), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo := openRepo(t, dir)
+	if _, data, err := repo.Object(want); err != nil || string(data) != "other\n" {
+		t.Fatalf("Object() without Verify = %q, %v, want the swapped content", data, err)
+	}
+	repo.Verify = true
+	_, _, err = repo.Object(want)
+	var corrupt *gitwood.CorruptObjectError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Object() error = %v, want a CorruptObjectError", err)
+	}
+	if corrupt.ShaSum != want || corrupt.Path != loose(want) || corrupt.Offset != -1 {
+		t.Errorf("Object() error = %+v, want the loose object %v", corrupt, want)
+	}
+	// The error names the ID the content actually hashes to.
+	if corrupt.Err == nil || !strings.Contains(corrupt.Err.Error(), other.String()) {
+		t.Errorf("Object() error = %v, want it to name %v", corrupt.Err, other)
+	}
+	if _, data, err := repo.Object(other); err != nil || string(data) != "other\n" {
+		t.Errorf("Object() of the other blob = %q, %v", data, err)
+	}
+}